@@ -0,0 +1,86 @@
+package apierror
+
+import (
+	"errors"
+	"fmt"
+)
+
+/**
+the kinds of failure a StatusError can be, for use with errors.Is
+*/
+var ErrBadRequest = errors.New("bad request")
+var ErrPermissionDenied = errors.New("permission denied")
+var ErrNotFound = errors.New("not found")
+var ErrUnavailable = errors.New("server unavailable")
+
+/**
+the longest response body that is quoted in an error message
+*/
+const maxQuotedBody = 512
+
+/**
+StatusError is returned when a server answers with a status that means the request failed
+*/
+type StatusError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Body       string //the response body, as sent
+	Detail     string //a summary of the error the server described in the body, if it could be understood
+	Retryable  bool   //true if the same request might succeed later
+}
+
+func (e *StatusError) description() string {
+	switch {
+	case e.StatusCode == 400:
+		return "bad data"
+	case e.StatusCode == 401 || e.StatusCode == 403:
+		return "permission denied"
+	case e.StatusCode == 404:
+		return "not found"
+	case e.StatusCode >= 500:
+		return "not available"
+	default:
+		return fmt.Sprintf("unexpected status %d", e.StatusCode)
+	}
+}
+
+func (e *StatusError) Error() string {
+	reason := e.Detail
+	if reason == "" {
+		reason = e.Body
+		if len(reason) > maxQuotedBody {
+			reason = reason[:maxQuotedBody] + "..."
+		}
+	}
+	return fmt.Sprintf("API returned %s: %s (%s %s)", e.description(), reason, e.Method, e.URL)
+}
+
+/**
+makes errors.Is(err, ErrNotFound) and the like work on a StatusError
+*/
+func (e *StatusError) Is(target error) bool {
+	switch target {
+	case ErrBadRequest:
+		return e.StatusCode == 400
+	case ErrPermissionDenied:
+		return e.StatusCode == 401 || e.StatusCode == 403
+	case ErrNotFound:
+		return e.StatusCode == 404
+	case ErrUnavailable:
+		return e.StatusCode >= 500
+	default:
+		return false
+	}
+}
+
+/**
+returns the status code of the StatusError in `err`, or 0 if there isn't one
+*/
+func StatusCode(err error) int {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode
+	}
+	return 0
+}
@@ -0,0 +1,43 @@
+package apierror
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestStatusErrorIs(t *testing.T) {
+	for status, expected := range map[int]error{
+		400: ErrBadRequest,
+		401: ErrPermissionDenied,
+		403: ErrPermissionDenied,
+		404: ErrNotFound,
+		503: ErrUnavailable,
+	} {
+		err := fmt.Errorf("wrapped: %w", &StatusError{StatusCode: status})
+		if !errors.Is(err, expected) {
+			t.Errorf("Expected %d to be %s", status, expected)
+		}
+		for _, other := range []error{ErrBadRequest, ErrPermissionDenied, ErrNotFound, ErrUnavailable} {
+			if other != expected && errors.Is(err, other) {
+				t.Errorf("Did not expect %d to be %s", status, other)
+			}
+		}
+	}
+	if StatusCode(fmt.Errorf("wrapped: %w", &StatusError{StatusCode: 409})) != 409 {
+		t.Error("Expected the status code to be found through the wrapping")
+	}
+}
+
+func TestErrorMessage(t *testing.T) {
+	err := &StatusError{Method: "GET", URL: "http://vs/API/item/VX-1", StatusCode: 404, Body: "<xml/>", Detail: "notFound: Item VX-1"}
+	if err.Error() != "API returned not found: notFound: Item VX-1 (GET http://vs/API/item/VX-1)" {
+		t.Errorf("Unexpected message %q", err.Error())
+	}
+
+	err = &StatusError{Method: "GET", URL: "http://vs/", StatusCode: 502, Body: strings.Repeat("x", 2000)}
+	if len(err.Error()) > maxQuotedBody+100 {
+		t.Errorf("Expected a long body to be cut short, got %d characters", len(err.Error()))
+	}
+}
@@ -0,0 +1,386 @@
+package bundle
+
+import (
+	"errors"
+	"fmt"
+	"github.com/guardian/deliverable_bundler/logging"
+	"github.com/guardian/deliverable_bundler/vidispine"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+/**
+the container format of the bundle
+*/
+type ArchiveFormat int
+
+const (
+	FormatZip ArchiveFormat = iota
+	FormatTar
+	FormatTarGzip
+	FormatTarZstd
+)
+
+/**
+convert a format name from the configuration into an ArchiveFormat
+*/
+func ParseArchiveFormat(name string) (ArchiveFormat, error) {
+	switch strings.ToLower(name) {
+	case "", "zip":
+		return FormatZip, nil
+	case "tar":
+		return FormatTar, nil
+	case "tar.gz", "tgz":
+		return FormatTarGzip, nil
+	case "tar.zst", "tzst":
+		return FormatTarZstd, nil
+	default:
+		return FormatZip, fmt.Errorf("unknown output format '%s', expected zip, tar, tar.gz or tar.zst", name)
+	}
+}
+
+func (f ArchiveFormat) String() string {
+	switch f {
+	case FormatZip:
+		return "zip"
+	case FormatTar:
+		return "tar"
+	case FormatTarGzip:
+		return "tar.gz"
+	case FormatTarZstd:
+		return "tar.zst"
+	default:
+		return fmt.Sprintf("ArchiveFormat(%d)", int(f))
+	}
+}
+
+/**
+describes a file to be added to an archive
+*/
+type ArchiveEntry struct {
+	Name     string
+	Size     int64 //must be exact, tar needs to know it before any data is written
+	Modified time.Time
+	Compress bool                      //compress the entry, if the format supports per-entry compression
+	CRC32    uint32                    //CRC-32 of the content, if HasCRC32 is set
+	HasCRC32 bool                      //lets zip write the CRC and sizes of an uncompressed entry into its header
+	File     *vidispine.VSFileDocument //the file the entry came from, nil for content that the bundler generates itself
+	//for a metadata sidecar, the storage and file ID of the file it describes, as given by itemKey
+	SidecarOf string
+}
+
+/**
+ArchiveWriter is implemented by each of the output formats. Entries are added one at a time, from a single goroutine
+*/
+type ArchiveWriter interface {
+	//add a file to the archive, copying all of the data from `src`. Returns the SHA-1 checksum of the data as a hex string
+	AddEntry(entry *ArchiveEntry, src io.Reader) (string, error)
+	//returns true if the given file was already written in a previous run
+	IsComplete(storageId string, fileId string) bool
+	//returns every entry written so far, including any carried over from a previous run
+	Entries() []JournalEntry
+	//finish the archive
+	Close() error
+	//stop writing without finishing the archive, keeping what has been done so far so it can be resumed
+	Abort() error
+	//stop writing and remove the partial archive
+	Discard() error
+}
+
+/**
+open an archive of the given format at `filename`. If `resume` is set and there is a journal from a previous run of
+the same content list, the new entries are added after the last completed one. `logger` can be nil for the default
+*/
+func OpenArchive(format ArchiveFormat, filename string, contentListUri string, resume bool, logger *slog.Logger) (ArchiveWriter, error) {
+	logger = logging.OrDefault(logger).With("output", filename)
+	output, openErr := openJournalledOutput(filename, contentListUri, format, resume, logger)
+	if openErr != nil {
+		return nil, openErr
+	}
+
+	w, initErr := newArchiveWriter(format, output)
+	if initErr != nil && len(output.journal.Entries) > 0 {
+		logger.Warn("Could not resume archive, starting again", "error", initErr)
+		output.close()
+		output, openErr = openJournalledOutput(filename, contentListUri, format, false, logger)
+		if openErr != nil {
+			return nil, openErr
+		}
+		w, initErr = newArchiveWriter(format, output)
+	}
+
+	if initErr != nil {
+		output.close()
+		return nil, initErr
+	}
+	return w, nil
+}
+
+/**
+write an archive of the given format straight to `out`, for example stdout or an HTTP response. Nothing is
+journalled, so a streamed archive can't be resumed, and Abort and Discard just stop writing. The caller is
+responsible for closing `out` afterwards
+*/
+func OpenArchiveStream(format ArchiveFormat, out io.Writer, contentListUri string) (ArchiveWriter, error) {
+	output := &journalledOutput{
+		Filename: "-",
+		out:      out,
+		journal: &Journal{Header: JournalHeader{
+			ContentList: contentListUri,
+			OutputFile:  "-",
+			Format:      format.String(),
+			Started:     time.Now(),
+		}},
+		completed: make(map[string]JournalEntry),
+		logger:    slog.Default(),
+	}
+	return newArchiveWriter(format, output)
+}
+
+func newArchiveWriter(format ArchiveFormat, output *journalledOutput) (ArchiveWriter, error) {
+	switch format {
+	case FormatZip:
+		return newResumableZipWriter(output)
+	case FormatTar, FormatTarGzip, FormatTarZstd:
+		return newResumableTarWriter(output, format)
+	default:
+		return nil, fmt.Errorf("unsupported archive format %s", format)
+	}
+}
+
+const archiveCopyBufSize = 4 * 1024 * 1024
+
+func itemKey(storageId string, fileId string) string {
+	return storageId + "/" + fileId
+}
+
+/**
+start a journal record for an entry that begins at `offset`
+*/
+func newJournalEntry(entry *ArchiveEntry, offset int64, checksum string) JournalEntry {
+	rtn := JournalEntry{
+		Name:      entry.Name,
+		Offset:    offset,
+		Checksum:  checksum,
+		File:      entry.File,
+		SidecarOf: entry.SidecarOf,
+	}
+	if entry.File != nil {
+		rtn.StorageId = entry.File.StorageId
+		rtn.FileId = entry.File.Id
+	}
+	return rtn
+}
+
+/**
+journalledOutput is the output file of an archive together with its journal. It takes care of the parts of
+resuming that don't depend on the archive format.
+A streamed output has no file and an in-memory journal, so it can't be resumed but otherwise behaves the same way
+*/
+type journalledOutput struct {
+	Filename  string
+	out       io.Writer //where the archive data goes, this is `file` unless the output is streamed
+	file      *os.File
+	journal   *Journal
+	offset    int64 //where the next entry will start
+	completed map[string]JournalEntry
+	logger    *slog.Logger
+}
+
+/**
+open the output file and its journal. When resuming, the file is truncated back to the end of the last completed
+entry and positioned there. If resuming isn't possible a fresh file and journal are created
+*/
+func openJournalledOutput(filename string, contentListUri string, format ArchiveFormat, resume bool, logger *slog.Logger) (*journalledOutput, error) {
+	if resume {
+		output, resumeErr := resumeJournalledOutput(filename, contentListUri, format, logger)
+		if resumeErr == nil {
+			return output, nil
+		}
+		if !errors.Is(resumeErr, os.ErrNotExist) {
+			logger.Warn("Could not resume archive, starting again", "error", resumeErr)
+		}
+	}
+
+	fp, createErr := os.Create(filename)
+	if createErr != nil {
+		return nil, createErr
+	}
+
+	journal, journalErr := CreateJournal(JournalPath(filename), JournalHeader{
+		ContentList: contentListUri,
+		OutputFile:  filename,
+		Format:      format.String(),
+		Started:     time.Now(),
+	})
+	if journalErr != nil {
+		fp.Close()
+		return nil, journalErr
+	}
+
+	return &journalledOutput{
+		Filename:  filename,
+		out:       fp,
+		file:      fp,
+		journal:   journal,
+		completed: make(map[string]JournalEntry),
+		logger:    logger,
+	}, nil
+}
+
+func resumeJournalledOutput(filename string, contentListUri string, format ArchiveFormat, logger *slog.Logger) (*journalledOutput, error) {
+	journal, journalErr := OpenJournal(JournalPath(filename))
+	if journalErr != nil {
+		return nil, journalErr
+	}
+	if journal.Partial {
+		logger.Warn("Ignoring incomplete record at the end of the journal")
+	}
+	if journal.Header.ContentList != contentListUri {
+		journal.Close()
+		return nil, fmt.Errorf("journal is for content list %s, not %s", journal.Header.ContentList, contentListUri)
+	}
+	if journal.Header.Format != format.String() {
+		journal.Close()
+		return nil, fmt.Errorf("journal is for a %s archive, not %s", journal.Header.Format, format)
+	}
+
+	fp, openErr := os.OpenFile(filename, os.O_RDWR, 0644)
+	if openErr != nil {
+		journal.Close()
+		return nil, openErr
+	}
+
+	output, truncErr := truncateToJournal(filename, fp, journal, logger)
+	if truncErr != nil {
+		fp.Close()
+		journal.Close()
+		return nil, truncErr
+	}
+	return output, nil
+}
+
+func truncateToJournal(filename string, fp *os.File, journal *Journal, logger *slog.Logger) (*journalledOutput, error) {
+	info, statErr := fp.Stat()
+	if statErr != nil {
+		return nil, statErr
+	}
+
+	//only keep the entries that are contiguous from the start of the file and actually made it to disk
+	var resumeOffset int64
+	for i, entry := range journal.Entries {
+		if entry.Offset != resumeOffset || entry.End > info.Size() {
+			logger.Warn("Journal entry is not in the archive, discarding it and everything after", "entry", i, "name", entry.Name)
+			journal.Truncate(i)
+			break
+		}
+		resumeOffset = entry.End
+	}
+
+	rewriteErr := journal.Rewrite()
+	if rewriteErr != nil {
+		return nil, rewriteErr
+	}
+
+	truncErr := fp.Truncate(resumeOffset)
+	if truncErr != nil {
+		return nil, truncErr
+	}
+	_, seekErr := fp.Seek(resumeOffset, io.SeekStart)
+	if seekErr != nil {
+		return nil, seekErr
+	}
+
+	output := &journalledOutput{
+		Filename:  filename,
+		out:       fp,
+		file:      fp,
+		journal:   journal,
+		offset:    resumeOffset,
+		completed: make(map[string]JournalEntry),
+		logger:    logger,
+	}
+	for _, entry := range journal.Entries {
+		output.recordCompleted(entry)
+	}
+	logger.Info("Resuming archive", "completedEntries", len(journal.Entries), "bytes", resumeOffset)
+	return output, nil
+}
+
+func (o *journalledOutput) recordCompleted(entry JournalEntry) {
+	if entry.File != nil {
+		o.completed[itemKey(entry.StorageId, entry.FileId)] = entry
+	}
+}
+
+func (o *journalledOutput) IsComplete(storageId string, fileId string) bool {
+	_, found := o.completed[itemKey(storageId, fileId)]
+	return found
+}
+
+/**
+make sure everything written so far is on disk, then record the entry in the journal
+*/
+func (o *journalledOutput) commit(entry JournalEntry) error {
+	if o.file != nil {
+		syncErr := o.file.Sync()
+		if syncErr != nil {
+			return syncErr
+		}
+	}
+
+	appendErr := o.journal.Append(entry)
+	if appendErr != nil {
+		return appendErr
+	}
+	o.recordCompleted(entry)
+	o.offset = entry.End
+	return nil
+}
+
+/**
+close the output file and journal, removing the journal if the archive is complete
+*/
+func (o *journalledOutput) finish(complete bool) error {
+	if o.file == nil {
+		return nil
+	}
+
+	fileErr := o.file.Close()
+	o.journal.Close()
+	if fileErr != nil {
+		return fileErr
+	}
+	if complete {
+		return os.Remove(JournalPath(o.Filename))
+	}
+	return nil
+}
+
+func (o *journalledOutput) close() {
+	if o.file != nil {
+		o.file.Close()
+	}
+	o.journal.Close()
+}
+
+/**
+remove the output file and journal. They must already have been closed
+*/
+func (o *journalledOutput) remove() error {
+	if o.file == nil {
+		return nil
+	}
+
+	removeErr := os.Remove(o.Filename)
+	if removeErr != nil {
+		return removeErr
+	}
+	if journalErr := os.Remove(JournalPath(o.Filename)); journalErr != nil && !errors.Is(journalErr, os.ErrNotExist) {
+		return journalErr
+	}
+	return nil
+}
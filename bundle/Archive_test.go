@@ -0,0 +1,59 @@
+package bundle
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+/**
+a streamed archive goes to a plain io.Writer, so there is no file to seek in or journal to write
+*/
+func TestStreamedZip(t *testing.T) {
+	var output bytes.Buffer
+
+	w, openErr := OpenArchiveStream(FormatZip, &output, "file:///list.json")
+	if openErr != nil {
+		t.Fatal("Could not open stream: ", openErr)
+	}
+	addTestEntry(t, w, "VX-10", "first file content")
+	addTestEntry(t, w, "VX-11", "second file content")
+	if len(w.Entries()) != 2 || !w.IsComplete("VX-1", "VX-10") {
+		t.Error("Expected the streamed entries to be tracked in memory")
+	}
+	if closeErr := w.Close(); closeErr != nil {
+		t.Fatal("Could not close stream: ", closeErr)
+	}
+
+	reader, readErr := zip.NewReader(bytes.NewReader(output.Bytes()), int64(output.Len()))
+	if readErr != nil {
+		t.Fatal("Could not read back streamed zip: ", readErr)
+	}
+	if len(reader.File) != 2 {
+		t.Fatalf("Expected 2 entries, got %d", len(reader.File))
+	}
+	src, _ := reader.File[1].Open()
+	content, _ := ioutil.ReadAll(src)
+	if string(content) != "second file content" {
+		t.Errorf("Unexpected content '%s'", string(content))
+	}
+}
+
+func TestStreamedTar(t *testing.T) {
+	for _, format := range []ArchiveFormat{FormatTar, FormatTarGzip, FormatTarZstd} {
+		var output bytes.Buffer
+
+		w, openErr := OpenArchiveStream(format, &output, "file:///list.json")
+		if openErr != nil {
+			t.Fatalf("Could not open %s stream: %s", format, openErr)
+		}
+		addTestEntry(t, w, "VX-10", "first file content")
+		if closeErr := w.Close(); closeErr != nil {
+			t.Fatalf("Could not close %s stream: %s", format, closeErr)
+		}
+		if output.Len() == 0 {
+			t.Errorf("%s: nothing was written to the stream", format)
+		}
+	}
+}
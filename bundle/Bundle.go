@@ -0,0 +1,336 @@
+package bundle
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/guardian/deliverable_bundler/contentlist"
+	"github.com/guardian/deliverable_bundler/logging"
+	"github.com/guardian/deliverable_bundler/metrics"
+	"github.com/guardian/deliverable_bundler/vidispine"
+	"log/slog"
+)
+
+/**
+BundleConfig holds everything that controls how a content list is turned into an archive
+*/
+type BundleConfig struct {
+	Pipeline          PipelineConfig
+	NamingMode        NamingMode
+	NamingStripPrefix string
+	NamingTemplate    string
+	Compression       *CompressionPolicy
+	ChecksumPolicy    ChecksumPolicy
+	FailurePolicy     FailurePolicy
+	PreferredStorages []string //storages to download from, best first, when an item's shape has copies on several
+	ManifestFormats   ManifestFormats
+	ManifestName      string
+	Sidecar           SidecarConfig //item metadata to write next to each file
+	Logger            *slog.Logger  //where progress and warnings are logged. nil means the default logger
+	//if set, this is called once each item in the content list has been added to the archive, with its position
+	//in the list and its archive entry, or once it has failed, in which case the entry is nil. The error for an
+	//item that was skipped matches ErrSkipped. Items carried over from a previous run are reported before any
+	//downloads start
+	ItemDone ItemDoneFunc
+}
+
+type ItemDoneFunc func(index int, item contentlist.ContentList, entry *JournalEntry, err error)
+
+/**
+returns a configuration with the same defaults as the bundler command
+*/
+func DefaultBundleConfig() *BundleConfig {
+	return &BundleConfig{
+		Pipeline:        DefaultPipelineConfig(),
+		NamingMode:      NameBasename,
+		Compression:     DefaultCompressionPolicy(),
+		ChecksumPolicy:  ChecksumFlag,
+		ManifestFormats: ManifestFormats{JSON: true},
+		ManifestName:    "manifest",
+	}
+}
+
+/**
+BundleResult describes what went into a bundle
+*/
+type BundleResult struct {
+	Manifest         *Manifest
+	ChecksumFailures []string        //files whose content did not match the Vidispine hash, if the policy is to flag them
+	Skipped          []SkippedItem   //items that were left out because of the failure policy
+	StateDecisions   []StateDecision //files that were not ready to download when they were first looked at, and what was done
+}
+
+/**
+returns true if the bundle was finished without some of the items
+*/
+func (r *BundleResult) Partial() bool {
+	return r != nil && len(r.Skipped) > 0
+}
+
+/**
+passed to BundleConfig.ItemDone, wrapped along with the reason, for an item that was left out of the bundle
+*/
+var ErrSkipped = errors.New("skipped")
+
+/**
+check the staged content against the hash Vidispine has for the file, before it goes anywhere near the archive.
+Returns a *ChecksumMismatchError if it doesn't match, or nil if it does or the policy is not to check
+*/
+func verifyStagedFile(staged *StagedFile, checksumPolicy ChecksumPolicy, logger *slog.Logger) error {
+	if checksumPolicy == ChecksumIgnore {
+		return nil
+	}
+
+	verifyErr := VerifyChecksum(staged.FileData, staged.SHA1, logger)
+	if verifyErr != nil {
+		metrics.ChecksumFailure()
+	}
+	return verifyErr
+}
+
+/**
+add the staged file to the archive under `name`
+*/
+func addStagedFile(w ArchiveWriter, staged *StagedFile, name string, compress bool) error {
+	fileData := staged.FileData
+	entry := ArchiveEntry{
+		Name:     name,
+		Size:     fileData.Size,
+		Compress: compress,
+		CRC32:    staged.CRC32,
+		HasCRC32: true,
+		File:     fileData,
+	}
+
+	_, addErr := w.AddEntry(&entry, staged.Content)
+	return addErr
+}
+
+func lastEntry(w ArchiveWriter) *JournalEntry {
+	entries := w.Entries()
+	if len(entries) == 0 {
+		return nil
+	}
+	return &entries[len(entries)-1]
+}
+
+/**
+returns a copy of `items` with the file and storage filled in for the entries that name an item and shape. An entry
+that can't be resolved is either left unresolved and added to result.Skipped, if the failure policy allows it, or
+stops the bundle
+*/
+func resolveItems(ctx context.Context, comm *vidispine.VidispineCommunicator, items []contentlist.ContentList, config *BundleConfig, itemDone ItemDoneFunc, result *BundleResult, logger *slog.Logger) ([]contentlist.ContentList, error) {
+	rtn := make([]contentlist.ContentList, len(items))
+	copy(rtn, items)
+
+	var resolver *vidispine.ShapeResolver
+	for i := range rtn {
+		item := &rtn[i]
+		if !item.NeedsResolving() {
+			continue
+		}
+		if resolver == nil {
+			resolver = vidispine.NewShapeResolver(comm, config.PreferredStorages)
+		}
+
+		fileData, resolveErr := resolver.Resolve(ctx, item.ItemId, item.ShapeTag())
+		if resolveErr != nil {
+			if ctx.Err() != nil {
+				return rtn, contextError(ctx)
+			}
+			if !config.FailurePolicy.ShouldSkip(resolveErr) {
+				logger.Error("Could not find the file for an item", "itemId", item.ItemId, "shape", item.ShapeTag(), "error", resolveErr)
+				itemDone(i, *item, nil, resolveErr)
+				return rtn, resolveErr
+			}
+			logger.Warn("Leaving item out of the bundle", "itemId", item.ItemId, "shape", item.ShapeTag(), "error", resolveErr)
+			result.Skipped = append(result.Skipped, skippedItemFor(*item, resolveErr))
+			itemDone(i, *item, nil, fmt.Errorf("%w: %w", ErrSkipped, resolveErr))
+			continue
+		}
+		item.StorageId = fileData.StorageId
+		item.FileId = fileData.Id
+	}
+	return rtn, nil
+}
+
+/**
+download every item in the content list into `w` and add the manifest. Items that `w` already holds from a
+previous run are skipped. The writer is left open, so the caller decides whether to Close, Abort or Discard it.
+Cancelling `ctx` stops the downloads, as described for RunPipeline
+*/
+func BuildBundle(ctx context.Context, comm *vidispine.VidispineCommunicator, contentListUri string, items []contentlist.ContentList, w ArchiveWriter, config *BundleConfig) (*BundleResult, error) {
+	logger := logging.OrDefault(config.Logger)
+	itemDone := config.ItemDone
+	if itemDone == nil {
+		itemDone = func(int, contentlist.ContentList, *JournalEntry, error) {}
+	}
+
+	result := &BundleResult{}
+	items, resolveErr := resolveItems(ctx, comm, items, config, itemDone, result, logger)
+	if resolveErr != nil {
+		return result, resolveErr
+	}
+
+	namer, namerErr := NewEntryNamer(config.NamingMode, config.NamingStripPrefix, config.NamingTemplate)
+	if namerErr != nil {
+		return nil, namerErr
+	}
+	namer.Reserve(config.ManifestName + ".json")
+	namer.Reserve(config.ManifestName + ".csv")
+	namer.Reserve(config.ManifestName + failureReportSuffix)
+
+	previous := make(map[string]JournalEntry)
+	hasSidecar := make(map[string]bool)
+	for _, entry := range w.Entries() {
+		namer.Reserve(entry.Name)
+		previous[itemKey(entry.StorageId, entry.FileId)] = entry
+		if entry.SidecarOf != "" {
+			hasSidecar[entry.SidecarOf] = true
+		}
+	}
+
+	var remaining []contentlist.ContentList
+	var remainingIndex []int
+	for i, item := range items {
+		if item.NeedsResolving() {
+			//left out when its file could not be found
+			continue
+		}
+		if !w.IsComplete(item.StorageId, item.FileId) {
+			remaining = append(remaining, item)
+			remainingIndex = append(remainingIndex, i)
+			continue
+		}
+
+		fileLogger := logging.ForFile(logger, item.StorageId, item.FileId)
+		fileLogger.Debug("Completed by a previous run, skipping")
+		entry := previous[itemKey(item.StorageId, item.FileId)]
+		if config.Sidecar.Format != SidecarNone && !hasSidecar[itemKey(item.StorageId, item.FileId)] {
+			//the previous run stopped between writing the file and writing its sidecar, so put the sidecar in now
+			content, fetchErr := config.Sidecar.forFile(ctx, comm, item, entry.File, fileLogger)
+			switch {
+			case fetchErr != nil && config.FailurePolicy.ShouldSkip(fetchErr):
+				//the file is already in the archive, so only its sidecar is left out
+				fileLogger.Warn("Leaving metadata sidecar out of the bundle", "error", fetchErr)
+				result.Skipped = append(result.Skipped, skippedItemFor(item, fetchErr))
+			case fetchErr != nil:
+				fileLogger.Error("Could not get metadata sidecar", "error", fetchErr)
+				itemDone(i, item, nil, fetchErr)
+				return result, fetchErr
+			case content != nil:
+				if addErr := addSidecar(w, namer, entry.File, sidecarItemId(item, entry.File), entry.Name, bytes.NewReader(content), int64(len(content)), config.Sidecar.Format); addErr != nil {
+					fileLogger.Error("Could not add metadata sidecar to archive", "error", addErr)
+					itemDone(i, item, nil, addErr)
+					return result, addErr
+				}
+			}
+		}
+		itemDone(i, item, &entry, nil)
+	}
+
+	compression := config.Compression
+	if compression == nil {
+		compression = DefaultCompressionPolicy()
+	}
+
+	pipelineConfig := config.Pipeline
+	if pipelineConfig.Logger == nil {
+		pipelineConfig.Logger = logger
+	}
+	if config.Sidecar.Format != SidecarNone {
+		pipelineConfig.sidecar = &config.Sidecar
+	}
+	pipelineConfig.ContinueOnError = config.FailurePolicy != FailFast || (pipelineConfig.StatePolicy != nil && pipelineConfig.StatePolicy.skipsAny())
+
+	logger.Info("Downloading files", "files", len(remaining), "skipped", len(items)-len(remaining), "workers", pipelineConfig.Concurrency)
+
+	failedIndex := -1
+	pipelineErr := RunPipeline(ctx, comm, remaining, pipelineConfig, func(staged *StagedFile) error {
+		index := remainingIndex[staged.Index]
+		fileLogger := logging.ForFile(logger, staged.Item.StorageId, staged.Item.FileId)
+		if staged.State != nil {
+			result.StateDecisions = append(result.StateDecisions, *staged.State)
+		}
+		skip := func(err error) {
+			fileLogger.Warn("Leaving item out of the bundle", "error", err)
+			result.Skipped = append(result.Skipped, skippedItemFor(staged.Item, err))
+			itemDone(index, staged.Item, nil, fmt.Errorf("%w: %w", ErrSkipped, err))
+		}
+
+		if staged.Err != nil {
+			if !config.FailurePolicy.ShouldSkip(staged.Err) && !errors.Is(staged.Err, ErrStateSkipped) {
+				return &StageError{Index: staged.Index, Item: staged.Item, Err: staged.Err}
+			}
+			skip(staged.Err)
+			return nil
+		}
+
+		name := namer.NameInFolder(staged.Item.Folder, staged.FileData)
+
+		verifyErr := verifyStagedFile(staged, config.ChecksumPolicy, fileLogger)
+		switch {
+		case verifyErr == nil:
+		case config.ChecksumPolicy == ChecksumFlag:
+			fileLogger.Warn("Checksum mismatch", "error", verifyErr)
+			result.ChecksumFailures = append(result.ChecksumFailures, verifyErr.Error())
+		case config.FailurePolicy.ShouldSkip(verifyErr):
+			skip(verifyErr)
+			return nil
+		default:
+			fileLogger.Error("Checksum mismatch", "error", verifyErr)
+			failedIndex = index
+			itemDone(index, staged.Item, nil, verifyErr)
+			return verifyErr
+		}
+
+		addErr := addStagedFile(w, staged, name, compression.ShouldCompress(name))
+		if addErr != nil {
+			fileLogger.Error("Could not add stream to archive", "error", addErr)
+			failedIndex = index
+			itemDone(index, staged.Item, nil, addErr)
+			return addErr
+		}
+
+		entry := lastEntry(w)
+		if staged.Sidecar != nil {
+			itemId := sidecarItemId(staged.Item, staged.FileData)
+			if sidecarErr := addSidecar(w, namer, staged.FileData, itemId, name, staged.Sidecar, staged.SidecarSize, config.Sidecar.Format); sidecarErr != nil {
+				fileLogger.Error("Could not add metadata sidecar to archive", "error", sidecarErr)
+				failedIndex = index
+				itemDone(index, staged.Item, nil, sidecarErr)
+				return sidecarErr
+			}
+		}
+		itemDone(index, staged.Item, entry, nil)
+		return nil
+	})
+
+	if len(result.ChecksumFailures) > 0 {
+		logger.Warn("Some files did not match their Vidispine checksum", "files", len(result.ChecksumFailures))
+	}
+	if len(result.Skipped) > 0 {
+		logger.Warn("Some items were left out of the bundle", "skipped", len(result.Skipped))
+	}
+	if pipelineErr != nil {
+		//a failed download never reaches the sink, so find out which item it was from the staged file error
+		if failedIndex < 0 && pipelineErr != ErrCancelled {
+			if staged, isStaged := pipelineErr.(*StageError); isStaged {
+				itemDone(remainingIndex[staged.Index], staged.Item, nil, pipelineErr)
+			}
+		}
+		return result, pipelineErr
+	}
+
+	result.Manifest = NewManifest(contentListUri, w.Entries())
+	result.Manifest.Skipped = result.Skipped
+	result.Manifest.StateDecisions = result.StateDecisions
+	manifestErr := result.Manifest.AddToArchive(w, config.ManifestName, config.ManifestFormats)
+	if manifestErr != nil {
+		logger.Error("Could not add manifest to archive", "error", manifestErr)
+		return result, manifestErr
+	}
+	metrics.BundleCompleted(result.Manifest.Summary().Bytes)
+	return result, nil
+}
@@ -0,0 +1,317 @@
+package bundle
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/guardian/deliverable_bundler/contentlist"
+	"github.com/guardian/deliverable_bundler/vidispine"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+)
+
+/**
+a file served by fileCommunicator. The hash is worked out from the content, and the path from the file ID, unless
+they are set
+*/
+type testFile struct {
+	content []byte
+	hash    string
+	path    string
+	itemId  string
+}
+
+func newTestFile(size int, seed byte) *testFile {
+	content := make([]byte, size)
+	for i := range content {
+		content[i] = byte(i%251) + seed
+	}
+	return &testFile{content: content}
+}
+
+/**
+counts the requests made to a fileCommunicator
+*/
+type requestLog struct {
+	mutex    sync.Mutex
+	requests []string
+}
+
+func (l *requestLog) add(request string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.requests = append(l.requests, request)
+}
+
+func (l *requestLog) count(prefix string) int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	rtn := 0
+	for _, request := range l.requests {
+		if strings.HasPrefix(request, prefix) {
+			rtn++
+		}
+	}
+	return rtn
+}
+
+/**
+returns a communicator for a test server that has `files` on storage VX-1. `intercept` can be nil, otherwise it is
+called first for every request and can answer it itself by returning true
+*/
+func fileCommunicator(t *testing.T, files map[string]*testFile, log *requestLog, intercept func(w http.ResponseWriter, r *http.Request) bool) *vidispine.VidispineCommunicator {
+	return testCommunicator(t, func(w http.ResponseWriter, r *http.Request) {
+		if log != nil {
+			log.add(r.URL.Path)
+		}
+		if intercept != nil && intercept(w, r) {
+			return
+		}
+		fileId, isData := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/API/storage/VX-1/file/"), "/data")
+		file, found := files[fileId]
+		if !found || !strings.HasPrefix(r.URL.Path, "/API/storage/VX-1/file/") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if !isData {
+			hash := file.hash
+			if hash == "" {
+				sum := sha1.Sum(file.content)
+				hash = hex.EncodeToString(sum[:])
+			}
+			filePath := file.path
+			if filePath == "" {
+				filePath = "media/" + fileId + ".mxf"
+			}
+			item := ""
+			if file.itemId != "" {
+				item = "<item><id>" + file.itemId + "</id></item>"
+			}
+			fmt.Fprintf(w, "<FileDocument><id>%s</id><path>%s</path><state>CLOSED</state><size>%d</size><hash>%s</hash><storage>VX-1</storage>%s</FileDocument>",
+				fileId, filePath, len(file.content), hash, item)
+			return
+		}
+
+		var start, end int
+		if _, scanErr := fmt.Sscanf(r.Header.Get("Range"), "Bytes=%d-%d", &start, &end); scanErr != nil || end >= len(file.content) {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(file.content[start : end+1])
+	})
+}
+
+func testItems(fileIds ...string) []contentlist.ContentList {
+	rtn := make([]contentlist.ContentList, len(fileIds))
+	for i, fileId := range fileIds {
+		rtn[i] = contentlist.ContentList{StorageId: "VX-1", FileId: fileId}
+	}
+	return rtn
+}
+
+func testBundleConfig() *BundleConfig {
+	config := DefaultBundleConfig()
+	config.Pipeline.BufferSize = 256
+	return config
+}
+
+/**
+build a zip bundle of `items` in memory, returning the result and the archive's entries by name
+*/
+func buildTestBundle(t *testing.T, comm *vidispine.VidispineCommunicator, items []contentlist.ContentList, config *BundleConfig) (*BundleResult, map[string][]byte, error) {
+	var output bytes.Buffer
+	writer, openErr := OpenArchiveStream(FormatZip, &output, "https://vs.example/lists/test.json")
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	result, bundleErr := BuildBundle(context.Background(), comm, "https://vs.example/lists/test.json", items, writer, config)
+	if bundleErr != nil {
+		writer.Discard()
+		return result, nil, bundleErr
+	}
+	if closeErr := writer.Close(); closeErr != nil {
+		t.Fatal(closeErr)
+	}
+
+	archive, zipErr := zip.NewReader(bytes.NewReader(output.Bytes()), int64(output.Len()))
+	if zipErr != nil {
+		t.Fatal(zipErr)
+	}
+	return result, zipEntries(archive), nil
+}
+
+/**
+build a zip bundle of `items` into `outputFile`, resuming it if there is a journal. If `finish` is false the
+archive is aborted rather than closed, as if the run had been interrupted
+*/
+func buildFileBundle(t *testing.T, comm *vidispine.VidispineCommunicator, outputFile string, items []contentlist.ContentList, config *BundleConfig, finish bool) *BundleResult {
+	writer, openErr := OpenArchive(FormatZip, outputFile, "https://vs.example/lists/test.json", true, nil)
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	result, bundleErr := BuildBundle(context.Background(), comm, "https://vs.example/lists/test.json", items, writer, config)
+	if bundleErr != nil {
+		writer.Abort()
+		t.Fatal(bundleErr)
+	}
+	if !finish {
+		writer.Abort()
+		return result
+	}
+	if closeErr := writer.Close(); closeErr != nil {
+		t.Fatal(closeErr)
+	}
+	return result
+}
+
+/**
+returns the content of every entry in the archive, by name
+*/
+func zipEntries(archive *zip.Reader) map[string][]byte {
+	entries := make(map[string][]byte)
+	for _, file := range archive.File {
+		fp, _ := file.Open()
+		entries[file.Name], _ = io.ReadAll(fp)
+		fp.Close()
+	}
+	return entries
+}
+
+func readZipFile(t *testing.T, filename string) map[string][]byte {
+	reader, readErr := zip.OpenReader(filename)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	defer reader.Close()
+	return zipEntries(&reader.Reader)
+}
+
+func mismatchFiles() map[string]*testFile {
+	files := map[string]*testFile{
+		"VX-10": newTestFile(1000, 0),
+		"VX-11": newTestFile(1000, 1),
+	}
+	files["VX-11"].hash = strings.Repeat("0", 40)
+	return files
+}
+
+func TestChecksumFlag(t *testing.T) {
+	comm := fileCommunicator(t, mismatchFiles(), nil, nil)
+	config := testBundleConfig()
+	config.ChecksumPolicy = ChecksumFlag
+
+	result, entries, err := buildTestBundle(t, comm, testItems("VX-10", "VX-11"), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.ChecksumFailures) != 1 || !strings.Contains(result.ChecksumFailures[0], "VX-11") {
+		t.Errorf("Expected VX-11 to be flagged, got %v", result.ChecksumFailures)
+	}
+	if _, present := entries["VX-11.mxf"]; !present {
+		t.Error("Expected a flagged file to stay in the bundle")
+	}
+	summary := result.Manifest.Summary()
+	if summary.Verified != 1 || summary.Mismatched != 1 {
+		t.Errorf("Unexpected manifest summary %+v", summary)
+	}
+}
+
+func TestChecksumFailStopsBundle(t *testing.T) {
+	comm := fileCommunicator(t, mismatchFiles(), nil, nil)
+	config := testBundleConfig()
+	config.ChecksumPolicy = ChecksumFail
+
+	_, _, err := buildTestBundle(t, comm, testItems("VX-11", "VX-10"), config)
+	var mismatch *ChecksumMismatchError
+	if !errors.As(err, &mismatch) || mismatch.FileId != "VX-11" {
+		t.Errorf("Expected a checksum mismatch for VX-11, got %v", err)
+	}
+}
+
+func TestChecksumFailSkipped(t *testing.T) {
+	comm := fileCommunicator(t, mismatchFiles(), nil, nil)
+	config := testBundleConfig()
+	config.ChecksumPolicy = ChecksumFail
+	config.FailurePolicy = SkipFailed
+	outputFile := path.Join(t.TempDir(), "test.zip")
+
+	result := buildFileBundle(t, comm, outputFile, testItems("VX-11", "VX-10"), config, true)
+	entries := readZipFile(t, outputFile)
+	if _, present := entries["VX-11.mxf"]; present {
+		t.Error("Expected the skipped file to be left out of the archive")
+	}
+	if content, present := entries["VX-10.mxf"]; !present || !bytes.Equal(content, newTestFile(1000, 0).content) {
+		t.Error("Expected VX-10 to be in the archive in place of the skipped file")
+	}
+	if !result.Partial() || len(result.Skipped) != 1 || result.Skipped[0].FileId != "VX-11" {
+		t.Errorf("Expected VX-11 to be skipped, got %+v", result.Skipped)
+	}
+	if len(result.Manifest.Entries) != 1 || result.Manifest.Entries[0].FileId != "VX-10" {
+		t.Errorf("Expected only VX-10 in the manifest, got %+v", result.Manifest.Entries)
+	}
+	if _, present := entries["manifest"+failureReportSuffix]; !present {
+		t.Error("Expected a failure report for the skipped file")
+	}
+}
+
+func TestChecksumFailSkippedOnResume(t *testing.T) {
+	files := mismatchFiles()
+	comm := fileCommunicator(t, files, nil, nil)
+	config := testBundleConfig()
+	config.ChecksumPolicy = ChecksumFail
+	config.FailurePolicy = SkipFailed
+	config.ManifestFormats = ManifestFormats{}
+	outputFile := path.Join(t.TempDir(), "test.zip")
+
+	buildFileBundle(t, comm, outputFile, testItems("VX-11", "VX-10"), config, false)
+
+	//by the next run the file has been fixed, so it should go in under its own name
+	files["VX-11"].hash = ""
+	result := buildFileBundle(t, comm, outputFile, testItems("VX-11", "VX-10"), config, true)
+	if result.Partial() {
+		t.Errorf("Expected nothing to be skipped on resume, got %+v", result.Skipped)
+	}
+
+	entries := readZipFile(t, outputFile)
+	var names []string
+	for name := range entries {
+		if strings.HasSuffix(name, ".mxf") {
+			names = append(names, name)
+		}
+	}
+	if len(names) != 2 {
+		t.Errorf("Expected just the two files in the archive, got %v", names)
+	}
+	if content, present := entries["VX-11.mxf"]; !present || !bytes.Equal(content, files["VX-11"].content) {
+		t.Error("Expected the fixed file to be in the archive as VX-11.mxf")
+	}
+}
+
+func TestChecksumFailStreamedSkipped(t *testing.T) {
+	comm := fileCommunicator(t, mismatchFiles(), nil, nil)
+	config := testBundleConfig()
+	config.ChecksumPolicy = ChecksumFail
+	config.FailurePolicy = SkipFailed
+
+	//the file is checked before it is streamed, so it can be left out even though nothing can be taken back
+	result, entries, err := buildTestBundle(t, comm, testItems("VX-11", "VX-10"), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, present := entries["VX-11.mxf"]; present {
+		t.Error("Expected the mismatched file to be left out of the stream")
+	}
+	if len(result.Skipped) != 1 || result.Skipped[0].FileId != "VX-11" {
+		t.Errorf("Expected VX-11 to be skipped, got %+v", result.Skipped)
+	}
+}
@@ -0,0 +1,88 @@
+package bundle
+
+import (
+	"fmt"
+	"github.com/guardian/deliverable_bundler/logging"
+	"github.com/guardian/deliverable_bundler/vidispine"
+	"log/slog"
+	"strings"
+)
+
+/**
+what to do when a file's content doesn't match the hash Vidispine has for it
+*/
+type ChecksumPolicy int
+
+const (
+	ChecksumIgnore ChecksumPolicy = iota //don't check at all
+	ChecksumFlag                         //log the mismatch and carry on
+	ChecksumFail                         //fail the bundle
+)
+
+/**
+convert a policy name from the configuration into a ChecksumPolicy
+*/
+func ParseChecksumPolicy(name string) (ChecksumPolicy, error) {
+	switch strings.ToLower(name) {
+	case "ignore":
+		return ChecksumIgnore, nil
+	case "flag":
+		return ChecksumFlag, nil
+	case "fail":
+		return ChecksumFail, nil
+	default:
+		return ChecksumIgnore, fmt.Errorf("unknown checksum policy '%s', expected ignore, flag or fail", name)
+	}
+}
+
+func (p ChecksumPolicy) String() string {
+	switch p {
+	case ChecksumIgnore:
+		return "ignore"
+	case ChecksumFlag:
+		return "flag"
+	case ChecksumFail:
+		return "fail"
+	default:
+		return fmt.Sprintf("ChecksumPolicy(%d)", int(p))
+	}
+}
+
+/**
+returned when the SHA-1 of a downloaded file is not what Vidispine expected
+*/
+type ChecksumMismatchError struct {
+	StorageId string
+	FileId    string
+	Path      string
+	Expected  string
+	Actual    string
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("checksum mismatch for %s (%s on %s): expected %s, got %s", e.Path, e.FileId, e.StorageId, e.Expected, e.Actual)
+}
+
+/**
+compare the SHA-1 checksum of the downloaded data with the hash in the file document.
+Returns a *ChecksumMismatchError if they differ. If Vidispine has no SHA-1 hash for the file there is nothing to
+compare against, so a warning is logged to `logger` and nil is returned.
+*/
+func VerifyChecksum(fileData *vidispine.VSFileDocument, actual string, logger *slog.Logger) error {
+	expected := strings.ToLower(strings.TrimSpace(fileData.Hash))
+	if len(expected) != len(actual) {
+		logging.OrDefault(logger).Warn("Vidispine has no SHA-1 hash for the file, can't verify it", "path", fileData.Path)
+		return nil
+	}
+
+	if expected != strings.ToLower(actual) {
+		return &ChecksumMismatchError{
+			StorageId: fileData.StorageId,
+			FileId:    fileData.Id,
+			Path:      fileData.Path,
+			Expected:  expected,
+			Actual:    actual,
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package bundle
+
+import (
+	"context"
+	"fmt"
+	"github.com/guardian/deliverable_bundler/contentlist"
+	"github.com/guardian/deliverable_bundler/logging"
+	"github.com/guardian/deliverable_bundler/vidispine"
+	"log/slog"
+	"path"
+	"strings"
+)
+
+/**
+returns a copy of the content list with every collection entry replaced by entries for the items in it, in the
+order Vidispine lists them. The items inherit the collection entry's shape tag and folder, and the items of a nested
+collection go in a subfolder named after it. Call this before the list is given to a job, as it changes the
+positions of the entries
+*/
+func ExpandCollections(ctx context.Context, comm *vidispine.VidispineCommunicator, items []contentlist.ContentList, logger *slog.Logger) ([]contentlist.ContentList, error) {
+	logger = logging.OrDefault(logger)
+	rtn := make([]contentlist.ContentList, 0, len(items))
+	for _, item := range items {
+		if item.CollectionId == "" {
+			rtn = append(rtn, item)
+			continue
+		}
+
+		collection, collectionErr := vidispine.VSCollectionInfo(ctx, comm, item.CollectionId)
+		if collectionErr != nil {
+			return nil, fmt.Errorf("could not expand collection %s: %w", item.CollectionId, collectionErr)
+		}
+		expanded, expandErr := expandCollection(ctx, comm, collection, item.Shape, item.Folder, map[string]bool{}, logger)
+		if expandErr != nil {
+			return nil, fmt.Errorf("could not expand collection %s: %w", item.CollectionId, expandErr)
+		}
+		logger.Info("Expanded collection", "collectionId", item.CollectionId, "items", len(expanded))
+		rtn = append(rtn, expanded...)
+	}
+	return rtn, nil
+}
+
+/**
+returns the items in the collection and the collections within it. `parents` holds the collections that are being
+expanded further up, so that a collection that contains itself doesn't go round forever
+*/
+func expandCollection(ctx context.Context, comm *vidispine.VidispineCommunicator, collection *vidispine.VSCollectionDocument, shape string, folder string, parents map[string]bool, logger *slog.Logger) ([]contentlist.ContentList, error) {
+	parents[collection.Id] = true
+	defer delete(parents, collection.Id)
+
+	var rtn []contentlist.ContentList
+	for _, content := range collection.Content {
+		switch content.Type {
+		case "item":
+			rtn = append(rtn, contentlist.ContentList{ItemId: content.Id, Shape: shape, Folder: folder})
+		case "collection":
+			if parents[content.Id] {
+				logger.Warn("Collection contains itself, not expanding it again", "collectionId", content.Id)
+				continue
+			}
+			child, childErr := vidispine.VSCollectionInfo(ctx, comm, content.Id)
+			if childErr != nil {
+				return nil, childErr
+			}
+			childFolder := path.Join(folder, collectionFolderName(child))
+			childItems, expandErr := expandCollection(ctx, comm, child, shape, childFolder, parents, logger)
+			if expandErr != nil {
+				return nil, expandErr
+			}
+			rtn = append(rtn, childItems...)
+		}
+	}
+	return rtn, nil
+}
+
+/**
+returns the name of the subfolder for a nested collection
+*/
+func collectionFolderName(collection *vidispine.VSCollectionDocument) string {
+	name := strings.TrimSpace(strings.NewReplacer("/", "_", "\\", "_").Replace(collection.Name))
+	if name == "" || name == "." || name == ".." {
+		return collection.Id
+	}
+	return name
+}
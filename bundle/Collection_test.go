@@ -0,0 +1,81 @@
+package bundle
+
+import (
+	"context"
+	"github.com/guardian/deliverable_bundler/contentlist"
+	"github.com/guardian/deliverable_bundler/vidispine"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+var sampleCollections = map[string]string{
+	"VX-1": `<CollectionDocument id="VX-1"><name>Documentary</name>
+		<content><id>VX-100</id><type>item</type></content>
+		<content><id>VX-2</id><type>collection</type></content>
+		<content><id>VX-101</id><type>item</type></content>
+	</CollectionDocument>`,
+	"VX-2": `<CollectionDocument id="VX-2"><name>Rushes/Day 1</name>
+		<content><id>VX-102</id><type>item</type></content>
+		<content><id>VX-1</id><type>collection</type></content>
+	</CollectionDocument>`,
+}
+
+/**
+returns a communicator for a test server that answers with `handler`
+*/
+func testCommunicator(t *testing.T, handler http.HandlerFunc) *vidispine.VidispineCommunicator {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	serverUrl, _ := url.Parse(server.URL)
+	port, _ := strconv.Atoi(serverUrl.Port())
+	return &vidispine.VidispineCommunicator{Protocol: "http", Hostname: serverUrl.Hostname(), Port: port}
+}
+
+func collectionCommunicator(t *testing.T) *vidispine.VidispineCommunicator {
+	return testCommunicator(t, func(w http.ResponseWriter, r *http.Request) {
+		for collectionId, doc := range sampleCollections {
+			if r.URL.Path == "/API/collection/"+collectionId {
+				w.Write([]byte(doc))
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	})
+}
+
+func TestExpandCollections(t *testing.T) {
+	items := []contentlist.ContentList{
+		{StorageId: "VX-9", FileId: "VX-90"},
+		{CollectionId: "VX-1", Shape: "lowres", Folder: "Docs"},
+	}
+
+	expanded, err := ExpandCollections(context.Background(), collectionCommunicator(t), items, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []contentlist.ContentList{
+		{StorageId: "VX-9", FileId: "VX-90"},
+		{ItemId: "VX-100", Shape: "lowres", Folder: "Docs"},
+		{ItemId: "VX-102", Shape: "lowres", Folder: "Docs/Rushes_Day 1"},
+		{ItemId: "VX-101", Shape: "lowres", Folder: "Docs"},
+	}
+	if len(expanded) != len(expected) {
+		t.Fatalf("Expected %d entries, got %+v", len(expected), expanded)
+	}
+	for i := range expected {
+		if expanded[i] != expected[i] {
+			t.Errorf("Entry %d is %+v, expected %+v", i, expanded[i], expected[i])
+		}
+	}
+}
+
+func TestExpandMissingCollection(t *testing.T) {
+	_, err := ExpandCollections(context.Background(), collectionCommunicator(t), []contentlist.ContentList{{CollectionId: "VX-404"}}, nil)
+	if err == nil {
+		t.Error("Expected a missing collection to fail")
+	}
+}
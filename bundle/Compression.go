@@ -0,0 +1,133 @@
+package bundle
+
+import (
+	"fmt"
+	"mime"
+	"path"
+	"strings"
+)
+
+/**
+these are already compressed, so deflating them costs CPU for next to no saving
+*/
+var defaultStoredTypes = []string{
+	"video/*", "audio/*", "image/*",
+	".mov", ".mp4", ".m4v", ".mxf", ".mts", ".m2ts", ".mkv", ".avi", ".r3d", ".braw", ".dv",
+	".mp3", ".m4a", ".aac", ".wav", ".aif", ".aiff",
+	".jpg", ".jpeg", ".png", ".gif", ".tif", ".tiff", ".dng",
+	".zip", ".gz", ".tgz", ".zst", ".bz2", ".xz", ".7z",
+}
+
+/**
+sidecars and project files, which are mostly text and compress well
+*/
+var defaultCompressedTypes = []string{
+	"text/*", "application/xml", "application/json",
+	".xml", ".json", ".txt", ".csv", ".srt", ".vtt", ".edl", ".xmp", ".ale",
+	".prproj", ".fcpxml", ".aaf", ".omf", ".drp", ".aep",
+}
+
+/**
+CompressionPolicy decides which archive entries are compressed and which are stored as-is.
+Rules can be file extensions, like ".mov", full MIME types like "video/mp4", or wildcards like "video/*".
+An extension rule takes precedence over a MIME type rule, and files that match nothing get the default
+*/
+type CompressionPolicy struct {
+	Default bool
+	rules   map[string]bool
+}
+
+/**
+returns a policy that stores media and compresses everything else
+*/
+func DefaultCompressionPolicy() *CompressionPolicy {
+	p := &CompressionPolicy{Default: true, rules: make(map[string]bool)}
+	p.Store(defaultStoredTypes...)
+	p.Compress(defaultCompressedTypes...)
+	return p
+}
+
+/**
+build a policy from the configuration. `mode` is "auto" for the default rules, "none" to store everything or "all"
+to compress everything. `storeTypes` and `compressTypes` are comma-separated lists of extra rules that override
+the defaults
+*/
+func ParseCompressionPolicy(mode string, storeTypes string, compressTypes string) (*CompressionPolicy, error) {
+	var p *CompressionPolicy
+	switch strings.ToLower(mode) {
+	case "", "auto":
+		p = DefaultCompressionPolicy()
+	case "none", "store":
+		p = &CompressionPolicy{Default: false, rules: make(map[string]bool)}
+	case "all", "deflate":
+		p = &CompressionPolicy{Default: true, rules: make(map[string]bool)}
+	default:
+		return nil, fmt.Errorf("unknown compression mode '%s', expected auto, none or all", mode)
+	}
+
+	p.Store(splitTypeList(storeTypes)...)
+	p.Compress(splitTypeList(compressTypes)...)
+	return p, nil
+}
+
+func splitTypeList(list string) []string {
+	var rtn []string
+	for _, part := range strings.Split(list, ",") {
+		if trimmed := strings.TrimSpace(part); trimmed != "" {
+			rtn = append(rtn, trimmed)
+		}
+	}
+	return rtn
+}
+
+func normaliseRule(rule string) string {
+	rule = strings.ToLower(rule)
+	if !strings.Contains(rule, "/") && !strings.HasPrefix(rule, ".") {
+		rule = "." + rule
+	}
+	return rule
+}
+
+/**
+store files matching any of the given rules without compression
+*/
+func (p *CompressionPolicy) Store(rules ...string) {
+	for _, rule := range rules {
+		p.rules[normaliseRule(rule)] = false
+	}
+}
+
+/**
+compress files matching any of the given rules
+*/
+func (p *CompressionPolicy) Compress(rules ...string) {
+	for _, rule := range rules {
+		p.rules[normaliseRule(rule)] = true
+	}
+}
+
+/**
+returns true if the file with the given name should be compressed
+*/
+func (p *CompressionPolicy) ShouldCompress(name string) bool {
+	ext := strings.ToLower(path.Ext(name))
+	if ext != "" {
+		if compress, found := p.rules[ext]; found {
+			return compress
+		}
+
+		mimeType := mime.TypeByExtension(ext)
+		if semicolon := strings.Index(mimeType, ";"); semicolon >= 0 {
+			mimeType = mimeType[:semicolon]
+		}
+		if mimeType != "" {
+			if compress, found := p.rules[mimeType]; found {
+				return compress
+			}
+			if compress, found := p.rules[strings.SplitN(mimeType, "/", 2)[0]+"/*"]; found {
+				return compress
+			}
+		}
+	}
+	return p.Default
+}
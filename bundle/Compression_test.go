@@ -0,0 +1,27 @@
+package bundle
+
+import "testing"
+
+func TestCompressionPolicy(t *testing.T) {
+	policy, err := ParseCompressionPolicy("auto", "prproj", "video/quicktime")
+	if err != nil {
+		t.Fatal("Could not parse policy: ", err)
+	}
+
+	tests := map[string]bool{
+		"Card01/A001.MXF":      false,
+		"clip.mp4":             false,
+		"clip.webm":            false, //matched by video/*
+		"clip.mov":             false, //the extension rule beats the MIME type override
+		"KP-27179 RICH.prproj": false,
+		"notes.txt":            true,
+		"sidecar.XML":          true,
+		"unknown.thing":        true,
+	}
+
+	for name, expected := range tests {
+		if policy.ShouldCompress(name) != expected {
+			t.Errorf("Expected ShouldCompress(%s) to be %t", name, expected)
+		}
+	}
+}
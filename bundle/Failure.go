@@ -0,0 +1,122 @@
+package bundle
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/guardian/deliverable_bundler/apierror"
+	"github.com/guardian/deliverable_bundler/contentlist"
+	"io"
+	"strconv"
+	"strings"
+)
+
+/**
+what to do when an item of the content list can't be downloaded
+*/
+type FailurePolicy int
+
+const (
+	FailFast    FailurePolicy = iota //stop the bundle at the first failure
+	SkipMissing                      //leave out items that Vidispine says don't exist, and stop for anything else
+	SkipFailed                       //leave out any item that still fails once its retries have run out
+)
+
+/**
+convert a policy name from the configuration into a FailurePolicy
+*/
+func ParseFailurePolicy(name string) (FailurePolicy, error) {
+	switch strings.ToLower(name) {
+	case "fail-fast", "":
+		return FailFast, nil
+	case "skip-missing":
+		return SkipMissing, nil
+	case "skip-failed":
+		return SkipFailed, nil
+	default:
+		return FailFast, fmt.Errorf("unknown failure policy '%s', expected fail-fast, skip-missing or skip-failed", name)
+	}
+}
+
+func (p FailurePolicy) String() string {
+	switch p {
+	case FailFast:
+		return "fail-fast"
+	case SkipMissing:
+		return "skip-missing"
+	case SkipFailed:
+		return "skip-failed"
+	default:
+		return fmt.Sprintf("FailurePolicy(%d)", int(p))
+	}
+}
+
+/**
+returns true if the policy allows the bundle to carry on without the item that failed with `err`
+*/
+func (p FailurePolicy) ShouldSkip(err error) bool {
+	switch p {
+	case SkipMissing:
+		return errors.Is(err, apierror.ErrNotFound)
+	case SkipFailed:
+		return true
+	default:
+		return false
+	}
+}
+
+/**
+SkippedItem is an item of the content list that was left out of the bundle, and why
+*/
+type SkippedItem struct {
+	StorageId  string `json:"storageId"`
+	FileId     string `json:"fileId"`
+	ItemId     string `json:"itemId,omitempty"` //for an item entry whose file could not be found
+	Shape      string `json:"shape,omitempty"`
+	StatusCode int    `json:"statusCode,omitempty"` //the HTTP status that Vidispine gave, if it was a refusal
+	State      string `json:"state,omitempty"`      //the Vidispine state of the file, if that is why it was left out
+	Reason     string `json:"reason"`
+}
+
+func NewSkippedItem(storageId string, fileId string, err error) SkippedItem {
+	rtn := SkippedItem{
+		StorageId:  storageId,
+		FileId:     fileId,
+		StatusCode: apierror.StatusCode(err),
+		Reason:     err.Error(),
+	}
+	var stateErr *FileStateError
+	if errors.As(err, &stateErr) {
+		rtn.State = stateErr.State
+	}
+	return rtn
+}
+
+/**
+returns the SkippedItem for a content list entry, with its item and shape if it named one
+*/
+func skippedItemFor(item contentlist.ContentList, err error) SkippedItem {
+	rtn := NewSkippedItem(item.StorageId, item.FileId, err)
+	if item.ItemId != "" {
+		rtn.ItemId = item.ItemId
+		rtn.Shape = item.ShapeTag()
+	}
+	return rtn
+}
+
+/**
+write the failure report for the skipped items as CSV, one row per item
+*/
+func WriteFailureReport(w io.Writer, skipped []SkippedItem) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"storage_id", "file_id", "status_code", "reason", "item_id", "shape"})
+	for _, item := range skipped {
+		status := ""
+		if item.StatusCode != 0 {
+			status = strconv.Itoa(item.StatusCode)
+		}
+		writer.Write([]string{item.StorageId, item.FileId, status, item.Reason, item.ItemId, item.Shape})
+	}
+	writer.Flush()
+	return writer.Error()
+}
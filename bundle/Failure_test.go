@@ -0,0 +1,73 @@
+package bundle
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/guardian/deliverable_bundler/apierror"
+	"testing"
+)
+
+func TestParseFailurePolicy(t *testing.T) {
+	tests := map[string]FailurePolicy{
+		"":             FailFast,
+		"fail-fast":    FailFast,
+		"Skip-Missing": SkipMissing,
+		"skip-failed":  SkipFailed,
+	}
+	for name, expected := range tests {
+		policy, err := ParseFailurePolicy(name)
+		if err != nil || policy != expected {
+			t.Errorf("Expected '%s' to give %s, got %s (%v)", name, expected, policy, err)
+		}
+	}
+
+	if _, err := ParseFailurePolicy("ignore"); err == nil {
+		t.Error("Expected an unknown policy to be rejected")
+	}
+}
+
+func TestShouldSkip(t *testing.T) {
+	notFound := fmt.Errorf("could not look up file: %w", &apierror.StatusError{StatusCode: 404})
+	unavailable := &apierror.StatusError{StatusCode: 503}
+	other := errors.New("connection reset")
+
+	tests := []struct {
+		policy   FailurePolicy
+		err      error
+		expected bool
+	}{
+		{FailFast, notFound, false},
+		{SkipMissing, notFound, true},
+		{SkipMissing, unavailable, false},
+		{SkipMissing, other, false},
+		{SkipFailed, unavailable, true},
+		{SkipFailed, other, true},
+	}
+	for _, test := range tests {
+		if test.policy.ShouldSkip(test.err) != test.expected {
+			t.Errorf("Expected %s to give ShouldSkip(%v) = %t", test.policy, test.err, test.expected)
+		}
+	}
+}
+
+func TestWriteFailureReport(t *testing.T) {
+	skipped := []SkippedItem{
+		NewSkippedItem("VX-1", "VX-10", &apierror.StatusError{Method: "GET", URL: "/API/storage/VX-1/file/VX-10", StatusCode: 404, Detail: "no such file"}),
+		NewSkippedItem("VX-1", "VX-11", errors.New("read timed out, after retries")),
+	}
+	if skipped[0].StatusCode != 404 || skipped[1].StatusCode != 0 {
+		t.Errorf("Unexpected status codes: %+v", skipped)
+	}
+
+	var buffer bytes.Buffer
+	if err := WriteFailureReport(&buffer, skipped); err != nil {
+		t.Fatal(err)
+	}
+	expected := "storage_id,file_id,status_code,reason,item_id,shape\n" +
+		"VX-1,VX-10,404,API returned not found: no such file (GET /API/storage/VX-1/file/VX-10),,\n" +
+		"VX-1,VX-11,,\"read timed out, after retries\",,\n"
+	if buffer.String() != expected {
+		t.Errorf("Unexpected report:\n%s", buffer.String())
+	}
+}
@@ -0,0 +1,303 @@
+package bundle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/guardian/deliverable_bundler/apierror"
+	"github.com/guardian/deliverable_bundler/logging"
+	"github.com/guardian/deliverable_bundler/retry"
+	"github.com/guardian/deliverable_bundler/vidispine"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+what to do with a file that Vidispine reports as being in a given state
+*/
+type StateAction int
+
+const (
+	StateDownload StateAction = iota //download it as it is
+	StateFail                        //refuse the file, which fails the bundle unless the failure policy skips it
+	StateSkip                        //leave the file out of the bundle whatever the failure policy is
+	StateWait                        //poll until the file is in a state that can be downloaded, then act on that
+)
+
+/**
+convert an action name from the configuration into a StateAction
+*/
+func ParseStateAction(name string) (StateAction, error) {
+	switch strings.ToLower(name) {
+	case "download":
+		return StateDownload, nil
+	case "fail":
+		return StateFail, nil
+	case "skip":
+		return StateSkip, nil
+	case "wait":
+		return StateWait, nil
+	default:
+		return StateDownload, fmt.Errorf("unknown file state action '%s', expected download, fail, skip or wait", name)
+	}
+}
+
+func (a StateAction) String() string {
+	switch a {
+	case StateDownload:
+		return "download"
+	case StateFail:
+		return "fail"
+	case StateSkip:
+		return "skip"
+	case StateWait:
+		return "wait"
+	default:
+		return fmt.Sprintf("StateAction(%d)", int(a))
+	}
+}
+
+/**
+StatePolicy decides what happens to a file according to its Vidispine state
+*/
+type StatePolicy struct {
+	Actions      map[string]StateAction //action for each state. States that aren't listed are downloaded
+	WaitTimeout  time.Duration          //how long to wait for a file before treating it as failed
+	PollInterval time.Duration          //how often to look at a file that is being waited for
+	Rescan       bool                   //ask Vidispine to rescan the storage before acting on a file that can't be downloaded yet
+}
+
+/**
+returns the policy used when none is given: LOST and MISSING files fail, OPEN, TO_APPEAR and BEING_READ files are
+waited for for up to ten minutes, and anything else, like CLOSED, is downloaded
+*/
+func DefaultStatePolicy() *StatePolicy {
+	return &StatePolicy{
+		Actions: map[string]StateAction{
+			"LOST":       StateFail,
+			"MISSING":    StateFail,
+			"OPEN":       StateWait,
+			"TO_APPEAR":  StateWait,
+			"BEING_READ": StateWait,
+		},
+		WaitTimeout:  10 * time.Minute,
+		PollInterval: 30 * time.Second,
+		Rescan:       false,
+	}
+}
+
+/**
+change the policy's actions from a list of the form STATE=action,STATE=action, e.g. "LOST=skip,OPEN=fail" or
+"BEING_READ=download" to read files that Vidispine is still reading without waiting for them. States that aren't
+in the list keep their current action
+*/
+func (p *StatePolicy) ParseActions(spec string) error {
+	for _, term := range strings.Split(spec, ",") {
+		if strings.TrimSpace(term) == "" {
+			continue
+		}
+		state, actionName, found := strings.Cut(term, "=")
+		if !found {
+			return fmt.Errorf("file state action '%s' should be STATE=action", term)
+		}
+		action, parseErr := ParseStateAction(strings.TrimSpace(actionName))
+		if parseErr != nil {
+			return parseErr
+		}
+		p.Actions[strings.ToUpper(strings.TrimSpace(state))] = action
+	}
+	return nil
+}
+
+func (p *StatePolicy) actionFor(state string) StateAction {
+	return p.Actions[state]
+}
+
+/**
+returns true if any state is skipped outright, in which case the pipeline has to hand failures to the sink
+*/
+func (p *StatePolicy) skipsAny() bool {
+	for _, action := range p.Actions {
+		if action == StateSkip {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+StateDecision records what was done about a file that was not in a state to be downloaded when it was first looked at
+*/
+type StateDecision struct {
+	StorageId  string `json:"storageId"`
+	FileId     string `json:"fileId"`
+	State      string `json:"state"`      //the state the file was first seen in
+	FinalState string `json:"finalState"` //the state it was in when the decision was made
+	Action     string `json:"action"`     //download, fail or skip
+	Rescanned  bool   `json:"rescanned,omitempty"`
+	Waited     string `json:"waited,omitempty"` //how long the file was waited for
+}
+
+/**
+returned for a file that the state policy refused or skipped. It matches apierror.ErrNotFound for a LOST or MISSING
+file, so that the skip-missing failure policy applies to it, and ErrStateSkipped if the policy is to skip the file
+*/
+type FileStateError struct {
+	StorageId string
+	FileId    string
+	State     string
+	Action    StateAction
+	TimedOut  bool //the file was waited for but never became ready
+}
+
+/**
+matched by a FileStateError for a file whose state is skipped
+*/
+var ErrStateSkipped = errors.New("skipped because of its state")
+
+func (e *FileStateError) Error() string {
+	if e.TimedOut {
+		return fmt.Sprintf("file %s on %s was still %s when the wait timed out", e.FileId, e.StorageId, e.State)
+	}
+	return fmt.Sprintf("file %s on %s is %s", e.FileId, e.StorageId, e.State)
+}
+
+func (e *FileStateError) Is(target error) bool {
+	switch target {
+	case apierror.ErrNotFound:
+		return e.State == "LOST" || e.State == "MISSING"
+	case ErrStateSkipped:
+		return e.Action == StateSkip
+	default:
+		return false
+	}
+}
+
+/**
+applies a StatePolicy to the files in a pipeline. Each storage is only rescanned once per pipeline, but every file
+that was looked up before the rescan had a chance to take effect is looked at again
+*/
+type stateChecker struct {
+	policy  *StatePolicy
+	mutex   sync.Mutex
+	rescans map[string]*storageRescan
+}
+
+/**
+a rescan of one storage. `done` is closed once the request has finished, and `at` is set before that
+*/
+type storageRescan struct {
+	done chan struct{}
+	at   time.Time //when the storage was rescanned. Zero if the rescan failed
+}
+
+func newStateChecker(policy *StatePolicy) *stateChecker {
+	if policy == nil {
+		policy = DefaultStatePolicy()
+	}
+	return &stateChecker{policy: policy, rescans: make(map[string]*storageRescan)}
+}
+
+/**
+rescan the storage if nothing else has asked for it yet. Returns when the storage was rescanned, whichever file it
+was for, or a zero time if the rescan failed. Other files on the storage wait for the rescan request to finish, so
+that they all see when it happened, but files on other storages carry on
+*/
+func (c *stateChecker) rescan(ctx context.Context, comm *vidispine.VidispineCommunicator, storageId string, logger *slog.Logger) time.Time {
+	c.mutex.Lock()
+	pending, asked := c.rescans[storageId]
+	if !asked {
+		pending = &storageRescan{done: make(chan struct{})}
+		c.rescans[storageId] = pending
+	}
+	c.mutex.Unlock()
+
+	if asked {
+		select {
+		case <-pending.done:
+			return pending.at
+		case <-ctx.Done():
+			return time.Time{}
+		}
+	}
+
+	logger.Info("Asking Vidispine to rescan storage", "storageId", storageId)
+	if rescanErr := vidispine.VSRescanStorage(ctx, comm, storageId); rescanErr == nil {
+		pending.at = time.Now()
+	} else {
+		logger.Warn("Could not rescan storage", "storageId", storageId, "error", rescanErr)
+	}
+	close(pending.done)
+	return pending.at
+}
+
+/**
+look at the state of the file and act on it. `fetched` is when fileData was looked up. Returns the file information
+to download from, which may have been looked up again, and a decision if the file was not downloadable straight away.
+The error is a FileStateError if the file is not to be downloaded
+*/
+func (c *stateChecker) check(ctx context.Context, comm *vidispine.VidispineCommunicator, fileData *vidispine.VSFileDocument, fetched time.Time, logger *slog.Logger) (*vidispine.VSFileDocument, *StateDecision, error) {
+	action := c.policy.actionFor(fileData.State)
+	if action == StateDownload {
+		return fileData, nil, nil
+	}
+
+	logger = logging.OrDefault(logger)
+	decision := &StateDecision{StorageId: fileData.StorageId, FileId: fileData.Id, State: fileData.State}
+	pollInterval := c.policy.PollInterval
+	if pollInterval <= 0 {
+		pollInterval = DefaultStatePolicy().PollInterval
+	}
+	refresh := func() error {
+		if sleepErr := retry.Sleep(ctx, pollInterval); sleepErr != nil {
+			return sleepErr
+		}
+		updated, infoErr := vidispine.VSFileInfo(ctx, comm, fileData.StorageId, fileData.Id)
+		if infoErr != nil {
+			return infoErr
+		}
+		fileData = updated
+		action = c.policy.actionFor(fileData.State)
+		return nil
+	}
+
+	if c.policy.Rescan {
+		//a rescan is given a poll interval to take effect, and until then the file's information may be out of date
+		rescannedAt := c.rescan(ctx, comm, fileData.StorageId, logger)
+		if !rescannedAt.IsZero() && fetched.Before(rescannedAt.Add(pollInterval)) {
+			decision.Rescanned = true
+			if refreshErr := refresh(); refreshErr != nil {
+				return nil, decision, refreshErr
+			}
+		}
+	}
+
+	started := time.Now()
+	timedOut := false
+	for action == StateWait {
+		if time.Since(started) >= c.policy.WaitTimeout {
+			timedOut = true
+			break
+		}
+		logger.Info("Waiting for file to be ready", "state", fileData.State)
+		if refreshErr := refresh(); refreshErr != nil {
+			return nil, decision, refreshErr
+		}
+		decision.Waited = time.Since(started).Round(time.Second).String()
+	}
+
+	decision.FinalState = fileData.State
+	switch {
+	case timedOut:
+		decision.Action = StateFail.String()
+		return nil, decision, &FileStateError{StorageId: fileData.StorageId, FileId: fileData.Id, State: fileData.State, Action: StateFail, TimedOut: true}
+	case action == StateDownload:
+		decision.Action = StateDownload.String()
+		return fileData, decision, nil
+	default:
+		decision.Action = action.String()
+		return nil, decision, &FileStateError{StorageId: fileData.StorageId, FileId: fileData.Id, State: fileData.State, Action: action}
+	}
+}
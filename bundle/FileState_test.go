@@ -0,0 +1,232 @@
+package bundle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/guardian/deliverable_bundler/apierror"
+	"github.com/guardian/deliverable_bundler/vidispine"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testStatePolicy() *StatePolicy {
+	policy := DefaultStatePolicy()
+	policy.PollInterval = time.Millisecond
+	policy.WaitTimeout = time.Second
+	return policy
+}
+
+/**
+returns a communicator for a server where file VX-10 is in `before` until the storage has been rescanned or it has
+been looked at `polls` times, then in `after`
+*/
+func stateCommunicator(t *testing.T, before string, after string, polls int32, rescans *int32) *vidispine.VidispineCommunicator {
+	var lookups int32
+	return testCommunicator(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/API/storage/VX-1/rescan":
+			atomic.AddInt32(rescans, 1)
+		case "/API/storage/VX-1/file/VX-10":
+			state := before
+			if atomic.AddInt32(&lookups, 1) > polls || atomic.LoadInt32(rescans) > 0 {
+				state = after
+			}
+			fmt.Fprintf(w, "<FileDocument><id>VX-10</id><state>%s</state><storage>VX-1</storage></FileDocument>", state)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+}
+
+func TestStateDownload(t *testing.T) {
+	var rescans int32
+	comm := stateCommunicator(t, "CLOSED", "CLOSED", 0, &rescans)
+	fileData := &vidispine.VSFileDocument{Id: "VX-10", StorageId: "VX-1", State: "CLOSED"}
+
+	result, decision, err := newStateChecker(testStatePolicy()).check(context.Background(), comm, fileData, time.Now(), nil)
+	if err != nil || decision != nil || result != fileData {
+		t.Errorf("Expected a closed file to be downloaded without a decision, got %+v, %v", decision, err)
+	}
+}
+
+func TestStateWaitsForOpenFile(t *testing.T) {
+	var rescans int32
+	comm := stateCommunicator(t, "OPEN", "CLOSED", 2, &rescans)
+	fileData := &vidispine.VSFileDocument{Id: "VX-10", StorageId: "VX-1", State: "OPEN"}
+
+	result, decision, err := newStateChecker(testStatePolicy()).check(context.Background(), comm, fileData, time.Now(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.State != "CLOSED" || decision == nil || decision.State != "OPEN" || decision.FinalState != "CLOSED" || decision.Action != "download" || decision.Waited == "" {
+		t.Errorf("Unexpected decision: %+v", decision)
+	}
+}
+
+func TestStateWaitsForFileBeingRead(t *testing.T) {
+	var rescans int32
+	comm := stateCommunicator(t, "BEING_READ", "CLOSED", 2, &rescans)
+	fileData := &vidispine.VSFileDocument{Id: "VX-10", StorageId: "VX-1", State: "BEING_READ"}
+
+	result, decision, err := newStateChecker(testStatePolicy()).check(context.Background(), comm, fileData, time.Now(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.State != "CLOSED" || decision == nil || decision.State != "BEING_READ" || decision.Action != "download" || decision.Waited == "" {
+		t.Errorf("Expected a file being read to be waited for by default, got %+v", decision)
+	}
+}
+
+func TestStateWaitTimesOut(t *testing.T) {
+	var rescans int32
+	comm := stateCommunicator(t, "OPEN", "OPEN", 0, &rescans)
+	policy := testStatePolicy()
+	policy.WaitTimeout = 10 * time.Millisecond
+	fileData := &vidispine.VSFileDocument{Id: "VX-10", StorageId: "VX-1", State: "OPEN"}
+
+	_, decision, err := newStateChecker(policy).check(context.Background(), comm, fileData, time.Now(), nil)
+	var stateErr *FileStateError
+	if !errors.As(err, &stateErr) || !stateErr.TimedOut || decision.Action != "fail" {
+		t.Errorf("Expected the wait to time out, got %v (%+v)", err, decision)
+	}
+}
+
+func TestStateLostFile(t *testing.T) {
+	var rescans int32
+	comm := stateCommunicator(t, "LOST", "LOST", 0, &rescans)
+	fileData := &vidispine.VSFileDocument{Id: "VX-10", StorageId: "VX-1", State: "LOST"}
+
+	_, decision, err := newStateChecker(testStatePolicy()).check(context.Background(), comm, fileData, time.Now(), nil)
+	if !errors.Is(err, apierror.ErrNotFound) || errors.Is(err, ErrStateSkipped) || decision.Action != "fail" {
+		t.Errorf("Expected a lost file to be refused as missing, got %v (%+v)", err, decision)
+	}
+	if !SkipMissing.ShouldSkip(err) {
+		t.Error("Expected skip-missing to apply to a lost file")
+	}
+
+	policy := testStatePolicy()
+	if parseErr := policy.ParseActions("lost=skip, MISSING=skip"); parseErr != nil {
+		t.Fatal(parseErr)
+	}
+	_, _, err = newStateChecker(policy).check(context.Background(), comm, fileData, time.Now(), nil)
+	if !errors.Is(err, ErrStateSkipped) {
+		t.Errorf("Expected a lost file to be skipped, got %v", err)
+	}
+}
+
+func TestStateRescan(t *testing.T) {
+	var rescans int32
+	comm := stateCommunicator(t, "MISSING", "CLOSED", 100, &rescans)
+	policy := testStatePolicy()
+	policy.Rescan = true
+	checker := newStateChecker(policy)
+
+	fileData := &vidispine.VSFileDocument{Id: "VX-10", StorageId: "VX-1", State: "MISSING"}
+	result, decision, err := checker.check(context.Background(), comm, fileData, time.Now(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.State != "CLOSED" || !decision.Rescanned || decision.Action != "download" {
+		t.Errorf("Expected the file to be found after a rescan, got %+v", decision)
+	}
+
+	checker.check(context.Background(), comm, fileData, time.Now(), nil)
+	if rescans != 1 {
+		t.Errorf("Expected the storage to be rescanned once, got %d", rescans)
+	}
+}
+
+func TestStateRefreshedAfterAnotherFilesRescan(t *testing.T) {
+	var rescans int32
+	comm := stateCommunicator(t, "MISSING", "CLOSED", 100, &rescans)
+	policy := testStatePolicy()
+	policy.Rescan = true
+	policy.PollInterval = 50 * time.Millisecond
+	checker := newStateChecker(policy)
+
+	//this file was looked up before another file on the same storage asked for the rescan
+	fetched := time.Now()
+	other := &vidispine.VSFileDocument{Id: "VX-10", StorageId: "VX-1", State: "MISSING"}
+	checker.check(context.Background(), comm, other, time.Now(), nil)
+
+	fileData := &vidispine.VSFileDocument{Id: "VX-10", StorageId: "VX-1", State: "MISSING"}
+	result, decision, err := checker.check(context.Background(), comm, fileData, fetched, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rescans != 1 || result.State != "CLOSED" || !decision.Rescanned {
+		t.Errorf("Expected the file to be looked at again after the other file's rescan, got %+v with %d rescans", decision, rescans)
+	}
+
+	//but not if it was looked up once the rescan had taken effect
+	time.Sleep(policy.PollInterval)
+	_, decision, _ = checker.check(context.Background(), comm, fileData, time.Now(), nil)
+	if decision.Rescanned {
+		t.Error("Expected a file looked up after the rescan not to be looked at again")
+	}
+}
+
+func TestRescanDoesNotHoldUpOtherStorages(t *testing.T) {
+	release := make(chan struct{})
+	comm := testCommunicator(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/API/storage/VX-1/rescan" {
+			<-release
+		}
+	})
+	checker := newStateChecker(testStatePolicy())
+
+	slowDone := make(chan time.Time)
+	go func() {
+		slowDone <- checker.rescan(context.Background(), comm, "VX-1", slog.Default())
+	}()
+	//wait for the slow rescan to be asked for before starting the other one
+	for {
+		checker.mutex.Lock()
+		_, asked := checker.rescans["VX-1"]
+		checker.mutex.Unlock()
+		if asked {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	otherDone := make(chan time.Time)
+	go func() {
+		otherDone <- checker.rescan(context.Background(), comm, "VX-2", slog.Default())
+	}()
+	select {
+	case rescannedAt := <-otherDone:
+		if rescannedAt.IsZero() {
+			t.Error("Expected the other storage to be rescanned")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Expected the rescan of another storage not to wait for a slow one")
+	}
+
+	close(release)
+	if rescannedAt := <-slowDone; rescannedAt.IsZero() {
+		t.Error("Expected the slow storage to be rescanned once it answered")
+	}
+}
+
+func TestParseStateActions(t *testing.T) {
+	policy := DefaultStatePolicy()
+	if policy.actionFor("BEING_READ") != StateWait {
+		t.Errorf("Expected BEING_READ to be waited for by default, got %s", policy.actionFor("BEING_READ"))
+	}
+	if err := policy.ParseActions("OPEN=fail,BEING_READ=download"); err != nil {
+		t.Fatal(err)
+	}
+	if policy.actionFor("OPEN") != StateFail || policy.actionFor("BEING_READ") != StateDownload || policy.actionFor("LOST") != StateFail || policy.actionFor("CLOSED") != StateDownload {
+		t.Errorf("Unexpected actions: %v", policy.Actions)
+	}
+	for _, bad := range []string{"OPEN", "OPEN=ignore"} {
+		if err := policy.ParseActions(bad); err == nil {
+			t.Errorf("Expected '%s' to be rejected", bad)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package bundle
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/guardian/deliverable_bundler/vidispine"
+	"os"
+	"time"
+)
+
+/**
+the first line of a journal file, identifying which bundle it belongs to
+*/
+type JournalHeader struct {
+	ContentList string    `json:"contentList"`
+	OutputFile  string    `json:"outputFile"`
+	Format      string    `json:"format"`
+	Started     time.Time `json:"started"`
+}
+
+/**
+a record of a single entry that has been completely written to the archive
+*/
+type JournalEntry struct {
+	Name      string                    `json:"name"`
+	StorageId string                    `json:"storageId"`
+	FileId    string                    `json:"fileId"`
+	Offset    int64                     `json:"offset"` //position in the output file where the entry starts
+	End       int64                     `json:"end"`    //position in the output file just after the entry
+	Checksum  string                    `json:"checksum"`
+	Header    *zip.FileHeader           `json:"header,omitempty"`    //the completed zip header, for zip archives only
+	File      *vidispine.VSFileDocument `json:"file,omitempty"`      //the file the entry came from, nil for generated content
+	SidecarOf string                    `json:"sidecarOf,omitempty"` //for a metadata sidecar, the key of the file it describes
+}
+
+/**
+Journal is an append-only sidecar file that records each entry as it is completed, so that an interrupted
+bundle can be picked up where it left off.
+A Journal without a file only keeps the entries in memory, which is what streamed bundles use
+*/
+type Journal struct {
+	Header  JournalHeader
+	Entries []JournalEntry
+	Partial bool //set if OpenJournal found a partly written record at the end, and dropped it
+	file    *os.File
+}
+
+/**
+returns the path of the journal that goes with the given output file
+*/
+func JournalPath(outputFile string) string {
+	return outputFile + ".journal"
+}
+
+/**
+create a new, empty journal at the given path, replacing anything that was there before
+*/
+func CreateJournal(path string, header JournalHeader) (*Journal, error) {
+	fp, openErr := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if openErr != nil {
+		return nil, openErr
+	}
+
+	j := &Journal{Header: header, file: fp}
+	writeErr := j.writeLine(header)
+	if writeErr != nil {
+		fp.Close()
+		return nil, writeErr
+	}
+	return j, nil
+}
+
+/**
+read an existing journal and open it for appending. A partially written final line, from a crash mid-write,
+is ignored
+*/
+func OpenJournal(path string) (*Journal, error) {
+	fp, openErr := os.OpenFile(path, os.O_RDWR, 0644)
+	if openErr != nil {
+		return nil, openErr
+	}
+
+	j := &Journal{file: fp}
+	scanner := bufio.NewScanner(fp)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	if !scanner.Scan() {
+		fp.Close()
+		return nil, errors.New("journal is empty")
+	}
+	headerErr := json.Unmarshal(scanner.Bytes(), &j.Header)
+	if headerErr != nil {
+		fp.Close()
+		return nil, fmt.Errorf("could not read journal header: %s", headerErr)
+	}
+
+	validLength := int64(len(scanner.Bytes()) + 1)
+	for scanner.Scan() {
+		var entry JournalEntry
+		entryErr := json.Unmarshal(scanner.Bytes(), &entry)
+		if entryErr != nil {
+			j.Partial = true
+			break
+		}
+		j.Entries = append(j.Entries, entry)
+		validLength += int64(len(scanner.Bytes()) + 1)
+	}
+
+	//drop anything after the last good record so that new records start on a fresh line
+	truncErr := fp.Truncate(validLength)
+	if truncErr != nil {
+		fp.Close()
+		return nil, truncErr
+	}
+	_, seekErr := fp.Seek(validLength, 0)
+	if seekErr != nil {
+		fp.Close()
+		return nil, seekErr
+	}
+	return j, nil
+}
+
+func (j *Journal) writeLine(record interface{}) error {
+	if j.file == nil {
+		return nil
+	}
+
+	content, marshalErr := json.Marshal(record)
+	if marshalErr != nil {
+		return marshalErr
+	}
+
+	_, writeErr := j.file.Write(append(content, '\n'))
+	if writeErr != nil {
+		return writeErr
+	}
+	return j.file.Sync()
+}
+
+/**
+record a completed entry. The record is flushed to disk before this returns
+*/
+func (j *Journal) Append(entry JournalEntry) error {
+	writeErr := j.writeLine(entry)
+	if writeErr != nil {
+		return writeErr
+	}
+	j.Entries = append(j.Entries, entry)
+	return nil
+}
+
+/**
+forget everything after the first `count` entries. This only affects the in-memory copy, call Rewrite to persist it
+*/
+func (j *Journal) Truncate(count int) {
+	if count < len(j.Entries) {
+		j.Entries = j.Entries[:count]
+	}
+}
+
+/**
+write the header and current entries out again, replacing the journal file content
+*/
+func (j *Journal) Rewrite() error {
+	if j.file == nil {
+		return nil
+	}
+
+	truncErr := j.file.Truncate(0)
+	if truncErr != nil {
+		return truncErr
+	}
+	_, seekErr := j.file.Seek(0, 0)
+	if seekErr != nil {
+		return seekErr
+	}
+
+	headerErr := j.writeLine(j.Header)
+	if headerErr != nil {
+		return headerErr
+	}
+	for _, entry := range j.Entries {
+		entryErr := j.writeLine(entry)
+		if entryErr != nil {
+			return entryErr
+		}
+	}
+	return nil
+}
+
+func (j *Journal) Close() error {
+	if j.file == nil {
+		return nil
+	}
+	return j.file.Close()
+}
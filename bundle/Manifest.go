@@ -0,0 +1,265 @@
+package bundle
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+describes one file in the bundle
+*/
+type ManifestEntry struct {
+	ArchivePath    string            `json:"archivePath"`
+	OriginalPath   string            `json:"originalPath"`
+	StorageId      string            `json:"storageId"`
+	FileId         string            `json:"fileId"`
+	ItemId         string            `json:"itemId,omitempty"` //the item the file belongs to, if Vidispine said
+	Shape          string            `json:"shape,omitempty"`  //the tag of the item's shape that the file is part of
+	Size           int64             `json:"size"`
+	Hash           string            `json:"hash"`           //the hash Vidispine has for the file
+	Checksum       string            `json:"checksum"`       //the SHA-1 of the data that went into the archive
+	ChecksumStatus string            `json:"checksumStatus"` //verified, mismatch or unverified
+	Timestamp      string            `json:"timestamp"`
+	State          string            `json:"state,omitempty"`   //the Vidispine state of the file when it was downloaded
+	Sidecar        string            `json:"sidecar,omitempty"` //the archive path of the item metadata sidecar, if there is one
+	Metadata       map[string]string `json:"metadata"`
+}
+
+/**
+Manifest lists everything that went into a bundle, and where it came from
+*/
+type Manifest struct {
+	ContentList string          `json:"contentList"`
+	Built       time.Time       `json:"built"`
+	Entries     []ManifestEntry `json:"entries"`
+	Skipped     []SkippedItem   `json:"skipped,omitempty"` //items of the content list that are not in the bundle
+	//what was done about files that were lost, missing or not finished when they were looked at
+	StateDecisions []StateDecision `json:"stateDecisions,omitempty"`
+}
+
+/**
+added to the manifest name for the failure report, which goes into the archive if any items were skipped
+*/
+const failureReportSuffix = "-failures.csv"
+
+/**
+ManifestSummary gives the totals for a manifest, without listing every file
+*/
+type ManifestSummary struct {
+	Files      int   `json:"files"`
+	Bytes      int64 `json:"bytes"`
+	Verified   int   `json:"verified"`
+	Mismatched int   `json:"mismatched"`
+	Unverified int   `json:"unverified"`
+	Skipped    int   `json:"skipped"`
+}
+
+func (m *Manifest) Summary() ManifestSummary {
+	rtn := ManifestSummary{Skipped: len(m.Skipped)}
+	for _, entry := range m.Entries {
+		rtn.Files++
+		rtn.Bytes += entry.Size
+		switch entry.ChecksumStatus {
+		case "verified":
+			rtn.Verified++
+		case "mismatch":
+			rtn.Mismatched++
+		default:
+			rtn.Unverified++
+		}
+	}
+	return rtn
+}
+
+/**
+which manifest files to put into the archive
+*/
+type ManifestFormats struct {
+	JSON bool
+	CSV  bool
+}
+
+/**
+parse a comma-separated list of manifest formats, like "json,csv". "none" or an empty string turns the manifest off
+*/
+func ParseManifestFormats(spec string) (ManifestFormats, error) {
+	var rtn ManifestFormats
+
+	for _, part := range strings.Split(spec, ",") {
+		switch strings.ToLower(strings.TrimSpace(part)) {
+		case "json":
+			rtn.JSON = true
+		case "csv":
+			rtn.CSV = true
+		case "none", "":
+		default:
+			return rtn, fmt.Errorf("unknown manifest format '%s', expected json, csv or none", part)
+		}
+	}
+	return rtn, nil
+}
+
+func checksumStatus(hash string, checksum string) string {
+	expected := strings.ToLower(strings.TrimSpace(hash))
+	switch {
+	case checksum == "" || len(expected) != len(checksum):
+		return "unverified"
+	case expected == strings.ToLower(checksum):
+		return "verified"
+	default:
+		return "mismatch"
+	}
+}
+
+/**
+build a manifest from the entries recorded in a bundle's journal. Entries for generated content are left out, and
+metadata sidecars are listed with the file they describe
+*/
+func NewManifest(contentListUri string, entries []JournalEntry) *Manifest {
+	rtn := &Manifest{
+		ContentList: contentListUri,
+		Built:       time.Now(),
+		Entries:     make([]ManifestEntry, 0, len(entries)),
+	}
+
+	sidecars := make(map[string]string)
+	for _, entry := range entries {
+		if entry.SidecarOf != "" {
+			sidecars[entry.SidecarOf] = entry.Name
+		}
+	}
+
+	for _, entry := range entries {
+		if entry.File == nil {
+			continue
+		}
+
+		metadata := make(map[string]string, len(entry.File.Metadata))
+		for _, field := range entry.File.Metadata {
+			metadata[field.Key] = field.Value
+		}
+
+		rtn.Entries = append(rtn.Entries, ManifestEntry{
+			ArchivePath:    entry.Name,
+			OriginalPath:   entry.File.Path,
+			StorageId:      entry.StorageId,
+			FileId:         entry.FileId,
+			ItemId:         entry.File.ItemId(),
+			Shape:          entry.File.ShapeTag(),
+			Size:           entry.File.Size,
+			Hash:           entry.File.Hash,
+			Checksum:       entry.Checksum,
+			ChecksumStatus: checksumStatus(entry.File.Hash, entry.Checksum),
+			Timestamp:      entry.File.Timestamp,
+			State:          entry.File.State,
+			Sidecar:        sidecars[itemKey(entry.StorageId, entry.FileId)],
+			Metadata:       metadata,
+		})
+	}
+	return rtn
+}
+
+func (m *Manifest) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(m)
+}
+
+/**
+write the manifest as CSV, one row per entry. Metadata fields are flattened into a single key=value;key=value column.
+Skipped items get a row with no archive path and a checksum status of "skipped", and every row has the same columns.
+The state column is the Vidispine state of the file when it was downloaded, or when it was left out because of it
+*/
+func (m *Manifest) WriteCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	built := m.Built.Format(time.RFC3339)
+
+	writer.Write([]string{"archive_path", "original_path", "storage_id", "file_id", "size", "hash", "checksum", "checksum_status", "timestamp", "metadata", "content_list", "built", "item_id", "shape", "sidecar", "state"})
+	for _, entry := range m.Entries {
+		keys := make([]string, 0, len(entry.Metadata))
+		for k := range entry.Metadata {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		fields := make([]string, 0, len(keys))
+		for _, k := range keys {
+			fields = append(fields, fmt.Sprintf("%s=%s", k, entry.Metadata[k]))
+		}
+
+		writer.Write([]string{
+			entry.ArchivePath,
+			entry.OriginalPath,
+			entry.StorageId,
+			entry.FileId,
+			strconv.FormatInt(entry.Size, 10),
+			entry.Hash,
+			entry.Checksum,
+			entry.ChecksumStatus,
+			entry.Timestamp,
+			strings.Join(fields, ";"),
+			m.ContentList,
+			built,
+			entry.ItemId,
+			entry.Shape,
+			entry.Sidecar,
+			entry.State,
+		})
+	}
+	for _, skipped := range m.Skipped {
+		writer.Write([]string{"", "", skipped.StorageId, skipped.FileId, "", "", "", "skipped", "", "", m.ContentList, built, skipped.ItemId, skipped.Shape, "", skipped.State})
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+/**
+add the manifest to the archive in each of the requested formats, as `basename`.json and/or `basename`.csv. If any
+items were skipped, the failure report goes in as `basename`-failures.csv whatever the formats are
+*/
+func (m *Manifest) AddToArchive(w ArchiveWriter, basename string, formats ManifestFormats) error {
+	if formats.JSON {
+		var content bytes.Buffer
+		if writeErr := m.WriteJSON(&content); writeErr != nil {
+			return writeErr
+		}
+		entry := &ArchiveEntry{Name: basename + ".json", Size: int64(content.Len()), Modified: m.Built, Compress: true}
+		_, addErr := w.AddEntry(entry, &content)
+		if addErr != nil {
+			return addErr
+		}
+	}
+
+	if formats.CSV {
+		var content bytes.Buffer
+		if writeErr := m.WriteCSV(&content); writeErr != nil {
+			return writeErr
+		}
+		entry := &ArchiveEntry{Name: basename + ".csv", Size: int64(content.Len()), Modified: m.Built, Compress: true}
+		_, addErr := w.AddEntry(entry, &content)
+		if addErr != nil {
+			return addErr
+		}
+	}
+
+	if len(m.Skipped) > 0 {
+		var content bytes.Buffer
+		if writeErr := WriteFailureReport(&content, m.Skipped); writeErr != nil {
+			return writeErr
+		}
+		entry := &ArchiveEntry{Name: basename + failureReportSuffix, Size: int64(content.Len()), Modified: m.Built, Compress: true}
+		_, addErr := w.AddEntry(entry, &content)
+		if addErr != nil {
+			return addErr
+		}
+	}
+	return nil
+}
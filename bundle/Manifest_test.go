@@ -0,0 +1,112 @@
+package bundle
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"github.com/guardian/deliverable_bundler/vidispine"
+	"testing"
+	"time"
+)
+
+func TestWriteCSVColumns(t *testing.T) {
+	manifest := &Manifest{
+		ContentList: "https://vs.example/lists/test.json",
+		Built:       time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		Entries: []ManifestEntry{
+			{ArchivePath: "VX-10.mxf", StorageId: "VX-1", FileId: "VX-10", ItemId: "VX-100", Shape: "original", Size: 10, ChecksumStatus: "verified", State: "OPEN"},
+		},
+		Skipped: []SkippedItem{
+			NewSkippedItem("VX-1", "VX-11", errors.New("gone")),
+			{ItemId: "VX-102", Shape: "lowres", Reason: "no such shape"},
+			NewSkippedItem("VX-1", "VX-12", &FileStateError{StorageId: "VX-1", FileId: "VX-12", State: "LOST", Action: StateSkip}),
+		},
+	}
+
+	var buffer bytes.Buffer
+	if err := manifest.WriteCSV(&buffer); err != nil {
+		t.Fatal(err)
+	}
+	//the reader refuses rows that have a different number of columns to the header
+	rows, readErr := csv.NewReader(&buffer).ReadAll()
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	if len(rows) != 5 {
+		t.Fatalf("Expected a header and 4 rows, got %d", len(rows))
+	}
+
+	columns := make(map[string]int)
+	for i, name := range rows[0] {
+		columns[name] = i
+	}
+	expected := []map[string]string{
+		{"file_id": "VX-10", "item_id": "VX-100", "shape": "original", "checksum_status": "verified", "state": "OPEN"},
+		{"file_id": "VX-11", "item_id": "", "checksum_status": "skipped", "state": ""},
+		{"file_id": "", "item_id": "VX-102", "shape": "lowres", "checksum_status": "skipped"},
+		{"file_id": "VX-12", "checksum_status": "skipped", "state": "LOST"},
+	}
+	for i, fields := range expected {
+		for name, value := range fields {
+			if rows[i+1][columns[name]] != value {
+				t.Errorf("Expected %s of row %d to be '%s', got '%s'", name, i+1, value, rows[i+1][columns[name]])
+			}
+		}
+	}
+}
+
+func TestNewManifestItemId(t *testing.T) {
+	entries := []JournalEntry{
+		{Name: "VX-10.mxf", StorageId: "VX-1", FileId: "VX-10", File: &vidispine.VSFileDocument{Id: "VX-10", Items: []vidispine.VSFileItem{{Id: "VX-100", Shapes: []vidispine.VSFileShape{{Id: "VX-200", Tags: []string{"original"}}}}}}},
+	}
+	manifest := NewManifest("https://vs.example/lists/test.json", entries)
+	if manifest.Entries[0].ItemId != "VX-100" {
+		t.Errorf("Expected the entry to have its item ID, got '%s'", manifest.Entries[0].ItemId)
+	}
+	if manifest.Entries[0].Shape != "original" {
+		t.Errorf("Expected the entry to have its shape tag, got '%s'", manifest.Entries[0].Shape)
+	}
+}
+
+func TestManifestInBundle(t *testing.T) {
+	files := map[string]*testFile{"VX-10": newTestFile(1000, 0), "VX-11": newTestFile(2000, 1)}
+	comm := fileCommunicator(t, files, nil, nil)
+	config := testBundleConfig()
+	config.ManifestFormats = ManifestFormats{JSON: true, CSV: true}
+
+	result, entries, err := buildTestBundle(t, comm, testItems("VX-10", "VX-11"), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, present := entries["manifest.csv"]; !present {
+		t.Error("Expected a CSV manifest in the bundle")
+	}
+	if _, present := entries["manifest"+failureReportSuffix]; present {
+		t.Error("Expected no failure report when nothing was skipped")
+	}
+
+	var manifest Manifest
+	if decodeErr := json.Unmarshal(entries["manifest.json"], &manifest); decodeErr != nil {
+		t.Fatalf("Could not decode the JSON manifest: %s", decodeErr)
+	}
+	if manifest.ContentList != "https://vs.example/lists/test.json" || len(manifest.Entries) != 2 {
+		t.Fatalf("Unexpected manifest: %+v", manifest)
+	}
+	expected := []ManifestEntry{
+		{ArchivePath: "VX-10.mxf", OriginalPath: "media/VX-10.mxf", FileId: "VX-10", Size: 1000, ChecksumStatus: "verified"},
+		{ArchivePath: "VX-11.mxf", OriginalPath: "media/VX-11.mxf", FileId: "VX-11", Size: 2000, ChecksumStatus: "verified"},
+	}
+	for i, entry := range manifest.Entries {
+		if entry.ArchivePath != expected[i].ArchivePath || entry.OriginalPath != expected[i].OriginalPath ||
+			entry.FileId != expected[i].FileId || entry.Size != expected[i].Size || entry.ChecksumStatus != expected[i].ChecksumStatus {
+			t.Errorf("Expected entry %d to be %+v, got %+v", i, expected[i], entry)
+		}
+		if entry.Checksum != entry.Hash {
+			t.Errorf("Expected the checksum of %s to be its Vidispine hash", entry.FileId)
+		}
+	}
+	if summary := result.Manifest.Summary(); summary.Files != 2 || summary.Bytes != 3000 || summary.Verified != 2 {
+		t.Errorf("Unexpected summary %+v", summary)
+	}
+}
@@ -0,0 +1,174 @@
+package bundle
+
+import (
+	"errors"
+	"fmt"
+	"github.com/guardian/deliverable_bundler/vidispine"
+	"path"
+	"strings"
+)
+
+/**
+how archive entry names are derived from the file's path on storage
+*/
+type NamingMode int
+
+const (
+	NameBasename    NamingMode = iota //just the file name, with no directories
+	NameFullPath                      //the whole storage-relative path
+	NameStripPrefix                   //the storage-relative path with a given prefix taken off
+	NameByStorage                     //the storage-relative path inside a folder named for the storage ID
+	NameTemplate                      //a user-supplied template, see expandNameTemplate
+)
+
+/**
+convert a naming mode from the configuration into a NamingMode. An empty string gives NameBasename, which is what
+the bundler has always done
+*/
+func ParseNamingMode(name string) (NamingMode, error) {
+	switch strings.ToLower(name) {
+	case "", "basename":
+		return NameBasename, nil
+	case "full", "fullpath":
+		return NameFullPath, nil
+	case "strip", "stripprefix":
+		return NameStripPrefix, nil
+	case "storage", "bystorage":
+		return NameByStorage, nil
+	case "template":
+		return NameTemplate, nil
+	default:
+		return NameBasename, fmt.Errorf("unknown naming mode '%s', expected basename, full, strip, storage or template", name)
+	}
+}
+
+/**
+EntryNamer works out the name of each file in the archive and makes sure that no two entries get the same one.
+Names are checked in the order they are requested, and when two files would collide the later one gets its
+Vidispine file ID added, so the result only depends on the order of the content list
+*/
+type EntryNamer struct {
+	Mode        NamingMode
+	StripPrefix string
+	Template    string
+	used        map[string]bool
+}
+
+/**
+create a new EntryNamer. `stripPrefix` is only used for NameStripPrefix and `template` only for NameTemplate
+*/
+func NewEntryNamer(mode NamingMode, stripPrefix string, template string) (*EntryNamer, error) {
+	if mode == NameStripPrefix && stripPrefix == "" {
+		return nil, errors.New("a prefix to strip is required for the strip naming mode")
+	}
+	if mode == NameTemplate && template == "" {
+		return nil, errors.New("a template is required for the template naming mode")
+	}
+
+	return &EntryNamer{
+		Mode:        mode,
+		StripPrefix: strings.Trim(stripPrefix, "/"),
+		Template:    template,
+		used:        make(map[string]bool),
+	}, nil
+}
+
+/**
+mark a name as already taken, e.g. by an entry written in a previous run
+*/
+func (n *EntryNamer) Reserve(name string) {
+	n.used[name] = true
+}
+
+/**
+returns true if an entry already has the given name
+*/
+func (n *EntryNamer) Taken(name string) bool {
+	return n.used[name]
+}
+
+/**
+expand a template like "{storageId}/{dir}/{name}-{fileId}{ext}". The available fields are
+{storageId}, {fileId}, {path}, {dir}, {basename}, {name} (the basename without extension) and {ext}
+*/
+func expandNameTemplate(template string, fileData *vidispine.VSFileDocument) string {
+	basename := path.Base(fileData.Path)
+	ext := path.Ext(basename)
+
+	replacer := strings.NewReplacer(
+		"{storageId}", fileData.StorageId,
+		"{fileId}", fileData.Id,
+		"{path}", fileData.Path,
+		"{dir}", path.Dir(fileData.Path),
+		"{basename}", basename,
+		"{name}", strings.TrimSuffix(basename, ext),
+		"{ext}", ext,
+	)
+	return replacer.Replace(template)
+}
+
+/**
+tidy up a generated name so that it is a relative path that can't escape the directory it is extracted into
+*/
+func sanitiseEntryName(name string) string {
+	cleaned := path.Clean("/" + strings.ReplaceAll(name, "\\", "/"))
+	return strings.TrimPrefix(cleaned, "/")
+}
+
+/**
+work out the name the given file would have, without checking for collisions
+*/
+func (n *EntryNamer) baseName(fileData *vidispine.VSFileDocument) string {
+	switch n.Mode {
+	case NameFullPath:
+		return fileData.Path
+	case NameStripPrefix:
+		trimmed := strings.TrimPrefix(fileData.Path, "/")
+		if trimmed == n.StripPrefix || strings.HasPrefix(trimmed, n.StripPrefix+"/") {
+			return strings.TrimPrefix(trimmed[len(n.StripPrefix):], "/")
+		}
+		return trimmed
+	case NameByStorage:
+		return fileData.StorageId + "/" + fileData.Path
+	case NameTemplate:
+		return expandNameTemplate(n.Template, fileData)
+	default:
+		return path.Base(fileData.Path)
+	}
+}
+
+/**
+returns the archive entry name for the given file, and records it as taken
+*/
+func (n *EntryNamer) NameFor(fileData *vidispine.VSFileDocument) string {
+	return n.NameInFolder("", fileData)
+}
+
+/**
+returns the archive entry name for the given file within `folder`, and records it as taken
+*/
+func (n *EntryNamer) NameInFolder(folder string, fileData *vidispine.VSFileDocument) string {
+	baseName := n.baseName(fileData)
+	if base := sanitiseEntryName(baseName); base == "" || base == "." {
+		baseName = fileData.Id
+	}
+	return n.Unique(sanitiseEntryName(path.Join(folder, baseName)), fileData.Id)
+}
+
+/**
+returns `name`, or if that is taken, `name` with `id` added before its extension, and records it as taken
+*/
+func (n *EntryNamer) Unique(name string, id string) string {
+	if n.used[name] {
+		ext := path.Ext(name)
+		stem := strings.TrimSuffix(name, ext)
+		candidate := fmt.Sprintf("%s_%s%s", stem, id, ext)
+		for i := 2; n.used[candidate]; i++ {
+			candidate = fmt.Sprintf("%s_%s_%d%s", stem, id, i, ext)
+		}
+		name = candidate
+	}
+
+	n.used[name] = true
+	return name
+}
@@ -0,0 +1,69 @@
+package bundle
+
+import (
+	"github.com/guardian/deliverable_bundler/vidispine"
+	"testing"
+)
+
+func TestNamingModes(t *testing.T) {
+	fileData := &vidispine.VSFileDocument{Id: "VX-5", StorageId: "VX-2", Path: "Project/Card01/A001.mov"}
+
+	tests := []struct {
+		mode     NamingMode
+		prefix   string
+		template string
+		expected string
+	}{
+		{NameBasename, "", "", "A001.mov"},
+		{NameFullPath, "", "", "Project/Card01/A001.mov"},
+		{NameStripPrefix, "Project/", "", "Card01/A001.mov"},
+		{NameStripPrefix, "Other", "", "Project/Card01/A001.mov"},
+		{NameByStorage, "", "", "VX-2/Project/Card01/A001.mov"},
+		{NameTemplate, "", "{storageId}/{name}-{fileId}{ext}", "VX-2/A001-VX-5.mov"},
+		{NameTemplate, "", "../../{basename}", "A001.mov"},
+	}
+
+	for _, test := range tests {
+		namer, err := NewEntryNamer(test.mode, test.prefix, test.template)
+		if err != nil {
+			t.Fatalf("Could not create namer for mode %d: %s", test.mode, err)
+		}
+		result := namer.NameFor(fileData)
+		if result != test.expected {
+			t.Errorf("Mode %d gave '%s', expected '%s'", test.mode, result, test.expected)
+		}
+	}
+}
+
+func TestNamingCollisions(t *testing.T) {
+	namer, _ := NewEntryNamer(NameBasename, "", "")
+	namer.Reserve("manifest.json")
+
+	names := []string{
+		namer.NameFor(&vidispine.VSFileDocument{Id: "VX-1", Path: "Card01/A001.mov"}),
+		namer.NameFor(&vidispine.VSFileDocument{Id: "VX-2", Path: "Card02/A001.mov"}),
+		namer.NameFor(&vidispine.VSFileDocument{Id: "VX-3", Path: "manifest.json"}),
+	}
+	expected := []string{"A001.mov", "A001_VX-2.mov", "manifest_VX-3.json"}
+
+	for i := range expected {
+		if names[i] != expected[i] {
+			t.Errorf("Name %d was '%s', expected '%s'", i, names[i], expected[i])
+		}
+	}
+}
+
+func TestNamingInFolder(t *testing.T) {
+	namer, _ := NewEntryNamer(NameBasename, "", "")
+	first := namer.NameInFolder("Rushes/Day 1", &vidispine.VSFileDocument{Id: "VX-5", Path: "Card01/A001.mov"})
+	second := namer.NameInFolder("Rushes/Day 1", &vidispine.VSFileDocument{Id: "VX-6", Path: "Card02/A001.mov"})
+	other := namer.NameInFolder("Rushes/Day 2", &vidispine.VSFileDocument{Id: "VX-7", Path: "Card03/A001.mov"})
+	escaped := namer.NameInFolder("../..", &vidispine.VSFileDocument{Id: "VX-8", Path: "B001.mov"})
+
+	if first != "Rushes/Day 1/A001.mov" || second != "Rushes/Day 1/A001_VX-6.mov" || other != "Rushes/Day 2/A001.mov" {
+		t.Errorf("Unexpected names in folders: %s, %s, %s", first, second, other)
+	}
+	if escaped != "B001.mov" {
+		t.Errorf("Expected a folder can't escape the archive, got %s", escaped)
+	}
+}
@@ -0,0 +1,361 @@
+package bundle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/guardian/deliverable_bundler/apierror"
+	"github.com/guardian/deliverable_bundler/contentlist"
+	"github.com/guardian/deliverable_bundler/logging"
+	"github.com/guardian/deliverable_bundler/progress"
+	"github.com/guardian/deliverable_bundler/vidispine"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+type PipelineConfig struct {
+	Concurrency int //number of files to download at the same time
+	BufferSize  int //size of the copy buffer used by each worker, this is also the size of each range request
+	//maximum number of bytes held in memory across all workers, including their copy buffers and prefetched chunks.
+	//Whatever the buffers leave is used to stage files and their metadata sidecars, and anything that doesn't fit is staged to disk
+	MemoryLimit int64
+	StagingDir  string //directory for files that are staged to disk. Empty means the system temp directory
+	Prefetch    int    //number of range requests each worker keeps in flight ahead of the copy. 0 disables prefetching
+	ReadRetry   vidispine.ReadRetryConfig
+	Cancel      <-chan struct{}   //closing this stops the pipeline with ErrCancelled. nil means it can't be cancelled
+	Progress    *progress.Tracker //if set, download progress is reported here
+	Logger      *slog.Logger      //nil means the default logger
+	//number of times to try downloading each item before giving up on it. Items that the server refused
+	//outright, like one that doesn't exist, are not tried again
+	ItemAttempts int
+	//if set, items that could not be downloaded are passed to the sink with Err set instead of stopping the
+	//pipeline, and the sink decides whether to carry on
+	ContinueOnError bool
+	StatePolicy     *StatePolicy //what to do with files that are lost, missing or still being written. nil means the default
+	states          *stateChecker
+	sidecar         *SidecarConfig //if set, each file's metadata sidecar is fetched along with it
+}
+
+/**
+returned by RunPipeline when it is stopped through PipelineConfig.Cancel or by cancelling its context
+*/
+var ErrCancelled = errors.New("cancelled")
+
+/**
+StagedFile is a downloaded file that is waiting to be written into the archive
+*/
+type StagedFile struct {
+	Index         int
+	Item          contentlist.ContentList
+	FileData      *vidispine.VSFileDocument
+	State         *StateDecision //set if the file was not in a state to be downloaded when it was first looked at
+	Sidecar       io.Reader      //the rendered metadata sidecar, if sidecars are wanted and the file belongs to an item
+	SidecarSize   int64          //size of the sidecar, in bytes
+	Content       io.Reader
+	CRC32         uint32 //CRC-32 of the content, worked out while it was staged
+	SHA1          string //SHA-1 of the content as a hex string, worked out while it was staged
+	Err           error
+	buffer        *stagingBuffer
+	sidecarBuffer *stagingBuffer
+}
+
+/**
+StageError is returned by RunPipeline when an item could not be downloaded. Index is its position in the list
+given to RunPipeline
+*/
+type StageError struct {
+	Index int
+	Item  contentlist.ContentList
+	Err   error
+}
+
+func (e *StageError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+/**
+free up any memory or disk space held by the staged file
+*/
+func (f *StagedFile) release() {
+	if f.buffer != nil {
+		f.buffer.Release()
+		f.buffer = nil
+	}
+	if f.sidecarBuffer != nil {
+		f.sidecarBuffer.Release()
+		f.sidecarBuffer = nil
+	}
+}
+
+/**
+move a rendered sidecar into a staging buffer, so that while it waits for the archive writer it counts against the
+memory limit in the same way as the file it goes with
+*/
+func (f *StagedFile) stageSidecar(content []byte, budget *memoryBudget, stagingDir string, abort <-chan struct{}) error {
+	buffer, bufErr := newStagingBuffer(int64(len(content)), budget, stagingDir, abort)
+	if bufErr != nil {
+		return fmt.Errorf("could not create staging buffer for the sidecar of %s: %s", f.Item.FileId, bufErr)
+	}
+	f.sidecarBuffer = buffer
+
+	if _, writeErr := buffer.Write(content); writeErr != nil {
+		return writeErr
+	}
+	reader, readErr := buffer.Reader()
+	if readErr != nil {
+		return readErr
+	}
+	f.Sidecar = reader
+	f.SidecarSize = int64(len(content))
+	return nil
+}
+
+/**
+the error to return when the pipeline's context is done. A deadline is reported as such, anything else is a
+cancellation
+*/
+func contextError(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return ctx.Err()
+	}
+	return ErrCancelled
+}
+
+/**
+returns a PipelineConfig with sensible defaults, that downloads one file at a time
+*/
+func DefaultPipelineConfig() PipelineConfig {
+	return PipelineConfig{
+		Concurrency:  1,
+		BufferSize:   4 * 1024 * 1024,
+		MemoryLimit:  256 * 1024 * 1024,
+		StagingDir:   "",
+		Prefetch:     0,
+		ReadRetry:    vidispine.DefaultReadRetryConfig(),
+		ItemAttempts: 1,
+	}
+}
+
+/**
+returns the memory each worker uses whatever it is staging: its copy buffer, the chunk it is copying from and the
+chunks queued up by prefetching
+*/
+func (c *PipelineConfig) workerMemory() int64 {
+	return int64(c.BufferSize) * int64(c.Prefetch+2)
+}
+
+/**
+returns true if an item that failed with `err` might work if it is downloaded again
+*/
+func worthRetrying(err error) bool {
+	var statusErr *apierror.StatusError
+	var stateErr *FileStateError
+	if errors.As(err, &stateErr) {
+		return false
+	}
+	return !errors.As(err, &statusErr) || statusErr.Retryable
+}
+
+/**
+look up the given item in Vidispine and download it into a staging buffer, making up to config.ItemAttempts attempts
+*/
+func stageItem(ctx context.Context, comm *vidispine.VidispineCommunicator, index int, item contentlist.ContentList, config *PipelineConfig, budget *memoryBudget, abort <-chan struct{}) *StagedFile {
+	var rtn *StagedFile
+	for attempt := 1; ; attempt++ {
+		rtn = stageAttempt(ctx, comm, index, item, config, budget, abort)
+		if rtn.Err == nil || attempt >= config.ItemAttempts || ctx.Err() != nil || !worthRetrying(rtn.Err) {
+			break
+		}
+		rtn.release()
+		logging.ForFile(config.Logger, item.StorageId, item.FileId).Warn("Could not download item, trying again",
+			"attempt", attempt, "maxAttempts", config.ItemAttempts, "error", rtn.Err)
+	}
+	config.Progress.FileDone(item.StorageId, item.FileId, rtn.Err)
+	return rtn
+}
+
+func stageAttempt(ctx context.Context, comm *vidispine.VidispineCommunicator, index int, item contentlist.ContentList, config *PipelineConfig, budget *memoryBudget, abort <-chan struct{}) *StagedFile {
+	rtn := &StagedFile{Index: index, Item: item}
+
+	fetched := time.Now()
+	fileData, vsErr := vidispine.VSFileInfo(ctx, comm, item.StorageId, item.FileId)
+	if vsErr != nil {
+		rtn.Err = fmt.Errorf("could not get file information for %s on %s: %w", item.FileId, item.StorageId, vsErr)
+		return rtn
+	}
+	rtn.FileData = fileData
+
+	logger := logging.ForFile(config.Logger, item.StorageId, item.FileId)
+	fileData, rtn.State, rtn.Err = config.states.check(ctx, comm, fileData, fetched, logger)
+	if rtn.Err != nil {
+		return rtn
+	}
+	rtn.FileData = fileData
+
+	//the sidecar is fetched first, as a file that can't have one is left out like one that can't be downloaded
+	if config.sidecar != nil && config.sidecar.Format != SidecarNone {
+		var sidecar []byte
+		sidecar, rtn.Err = config.sidecar.forFile(ctx, comm, item, fileData, logger)
+		if rtn.Err == nil && sidecar != nil {
+			rtn.Err = rtn.stageSidecar(sidecar, budget, config.StagingDir, abort)
+		}
+		if rtn.Err != nil {
+			return rtn
+		}
+	}
+
+	reader, readErr := vidispine.NewPrefetchingVSFileReader(ctx, comm, fileData, config.BufferSize, config.Prefetch)
+	if readErr != nil {
+		rtn.Err = fmt.Errorf("could not read from %s on %s: %w", item.FileId, item.StorageId, readErr)
+		return rtn
+	}
+	defer reader.Close()
+	reader.SetRetryConfig(config.ReadRetry)
+	config.Progress.FileStarted(item.StorageId, item.FileId, fileData.Size)
+	reader.SetProgressFunc(func(bytes int) {
+		config.Progress.FileBytes(item.StorageId, item.FileId, bytes)
+	})
+
+	buffer, bufErr := newStagingBuffer(fileData.Size, budget, config.StagingDir, abort)
+	if bufErr != nil {
+		rtn.Err = fmt.Errorf("could not create staging buffer for %s: %s", item.FileId, bufErr)
+		return rtn
+	}
+	rtn.buffer = buffer
+
+	_, copyErr := vidispine.BufferedCopy(buffer, reader, config.BufferSize)
+	if copyErr != nil {
+		rtn.Err = fmt.Errorf("could not download %s on %s: %w", item.FileId, item.StorageId, copyErr)
+		return rtn
+	}
+
+	content, contentErr := buffer.Reader()
+	if contentErr != nil {
+		rtn.Err = contentErr
+		return rtn
+	}
+	rtn.Content = content
+	rtn.CRC32 = buffer.CRC32()
+	rtn.SHA1 = buffer.SHA1()
+	return rtn
+}
+
+/**
+downloads every item in the list using up to config.Concurrency workers, and calls `sink` for each of them in
+the order they appear in the list. `sink` is always called from the goroutine that called RunPipeline, so it
+is safe for it to write to a single archive writer.
+Processing stops at the first error, either from a download or from `sink`, and that error is returned. With
+config.ContinueOnError, failed downloads go to `sink` instead, and only an error from `sink` stops processing.
+If `ctx` is cancelled the downloads in progress are abandoned and ErrCancelled is returned, or the context's error
+if it reached its deadline.
+*/
+func RunPipeline(ctx context.Context, comm *vidispine.VidispineCommunicator, items []contentlist.ContentList, config PipelineConfig, sink func(staged *StagedFile) error) error {
+	if config.Concurrency < 1 {
+		config.Concurrency = 1
+	}
+	if config.BufferSize < 1 {
+		config.BufferSize = DefaultPipelineConfig().BufferSize
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if config.Cancel != nil {
+		go func() {
+			select {
+			case <-config.Cancel:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	config.states = newStateChecker(config.StatePolicy)
+	config.Progress.AddFiles(len(items))
+	stagingLimit := config.MemoryLimit - int64(config.Concurrency)*config.workerMemory()
+	if stagingLimit < 0 {
+		logging.OrDefault(config.Logger).Warn("The download buffers need more than the memory limit, so every file will be staged to disk",
+			"memoryLimit", config.MemoryLimit, "workers", config.Concurrency, "perWorker", config.workerMemory())
+		stagingLimit = 0
+	}
+	budget := &memoryBudget{limit: stagingLimit}
+	abort := make(chan struct{})
+	slots := make(chan struct{}, config.Concurrency)
+	results := make([]chan *StagedFile, len(items))
+	for i := range results {
+		results[i] = make(chan *StagedFile, 1)
+	}
+
+	var workers sync.WaitGroup
+	dispatched := make(chan int, 1)
+
+	go func() {
+		count := 0
+		defer func() { dispatched <- count }()
+
+		for i, item := range items {
+			select {
+			case slots <- struct{}{}:
+			case <-abort:
+				return
+			}
+			workers.Add(1)
+			count++
+			go func(index int, item contentlist.ContentList) {
+				defer workers.Done()
+				results[index] <- stageItem(ctx, comm, index, item, &config, budget, abort)
+			}(i, item)
+		}
+	}()
+
+	var pipelineErr error
+	completed := 0
+	for i := range items {
+		var staged *StagedFile
+		select {
+		case staged = <-results[i]:
+		case <-ctx.Done():
+			pipelineErr = contextError(ctx)
+		}
+		if pipelineErr != nil {
+			break
+		}
+		completed++
+
+		if staged.Err != nil && ctx.Err() != nil {
+			//the download failed because it was stopped, so report that rather than the error it caused
+			pipelineErr = contextError(ctx)
+		} else if staged.Err != nil && !config.ContinueOnError {
+			pipelineErr = &StageError{Index: staged.Index, Item: staged.Item, Err: staged.Err}
+		} else {
+			pipelineErr = sink(staged)
+		}
+		staged.release()
+		<-slots
+
+		if pipelineErr != nil {
+			break
+		}
+	}
+
+	if pipelineErr != nil {
+		logging.OrDefault(config.Logger).Warn("Aborting download pipeline", "error", pipelineErr)
+		close(abort)
+		cancel()
+		total := <-dispatched
+		workers.Wait()
+		for i := completed; i < total; i++ {
+			staged := <-results[i]
+			staged.release()
+		}
+		return pipelineErr
+	}
+
+	<-dispatched
+	return nil
+}
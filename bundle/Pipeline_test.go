@@ -0,0 +1,93 @@
+package bundle
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPipelineKeepsOrder(t *testing.T) {
+	files := make(map[string]*testFile)
+	var fileIds []string
+	for i := 0; i < 8; i++ {
+		fileId := fmt.Sprintf("VX-%d", 10+i)
+		files[fileId] = newTestFile(700+i*100, byte(i))
+		fileIds = append(fileIds, fileId)
+	}
+	//the files at the start of the list are the slowest, so the later ones finish first
+	comm := fileCommunicator(t, files, nil, func(w http.ResponseWriter, r *http.Request) bool {
+		var n int
+		fmt.Sscanf(strings.TrimPrefix(r.URL.Path, "/API/storage/VX-1/file/VX-"), "%d", &n)
+		time.Sleep(time.Duration(18-n) * 2 * time.Millisecond)
+		return false
+	})
+
+	config := DefaultPipelineConfig()
+	config.Concurrency = 4
+	config.BufferSize = 256
+	config.Prefetch = 2
+	var received []string
+	err := RunPipeline(context.Background(), comm, testItems(fileIds...), config, func(staged *StagedFile) error {
+		if staged.Err != nil {
+			return staged.Err
+		}
+		content, _ := io.ReadAll(staged.Content)
+		if !bytes.Equal(content, files[staged.Item.FileId].content) {
+			t.Errorf("Content of %s does not match", staged.Item.FileId)
+		}
+		if staged.Index != len(received) {
+			t.Errorf("Expected index %d, got %d", len(received), staged.Index)
+		}
+		received = append(received, staged.Item.FileId)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(received, ",") != strings.Join(fileIds, ",") {
+		t.Errorf("Expected the files in list order, got %v", received)
+	}
+}
+
+/**
+run a pipeline over three 1000 byte files and return how many of them were staged in memory
+*/
+func stagedInMemory(t *testing.T, memoryLimit int64) int {
+	files := map[string]*testFile{"VX-10": newTestFile(1000, 0), "VX-11": newTestFile(1000, 1), "VX-12": newTestFile(1000, 2)}
+	comm := fileCommunicator(t, files, nil, nil)
+
+	config := DefaultPipelineConfig()
+	config.Concurrency = 2
+	config.BufferSize = 256
+	config.Prefetch = 1
+	config.MemoryLimit = memoryLimit
+	config.StagingDir = t.TempDir()
+	inMemory := 0
+	err := RunPipeline(context.Background(), comm, testItems("VX-10", "VX-11", "VX-12"), config, func(staged *StagedFile) error {
+		if staged.buffer.memory != nil {
+			inMemory++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return inMemory
+}
+
+func TestPipelineMemoryBudget(t *testing.T) {
+	//two workers, each with a copy buffer, a chunk being copied from and one prefetched chunk of 256 bytes
+	buffers := int64(2 * 3 * 256)
+
+	if inMemory := stagedInMemory(t, buffers); inMemory != 0 {
+		t.Errorf("Expected every file to go to disk when the buffers take the whole limit, %d were in memory", inMemory)
+	}
+	if inMemory := stagedInMemory(t, buffers+3000); inMemory != 3 {
+		t.Errorf("Expected every file to be staged in memory when there is room, %d were", inMemory)
+	}
+}
@@ -0,0 +1,192 @@
+package bundle
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/hex"
+	"github.com/guardian/deliverable_bundler/vidispine"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"time"
+)
+
+/**
+countingWriter passes writes on to the output file and keeps track of where we are in it
+*/
+type countingWriter struct {
+	w     io.Writer
+	count int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.count += int64(n)
+	return n, err
+}
+
+/**
+segmentWriter lets tar.Writer write through a different compressor for each entry
+*/
+type segmentWriter struct {
+	current io.Writer
+}
+
+func (s *segmentWriter) Write(p []byte) (int, error) {
+	return s.current.Write(p)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+/**
+ResumableTarWriter writes a tar archive, optionally compressed with gzip or zstd, to a local file and records every
+completed entry in a journal.
+For the compressed formats each entry is written as its own gzip member or zstd frame. Both formats define a
+file made up of several of these as the concatenation of their content, so the result is an ordinary .tar.gz or
+.tar.zst, but it also means that an interrupted bundle can be truncated back to the end of any completed entry and
+carried on from there.
+*/
+type ResumableTarWriter struct {
+	*journalledOutput
+	format  ArchiveFormat
+	counter *countingWriter
+	segment *segmentWriter
+	tar     *tar.Writer
+	gzip    *gzip.Writer
+	zstd    *zstd.Encoder
+}
+
+func newResumableTarWriter(output *journalledOutput, format ArchiveFormat) (*ResumableTarWriter, error) {
+	counter := &countingWriter{w: output.out, count: output.offset}
+	segment := &segmentWriter{current: counter}
+
+	w := &ResumableTarWriter{
+		journalledOutput: output,
+		format:           format,
+		counter:          counter,
+		segment:          segment,
+		tar:              tar.NewWriter(segment),
+	}
+
+	switch format {
+	case FormatTarGzip:
+		w.gzip = gzip.NewWriter(counter)
+	case FormatTarZstd:
+		encoder, encoderErr := zstd.NewWriter(counter)
+		if encoderErr != nil {
+			return nil, encoderErr
+		}
+		w.zstd = encoder
+	}
+	return w, nil
+}
+
+/**
+start a new gzip member or zstd frame, and point the tar writer at it
+*/
+func (w *ResumableTarWriter) startSegment() io.WriteCloser {
+	var compressor io.WriteCloser
+	switch w.format {
+	case FormatTarGzip:
+		w.gzip.Reset(w.counter)
+		compressor = w.gzip
+	case FormatTarZstd:
+		w.zstd.Reset(w.counter)
+		compressor = w.zstd
+	default:
+		compressor = nopWriteCloser{w.counter}
+	}
+
+	w.segment.current = compressor
+	return compressor
+}
+
+/**
+add a file to the archive. entry.Size must be exactly the amount of data in `src`. Each entry is a complete
+segment, so it is recorded in the journal as soon as it has been written
+*/
+func (w *ResumableTarWriter) AddEntry(entry *ArchiveEntry, src io.Reader) (string, error) {
+	modified := entry.Modified
+	if modified.IsZero() {
+		modified = time.Now()
+	}
+
+	compressor := w.startSegment()
+	headerErr := w.tar.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     entry.Name,
+		Size:     entry.Size,
+		Mode:     0644,
+		ModTime:  modified,
+	})
+	if headerErr != nil {
+		return "", headerErr
+	}
+
+	hasher := sha1.New()
+	_, copyErr := vidispine.BufferedCopy(w.tar, io.TeeReader(src, hasher), archiveCopyBufSize)
+	if copyErr != nil {
+		return "", copyErr
+	}
+
+	//pad out the final block so that the entry is complete within this segment
+	flushErr := w.tar.Flush()
+	if flushErr != nil {
+		return "", flushErr
+	}
+	closeErr := compressor.Close()
+	if closeErr != nil {
+		return "", closeErr
+	}
+
+	checksum := hex.EncodeToString(hasher.Sum(nil))
+	journalEntry := newJournalEntry(entry, w.offset, checksum)
+	journalEntry.End = w.counter.count
+	commitErr := w.commit(journalEntry)
+	if commitErr != nil {
+		return "", commitErr
+	}
+	return checksum, nil
+}
+
+/**
+returns every entry written to the archive so far, including any carried over from a previous run
+*/
+func (w *ResumableTarWriter) Entries() []JournalEntry {
+	return append([]JournalEntry{}, w.journal.Entries...)
+}
+
+/**
+write the end-of-archive marker in a segment of its own and remove the journal
+*/
+func (w *ResumableTarWriter) Close() error {
+	compressor := w.startSegment()
+	tarErr := w.tar.Close()
+	if tarErr == nil {
+		tarErr = compressor.Close()
+	}
+	if tarErr != nil {
+		w.close()
+		return tarErr
+	}
+	return w.finish(true)
+}
+
+/**
+stop writing without finishing the archive. Completed entries stay in the journal, so the next run with the same
+output file can pick up from here
+*/
+func (w *ResumableTarWriter) Abort() error {
+	return w.finish(false)
+}
+
+func (w *ResumableTarWriter) Discard() error {
+	w.close()
+	return w.remove()
+}
@@ -0,0 +1,97 @@
+package bundle
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func appendToFile(t *testing.T, filename string, content string) {
+	fp, openErr := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0644)
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer fp.Close()
+	if _, writeErr := fp.WriteString(content); writeErr != nil {
+		t.Fatal(writeErr)
+	}
+}
+
+func openTarReader(t *testing.T, format ArchiveFormat, filename string) *tar.Reader {
+	fp, openErr := os.Open(filename)
+	if openErr != nil {
+		t.Fatal("Could not open archive: ", openErr)
+	}
+	t.Cleanup(func() { fp.Close() })
+
+	var src io.Reader = fp
+	switch format {
+	case FormatTarGzip:
+		gzipReader, gzipErr := gzip.NewReader(fp)
+		if gzipErr != nil {
+			t.Fatal("Could not open gzip stream: ", gzipErr)
+		}
+		src = gzipReader
+	case FormatTarZstd:
+		zstdReader, zstdErr := zstd.NewReader(fp)
+		if zstdErr != nil {
+			t.Fatal("Could not open zstd stream: ", zstdErr)
+		}
+		t.Cleanup(zstdReader.Close)
+		src = zstdReader
+	}
+	return tar.NewReader(src)
+}
+
+func TestResumeTarFormats(t *testing.T) {
+	for _, format := range []ArchiveFormat{FormatTar, FormatTarGzip, FormatTarZstd} {
+		outputFile := path.Join(t.TempDir(), "test."+format.String())
+
+		first, openErr := OpenArchive(format, outputFile, "file:///list.json", true, nil)
+		if openErr != nil {
+			t.Fatalf("Could not open %s: %s", format, openErr)
+		}
+		addTestEntry(t, first, "VX-10", "first file content")
+		first.Abort()
+		//as if the run had been stopped part way through the next entry
+		appendToFile(t, outputFile, "partial entry")
+
+		second, reopenErr := OpenArchive(format, outputFile, "file:///list.json", true, nil)
+		if reopenErr != nil {
+			t.Fatalf("Could not reopen %s: %s", format, reopenErr)
+		}
+		if !second.IsComplete("VX-1", "VX-10") || second.IsComplete("VX-1", "VX-11") {
+			t.Errorf("%s: expected only the first entry to be carried over", format)
+		}
+		addTestEntry(t, second, "VX-11", "second file content")
+		if closeErr := second.Close(); closeErr != nil {
+			t.Fatalf("Could not close %s: %s", format, closeErr)
+		}
+
+		reader := openTarReader(t, format, outputFile)
+		expected := map[string]string{"VX-10.txt": "first file content", "VX-11.txt": "second file content"}
+		count := 0
+		for {
+			header, nextErr := reader.Next()
+			if nextErr == io.EOF {
+				break
+			}
+			if nextErr != nil {
+				t.Fatalf("%s: could not read archive: %s", format, nextErr)
+			}
+			content, _ := ioutil.ReadAll(reader)
+			if string(content) != expected[header.Name] {
+				t.Errorf("%s: entry %s has content '%s'", format, header.Name, string(content))
+			}
+			count++
+		}
+		if count != len(expected) {
+			t.Errorf("%s: expected %d entries, got %d", format, len(expected), count)
+		}
+	}
+}
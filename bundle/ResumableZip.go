@@ -0,0 +1,415 @@
+package bundle
+
+import (
+	"archive/zip"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/guardian/deliverable_bundler/vidispine"
+	"hash/crc32"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	zipLocalHeaderLen      = 30
+	zipDataDescriptorLen   = 16
+	zipDataDescriptor64Len = 24
+	zipLocalZip64ExtraLen  = 20
+	zipUint32Max           = (1 << 32) - 1
+	zipDataDescriptorFlag  = 0x8
+	zipUTF8Flag            = 0x800
+	zipVersion20           = 20
+	zipVersion45           = 45
+	zipUint16Max           = (1 << 16) - 1
+	zipZip64ExtraID        = 0x0001
+
+	zipDirectoryHeaderSignature = 0x02014b50
+	zipDirectoryEndSignature    = 0x06054b50
+	zipDirectory64EndSignature  = 0x06064b50
+	zipDirectory64LocSignature  = 0x07064b50
+	zipDirectory64EndLen        = 56
+)
+
+/**
+cutoffWriter passes writes on to the output and keeps track of where we are in it. Once `cutoff` is set, anything
+written past that point is thrown away. zip.Writer only closes off an entry when the next one is started, so this lets
+the last entry be finished off without any of the next one reaching the output
+*/
+type cutoffWriter struct {
+	w      io.Writer
+	count  int64
+	cutoff int64 //-1 for no cutoff
+}
+
+func (c *cutoffWriter) Write(p []byte) (int, error) {
+	keep := p
+	if c.cutoff >= 0 && c.count+int64(len(p)) > c.cutoff {
+		keep = p[:max(c.cutoff-c.count, 0)]
+	}
+	if len(keep) > 0 {
+		n, err := c.w.Write(keep)
+		c.count += int64(n)
+		if err != nil {
+			return n, err
+		}
+	}
+	return len(p), nil
+}
+
+/**
+returns the length of the data descriptor that zip.Writer puts after the given entry's data
+*/
+func zipDescriptorLength(fh *zip.FileHeader) int64 {
+	if fh.Flags&zipDataDescriptorFlag == 0 {
+		return 0
+	}
+	if fh.CompressedSize64 > zipUint32Max || fh.UncompressedSize64 > zipUint32Max {
+		return zipDataDescriptor64Len
+	}
+	return zipDataDescriptorLen
+}
+
+/**
+work out how many bytes the given entry takes up in the archive, from the start of its local header to the end
+of its data descriptor. The header must have been completed by zip.Writer
+*/
+func zipEntryLength(fh *zip.FileHeader) int64 {
+	length := int64(zipLocalHeaderLen+len(fh.Name)+len(fh.Extra)) + int64(fh.CompressedSize64)
+
+	//without a data descriptor, large sizes go into a zip64 extra field in the local header
+	if fh.Flags&zipDataDescriptorFlag == 0 && (fh.CompressedSize64 > zipUint32Max || fh.UncompressedSize64 > zipUint32Max) {
+		length += zipLocalZip64ExtraLen
+	}
+	return length + zipDescriptorLength(fh)
+}
+
+/**
+ResumableZipWriter writes a zip archive to a local file and records every completed entry in a journal.
+If a run is interrupted, opening the same output file again picks up after the last completed entry.
+zip.Writer is only used to write the entries themselves. The central directory is written from the journal, so the
+entries carried over from a previous run never have to be fed through a zip.Writer again
+*/
+type ResumableZipWriter struct {
+	*journalledOutput
+	output  *cutoffWriter
+	zip     *zip.Writer
+	pending *pendingEntry
+}
+
+type pendingEntry struct {
+	entry  JournalEntry
+	header *zip.FileHeader
+}
+
+/**
+set up a zip.Writer that carries on from the end of the entries carried over from a previous run
+*/
+func newResumableZipWriter(output *journalledOutput) (*ResumableZipWriter, error) {
+	for _, entry := range output.journal.Entries {
+		if entry.Header == nil {
+			return nil, fmt.Errorf("journal entry for %s has no zip header", entry.Name)
+		}
+	}
+
+	counter := &cutoffWriter{w: output.out, count: output.offset, cutoff: -1}
+	return &ResumableZipWriter{
+		journalledOutput: output,
+		output:           counter,
+		zip:              zip.NewWriter(counter),
+	}, nil
+}
+
+/**
+append the central directory record for an entry with the given completed header, which starts at `offset`.
+Returns true if it needed a zip64 extra field. This follows zip.Writer.Close
+*/
+func appendZipDirectoryHeader(b []byte, h *zip.FileHeader, offset uint64) ([]byte, bool) {
+	le := binary.LittleEndian
+	readerVersion := h.ReaderVersion
+	extra := h.Extra
+	usedZip64 := h.CompressedSize64 >= zipUint32Max || h.UncompressedSize64 >= zipUint32Max || offset >= zipUint32Max
+	if usedZip64 {
+		readerVersion = max(readerVersion, zipVersion45)
+		var fields []byte
+		if h.UncompressedSize64 >= zipUint32Max {
+			fields = le.AppendUint64(fields, h.UncompressedSize64)
+		}
+		if h.CompressedSize64 >= zipUint32Max {
+			fields = le.AppendUint64(fields, h.CompressedSize64)
+		}
+		if offset >= zipUint32Max {
+			fields = le.AppendUint64(fields, offset)
+		}
+		extra = append([]byte{}, h.Extra...)
+		extra = le.AppendUint16(extra, zipZip64ExtraID)
+		extra = le.AppendUint16(extra, uint16(len(fields)))
+		extra = append(extra, fields...)
+	}
+
+	b = le.AppendUint32(b, zipDirectoryHeaderSignature)
+	b = le.AppendUint16(b, h.CreatorVersion)
+	b = le.AppendUint16(b, readerVersion)
+	b = le.AppendUint16(b, h.Flags)
+	b = le.AppendUint16(b, h.Method)
+	b = le.AppendUint16(b, h.ModifiedTime)
+	b = le.AppendUint16(b, h.ModifiedDate)
+	b = le.AppendUint32(b, h.CRC32)
+	b = le.AppendUint32(b, uint32(min(h.CompressedSize64, zipUint32Max)))
+	b = le.AppendUint32(b, uint32(min(h.UncompressedSize64, zipUint32Max)))
+	b = le.AppendUint16(b, uint16(len(h.Name)))
+	b = le.AppendUint16(b, uint16(len(extra)))
+	b = le.AppendUint16(b, uint16(len(h.Comment)))
+	b = le.AppendUint16(b, 0) //disk number start
+	b = le.AppendUint16(b, 0) //internal file attributes
+	b = le.AppendUint32(b, h.ExternalAttrs)
+	b = le.AppendUint32(b, uint32(min(offset, zipUint32Max)))
+	b = append(b, h.Name...)
+	b = append(b, extra...)
+	return append(b, h.Comment...), usedZip64
+}
+
+/**
+write the central directory for `entries`, which must all have completed zip headers, followed by the end of
+central directory records. `start` is where in the archive the directory goes
+*/
+func writeZipDirectory(out io.Writer, start int64, entries []JournalEntry) error {
+	le := binary.LittleEndian
+	var b []byte
+	usedZip64 := false
+	for _, entry := range entries {
+		var entryZip64 bool
+		b, entryZip64 = appendZipDirectoryHeader(b, entry.Header, uint64(entry.Offset))
+		usedZip64 = usedZip64 || entryZip64
+	}
+
+	end := uint64(start) + uint64(len(b))
+	records := uint64(len(entries))
+	size := uint64(len(b))
+	offset := uint64(start)
+
+	if usedZip64 || records >= zipUint16Max || size >= zipUint32Max || offset >= zipUint32Max {
+		b = le.AppendUint32(b, zipDirectory64EndSignature)
+		b = le.AppendUint64(b, zipDirectory64EndLen-12) //length without the signature and this field
+		b = le.AppendUint16(b, zipVersion45)             //version made by
+		b = le.AppendUint16(b, zipVersion45)             //version needed to extract
+		b = le.AppendUint32(b, 0)                        //number of this disk
+		b = le.AppendUint32(b, 0)                        //disk with the start of the central directory
+		b = le.AppendUint64(b, records)                  //entries on this disk
+		b = le.AppendUint64(b, records)                  //entries in total
+		b = le.AppendUint64(b, size)
+		b = le.AppendUint64(b, offset)
+
+		b = le.AppendUint32(b, zipDirectory64LocSignature)
+		b = le.AppendUint32(b, 0) //disk with the start of the zip64 end record
+		b = le.AppendUint64(b, end)
+		b = le.AppendUint32(b, 1) //total number of disks
+	}
+
+	b = le.AppendUint32(b, zipDirectoryEndSignature)
+	b = le.AppendUint16(b, 0) //number of this disk
+	b = le.AppendUint16(b, 0) //disk with the start of the central directory
+	b = le.AppendUint16(b, uint16(min(records, zipUint16Max)))
+	b = le.AppendUint16(b, uint16(min(records, zipUint16Max)))
+	b = le.AppendUint32(b, uint32(min(size, zipUint32Max)))
+	b = le.AppendUint32(b, uint32(min(offset, zipUint32Max)))
+	b = le.AppendUint16(b, 0) //comment length
+
+	_, writeErr := out.Write(b)
+	return writeErr
+}
+
+/**
+returns every entry written to the archive so far, including any carried over from a previous run and the most
+recent one, which may not have been committed to the journal yet
+*/
+func (w *ResumableZipWriter) Entries() []JournalEntry {
+	rtn := append([]JournalEntry{}, w.journal.Entries...)
+	if w.pending != nil {
+		entry := w.pending.entry
+		header := *w.pending.header
+		entry.Header = &header
+		rtn = append(rtn, entry)
+	}
+	return rtn
+}
+
+/**
+record the previous entry in the journal. This must only be called once the previous entry has been closed off
+by zip.Writer
+*/
+func (w *ResumableZipWriter) commitPending() error {
+	if w.pending == nil {
+		return nil
+	}
+
+	flushErr := w.zip.Flush()
+	if flushErr != nil {
+		return flushErr
+	}
+
+	entry := w.pending.entry
+	entry.Header = w.pending.header
+	entry.End = entry.Offset + zipEntryLength(w.pending.header)
+
+	commitErr := w.commit(entry)
+	if commitErr != nil {
+		return commitErr
+	}
+	w.pending = nil
+	return nil
+}
+
+/**
+add a file to the archive. The entry is recorded in the journal once it has been completely written out,
+which happens when the next entry is started or the writer is closed.
+*/
+func (w *ResumableZipWriter) AddEntry(entry *ArchiveEntry, src io.Reader) (string, error) {
+	if !entry.Compress && entry.HasCRC32 {
+		return w.addStoredEntry(entry, src)
+	}
+
+	header := &zip.FileHeader{
+		Name:               entry.Name,
+		UncompressedSize64: uint64(entry.Size),
+		Modified:           entry.Modified,
+	}
+	if entry.Compress {
+		header.Method = zip.Deflate
+	}
+
+	dest, createErr := w.zip.CreateHeader(header)
+	if createErr != nil {
+		return "", createErr
+	}
+
+	//creating the new header closed off the previous entry, so it can be committed now
+	commitErr := w.commitPending()
+	if commitErr != nil {
+		return "", commitErr
+	}
+
+	hasher := sha1.New()
+	_, copyErr := vidispine.BufferedCopy(dest, io.TeeReader(src, hasher), archiveCopyBufSize)
+	if copyErr != nil {
+		return "", copyErr
+	}
+
+	checksum := hex.EncodeToString(hasher.Sum(nil))
+	w.pending = &pendingEntry{entry: newJournalEntry(entry, w.offset, checksum), header: header}
+	return checksum, nil
+}
+
+/**
+converts a time to the MS-DOS date and time fields used in zip headers
+*/
+func msDosTime(t time.Time) (uint16, uint16) {
+	date := uint16(t.Day() + int(t.Month())<<5 + (t.Year()-1980)<<9)
+	clock := uint16(t.Second()/2 + t.Minute()<<5 + t.Hour()<<11)
+	return date, clock
+}
+
+/**
+write an uncompressed entry whose CRC and size are already known. These go into the local header rather than a
+data descriptor after the data, which is what streaming unzip tools need to be able to find the end of a stored entry
+*/
+func (w *ResumableZipWriter) addStoredEntry(entry *ArchiveEntry, src io.Reader) (string, error) {
+	header := &zip.FileHeader{
+		Name:               entry.Name,
+		Method:             zip.Store,
+		CreatorVersion:     zipVersion20,
+		ReaderVersion:      zipVersion20,
+		CRC32:              entry.CRC32,
+		CompressedSize64:   uint64(entry.Size),
+		UncompressedSize64: uint64(entry.Size),
+	}
+	if !entry.Modified.IsZero() {
+		header.ModifiedDate, header.ModifiedTime = msDosTime(entry.Modified)
+	}
+	if utf8.ValidString(entry.Name) && strings.IndexFunc(entry.Name, func(r rune) bool { return r >= utf8.RuneSelf }) >= 0 {
+		header.Flags |= zipUTF8Flag
+	}
+
+	dest, createErr := w.zip.CreateRaw(header)
+	if createErr != nil {
+		return "", createErr
+	}
+
+	commitErr := w.commitPending()
+	if commitErr != nil {
+		return "", commitErr
+	}
+
+	hasher := sha1.New()
+	crc := crc32.NewIEEE()
+	written, copyErr := io.CopyBuffer(dest, io.TeeReader(src, io.MultiWriter(hasher, crc)), make([]byte, archiveCopyBufSize))
+	if copyErr != nil {
+		return "", copyErr
+	}
+
+	//the header has already gone out, so if the content isn't what we said it was the archive is broken
+	if written != entry.Size || crc.Sum32() != entry.CRC32 {
+		return "", fmt.Errorf("stored entry %s has %d bytes with CRC %08x, expected %d bytes with CRC %08x", entry.Name, written, crc.Sum32(), entry.Size, entry.CRC32)
+	}
+
+	checksum := hex.EncodeToString(hasher.Sum(nil))
+	w.pending = &pendingEntry{entry: newJournalEntry(entry, w.offset, checksum), header: header}
+	return checksum, nil
+}
+
+/**
+close off the most recently added entry and record it in the journal. A throwaway directory entry is started to get
+zip.Writer to write the data descriptor, and the output is cut off where the entry ends so that none of it gets out
+*/
+func (w *ResumableZipWriter) closePending() error {
+	if w.pending == nil {
+		return nil
+	}
+
+	_, createErr := w.zip.Create("incomplete/")
+	if createErr != nil {
+		return createErr
+	}
+	w.output.cutoff = w.pending.entry.Offset + zipEntryLength(w.pending.header)
+	return w.commitPending()
+}
+
+/**
+finish the archive by writing the central directory. The journal is removed, since there is nothing left to resume
+*/
+func (w *ResumableZipWriter) Close() error {
+	closeErr := w.closePending()
+	if closeErr == nil {
+		closeErr = writeZipDirectory(w.out, w.offset, w.journal.Entries)
+	}
+	if closeErr != nil {
+		w.close()
+		return closeErr
+	}
+	return w.finish(true)
+}
+
+/**
+stop writing without finishing the archive. Completed entries stay in the journal, so the next run with the same
+output file can pick up from here
+*/
+func (w *ResumableZipWriter) Abort() error {
+	abortErr := w.closePending()
+
+	finishErr := w.finish(false)
+	if abortErr != nil {
+		return abortErr
+	}
+	return finishErr
+}
+
+/**
+stop writing and remove both the partial archive and its journal
+*/
+func (w *ResumableZipWriter) Discard() error {
+	w.close()
+	return w.remove()
+}
@@ -0,0 +1,219 @@
+package bundle
+
+import (
+	"archive/zip"
+	"bytes"
+	"github.com/guardian/deliverable_bundler/vidispine"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func addTestEntry(t *testing.T, w ArchiveWriter, fileId string, content string) {
+	entry := &ArchiveEntry{
+		Name:     fileId + ".txt",
+		Size:     int64(len(content)),
+		Modified: time.Now(),
+		Compress: true,
+		File:     &vidispine.VSFileDocument{Id: fileId, StorageId: "VX-1", Size: int64(len(content))},
+	}
+	_, addErr := w.AddEntry(entry, bytes.NewReader([]byte(content)))
+	if addErr != nil {
+		t.Fatal("Could not add entry: ", addErr)
+	}
+}
+
+func TestResumeAfterAbort(t *testing.T) {
+	outputFile := path.Join(t.TempDir(), "test.zip")
+
+	first, openErr := OpenArchive(FormatZip, outputFile, "file:///list.json", true, nil)
+	if openErr != nil {
+		t.Fatal("Could not open zip: ", openErr)
+	}
+	addTestEntry(t, first, "VX-10", "first file content")
+	addTestEntry(t, first, "VX-11", "second file content, which is a bit longer than the first")
+	first.Abort()
+
+	second, reopenErr := OpenArchive(FormatZip, outputFile, "file:///list.json", true, nil)
+	if reopenErr != nil {
+		t.Fatal("Could not reopen zip: ", reopenErr)
+	}
+	if !second.IsComplete("VX-1", "VX-10") || !second.IsComplete("VX-1", "VX-11") {
+		t.Error("Expected both entries from the first run to be complete")
+	}
+	addTestEntry(t, second, "VX-12", "third file content")
+	closeErr := second.Close()
+	if closeErr != nil {
+		t.Fatal("Could not close zip: ", closeErr)
+	}
+
+	if _, statErr := os.Stat(JournalPath(outputFile)); !os.IsNotExist(statErr) {
+		t.Error("Expected journal to be removed once the archive was complete")
+	}
+
+	reader, readErr := zip.OpenReader(outputFile)
+	if readErr != nil {
+		t.Fatal("Could not read back archive: ", readErr)
+	}
+	defer reader.Close()
+
+	expected := []string{"first file content", "second file content, which is a bit longer than the first", "third file content"}
+	if len(reader.File) != len(expected) {
+		t.Fatalf("Expected %d entries, got %d", len(expected), len(reader.File))
+	}
+	for i, f := range reader.File {
+		fp, _ := f.Open()
+		content, contentErr := ioutil.ReadAll(fp)
+		fp.Close()
+		if contentErr != nil {
+			t.Errorf("Could not read entry %s: %s", f.Name, contentErr)
+		}
+		if string(content) != expected[i] {
+			t.Errorf("Entry %s has content '%s', expected '%s'", f.Name, string(content), expected[i])
+		}
+	}
+}
+
+func TestStoredEntryResume(t *testing.T) {
+	outputFile := path.Join(t.TempDir(), "test.zip")
+	content := "stored file content"
+
+	first, openErr := OpenArchive(FormatZip, outputFile, "file:///list.json", true, nil)
+	if openErr != nil {
+		t.Fatal("Could not open zip: ", openErr)
+	}
+	entry := &ArchiveEntry{
+		Name:     "VX-10.mov",
+		Size:     int64(len(content)),
+		CRC32:    crc32.ChecksumIEEE([]byte(content)),
+		HasCRC32: true,
+		File:     &vidispine.VSFileDocument{Id: "VX-10", StorageId: "VX-1", Size: int64(len(content))},
+	}
+	if _, addErr := first.AddEntry(entry, bytes.NewReader([]byte(content))); addErr != nil {
+		t.Fatal("Could not add stored entry: ", addErr)
+	}
+	first.Abort()
+
+	second, reopenErr := OpenArchive(FormatZip, outputFile, "file:///list.json", true, nil)
+	if reopenErr != nil {
+		t.Fatal("Could not reopen zip: ", reopenErr)
+	}
+	if !second.IsComplete("VX-1", "VX-10") {
+		t.Error("Expected stored entry to be carried over")
+	}
+	addTestEntry(t, second, "VX-11", "compressed file content")
+	second.Close()
+
+	reader, readErr := zip.OpenReader(outputFile)
+	if readErr != nil {
+		t.Fatal("Could not read back archive: ", readErr)
+	}
+	defer reader.Close()
+
+	if len(reader.File) != 2 || reader.File[0].Method != zip.Store || reader.File[1].Method != zip.Deflate {
+		t.Fatal("Expected a stored entry followed by a deflated one")
+	}
+	if reader.File[0].Flags&zipDataDescriptorFlag != 0 {
+		t.Error("Stored entry should not use a data descriptor")
+	}
+	fp, _ := reader.File[0].Open()
+	readBack, contentErr := ioutil.ReadAll(fp)
+	if contentErr != nil || string(readBack) != content {
+		t.Errorf("Stored entry content was '%s' (%v)", string(readBack), contentErr)
+	}
+}
+
+func TestResumeDifferentContentList(t *testing.T) {
+	outputFile := path.Join(t.TempDir(), "test.zip")
+
+	first, openErr := OpenArchive(FormatZip, outputFile, "file:///list.json", true, nil)
+	if openErr != nil {
+		t.Fatal("Could not open zip: ", openErr)
+	}
+	addTestEntry(t, first, "VX-10", "first file content")
+	first.Abort()
+
+	second, reopenErr := OpenArchive(FormatZip, outputFile, "file:///other-list.json", true, nil)
+	if reopenErr != nil {
+		t.Fatal("Could not reopen zip: ", reopenErr)
+	}
+	defer second.Discard()
+
+	if second.IsComplete("VX-1", "VX-10") {
+		t.Error("Should not resume from a journal for a different content list")
+	}
+}
+
+/**
+add the same entries as addTestEntry, but with a fixed modification time so that archives can be compared byte for byte
+*/
+func addFixedEntries(t *testing.T, w ArchiveWriter, fileIds ...string) {
+	for _, fileId := range fileIds {
+		content := "content of " + fileId
+		entry := &ArchiveEntry{
+			Name:     fileId + ".txt",
+			Size:     int64(len(content)),
+			Modified: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+			Compress: true,
+			File:     &vidispine.VSFileDocument{Id: fileId, StorageId: "VX-1", Size: int64(len(content))},
+		}
+		if _, addErr := w.AddEntry(entry, bytes.NewReader([]byte(content))); addErr != nil {
+			t.Fatal("Could not add entry: ", addErr)
+		}
+	}
+}
+
+func TestResumedZipMatchesSingleRun(t *testing.T) {
+	dir := t.TempDir()
+
+	singleFile := path.Join(dir, "single.zip")
+	single, openErr := OpenArchive(FormatZip, singleFile, "file:///list.json", false, nil)
+	if openErr != nil {
+		t.Fatal("Could not open zip: ", openErr)
+	}
+	addFixedEntries(t, single, "VX-10", "VX-11", "VX-12")
+	if closeErr := single.Close(); closeErr != nil {
+		t.Fatal("Could not close zip: ", closeErr)
+	}
+
+	resumedFile := path.Join(dir, "resumed.zip")
+	first, openErr := OpenArchive(FormatZip, resumedFile, "file:///list.json", true, nil)
+	if openErr != nil {
+		t.Fatal("Could not open zip: ", openErr)
+	}
+	addFixedEntries(t, first, "VX-10", "VX-11")
+	first.Abort()
+	second, reopenErr := OpenArchive(FormatZip, resumedFile, "file:///list.json", true, nil)
+	if reopenErr != nil {
+		t.Fatal("Could not reopen zip: ", reopenErr)
+	}
+	addFixedEntries(t, second, "VX-12")
+	if closeErr := second.Close(); closeErr != nil {
+		t.Fatal("Could not close zip: ", closeErr)
+	}
+
+	//and the same entries written by zip.Writer on its own, to check the central directory against
+	var plain bytes.Buffer
+	plainWriter := zip.NewWriter(&plain)
+	for _, fileId := range []string{"VX-10", "VX-11", "VX-12"} {
+		dest, _ := plainWriter.CreateHeader(&zip.FileHeader{
+			Name:     fileId + ".txt",
+			Method:   zip.Deflate,
+			Modified: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		})
+		dest.Write([]byte("content of " + fileId))
+	}
+	plainWriter.Close()
+
+	singleContent, _ := os.ReadFile(singleFile)
+	resumedContent, _ := os.ReadFile(resumedFile)
+	if !bytes.Equal(singleContent, plain.Bytes()) {
+		t.Error("Expected the archive to be the same as one written by zip.Writer")
+	}
+	if !bytes.Equal(singleContent, resumedContent) {
+		t.Error("Expected the resumed archive to be the same as one written in a single run")
+	}
+}
@@ -0,0 +1,27 @@
+package bundle
+
+import (
+	"context"
+	"github.com/guardian/deliverable_bundler/contentlist"
+	"github.com/guardian/deliverable_bundler/logging"
+	"github.com/guardian/deliverable_bundler/vidispine"
+	"log/slog"
+)
+
+/**
+run an item search and return a content list with an entry for the given shape of each item that matched, so that
+a bundle can be made without a content list
+*/
+func SearchContentList(ctx context.Context, comm *vidispine.VidispineCommunicator, search *vidispine.VSItemSearchDocument, shape string, config vidispine.SearchConfig, logger *slog.Logger) ([]contentlist.ContentList, error) {
+	itemIds, searchErr := vidispine.SearchItemIds(ctx, comm, search, config)
+	if searchErr != nil {
+		return nil, searchErr
+	}
+	logging.OrDefault(logger).Info("Found items to bundle", "items", len(itemIds))
+
+	rtn := make([]contentlist.ContentList, len(itemIds))
+	for i, itemId := range itemIds {
+		rtn[i] = contentlist.ContentList{ItemId: itemId, Shape: shape}
+	}
+	return rtn, nil
+}
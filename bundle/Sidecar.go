@@ -0,0 +1,241 @@
+package bundle
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/guardian/deliverable_bundler/contentlist"
+	"github.com/guardian/deliverable_bundler/vidispine"
+	"io"
+	"log/slog"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+/**
+the format of the metadata sidecar written next to each file
+*/
+type SidecarFormat int
+
+const (
+	SidecarNone SidecarFormat = iota //no sidecars
+	SidecarXML                       //the item's MetadataListDocument as Vidispine sends it
+	SidecarJSON                      //a JSON object of field name to value, or a list of values if there are several
+	SidecarXMP                       //an XMP sidecar, with the title as dc:title and every field in its own namespace
+)
+
+/**
+convert a sidecar format name from the configuration into a SidecarFormat
+*/
+func ParseSidecarFormat(name string) (SidecarFormat, error) {
+	switch strings.ToLower(name) {
+	case "none", "":
+		return SidecarNone, nil
+	case "xml":
+		return SidecarXML, nil
+	case "json":
+		return SidecarJSON, nil
+	case "xmp":
+		return SidecarXMP, nil
+	default:
+		return SidecarNone, fmt.Errorf("unknown metadata sidecar format '%s', expected none, xml, json or xmp", name)
+	}
+}
+
+func (f SidecarFormat) String() string {
+	switch f {
+	case SidecarNone:
+		return "none"
+	case SidecarXML:
+		return "xml"
+	case SidecarJSON:
+		return "json"
+	case SidecarXMP:
+		return "xmp"
+	default:
+		return fmt.Sprintf("SidecarFormat(%d)", int(f))
+	}
+}
+
+/**
+controls the item metadata sidecars
+*/
+type SidecarConfig struct {
+	Format SidecarFormat
+	Fields []string //metadata fields to include. Empty means every field
+}
+
+/**
+returns the name of the sidecar for the archive entry `name`. XMP sidecars replace the extension, as most tools
+expect, and the others are added after it
+*/
+func sidecarName(name string, format SidecarFormat) string {
+	switch format {
+	case SidecarXMP:
+		return strings.TrimSuffix(name, path.Ext(name)) + ".xmp"
+	case SidecarJSON:
+		return name + ".metadata.json"
+	default:
+		return name + ".metadata.xml"
+	}
+}
+
+/**
+returns only the fields in the configured list, or all of them if there isn't one
+*/
+func (c *SidecarConfig) selectFields(fields map[string][]string) map[string][]string {
+	if len(c.Fields) == 0 {
+		return fields
+	}
+	rtn := make(map[string][]string, len(c.Fields))
+	for _, name := range c.Fields {
+		if values, present := fields[name]; present {
+			rtn[name] = values
+		}
+	}
+	return rtn
+}
+
+func renderJSONSidecar(itemId string, fields map[string][]string) ([]byte, error) {
+	flattened := make(map[string]interface{}, len(fields))
+	for name, values := range fields {
+		if len(values) == 1 {
+			flattened[name] = values[0]
+		} else {
+			flattened[name] = values
+		}
+	}
+	return json.MarshalIndent(map[string]interface{}{"itemId": itemId, "fields": flattened}, "", "  ")
+}
+
+var invalidXMLNameChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+/**
+returns the XMP element name for a metadata field. Characters that can't be in a name are replaced, and names that
+start with something that can't begin one, like a digit, are prefixed with an underscore
+*/
+func xmpElementName(field string) string {
+	name := invalidXMLNameChars.ReplaceAllString(field, "_")
+	if name == "" || strings.ContainsAny(name[:1], "0123456789-.") {
+		name = "_" + name
+	}
+	return "vs:" + name
+}
+
+func writeXMPText(buffer *bytes.Buffer, value string) {
+	xml.EscapeText(buffer, []byte(value))
+}
+
+func renderXMPSidecar(itemId string, fields map[string][]string) []byte {
+	var buffer bytes.Buffer
+	buffer.WriteString("<?xpacket begin=\"\xef\xbb\xbf\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n")
+	buffer.WriteString("<x:xmpmeta xmlns:x=\"adobe:ns:meta/\">\n")
+	buffer.WriteString(" <rdf:RDF xmlns:rdf=\"http://www.w3.org/1999/02/22-rdf-syntax-ns#\">\n")
+	buffer.WriteString("  <rdf:Description rdf:about=\"\" xmlns:dc=\"http://purl.org/dc/elements/1.1/\" xmlns:vs=\"http://xml.vidispine.com/schema/vidispine/xmp/\">\n")
+	buffer.WriteString("   <vs:itemId>")
+	writeXMPText(&buffer, itemId)
+	buffer.WriteString("</vs:itemId>\n")
+
+	if titles := fields["title"]; len(titles) > 0 {
+		buffer.WriteString("   <dc:title><rdf:Alt><rdf:li xml:lang=\"x-default\">")
+		writeXMPText(&buffer, titles[0])
+		buffer.WriteString("</rdf:li></rdf:Alt></dc:title>\n")
+	}
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		element := xmpElementName(name)
+		values := fields[name]
+		if len(values) == 1 {
+			buffer.WriteString("   <" + element + ">")
+			writeXMPText(&buffer, values[0])
+			buffer.WriteString("</" + element + ">\n")
+			continue
+		}
+		buffer.WriteString("   <" + element + "><rdf:Bag>")
+		for _, value := range values {
+			buffer.WriteString("<rdf:li>")
+			writeXMPText(&buffer, value)
+			buffer.WriteString("</rdf:li>")
+		}
+		buffer.WriteString("</rdf:Bag></" + element + ">\n")
+	}
+
+	buffer.WriteString("  </rdf:Description>\n")
+	buffer.WriteString(" </rdf:RDF>\n")
+	buffer.WriteString("</x:xmpmeta>\n")
+	buffer.WriteString("<?xpacket end=\"w\"?>\n")
+	return buffer.Bytes()
+}
+
+/**
+fetch the item's metadata and render it in the configured format
+*/
+func (c *SidecarConfig) render(ctx context.Context, comm *vidispine.VidispineCommunicator, itemId string) ([]byte, error) {
+	raw, metadata, metadataErr := vidispine.VSItemMetadata(ctx, comm, itemId, c.Fields)
+	if metadataErr != nil {
+		return nil, metadataErr
+	}
+	switch c.Format {
+	case SidecarJSON:
+		return renderJSONSidecar(itemId, c.selectFields(metadata.Flatten()))
+	case SidecarXMP:
+		return renderXMPSidecar(itemId, c.selectFields(metadata.Flatten())), nil
+	default:
+		return raw, nil
+	}
+}
+
+/**
+returns the ID of the item whose metadata goes in the file's sidecar, or an empty string if it isn't known
+*/
+func sidecarItemId(item contentlist.ContentList, fileData *vidispine.VSFileDocument) string {
+	if item.ItemId != "" {
+		return item.ItemId
+	}
+	return fileData.ItemId()
+}
+
+/**
+fetch and render the metadata sidecar for a file. A file that doesn't belong to an item has no sidecar, so nil is
+returned for it. An error means the item's metadata could not be fetched, and is treated like a failed download
+*/
+func (c *SidecarConfig) forFile(ctx context.Context, comm *vidispine.VidispineCommunicator, item contentlist.ContentList, fileData *vidispine.VSFileDocument, logger *slog.Logger) ([]byte, error) {
+	itemId := sidecarItemId(item, fileData)
+	if itemId == "" {
+		logger.Warn("File does not belong to an item, so it has no metadata sidecar")
+		return nil, nil
+	}
+
+	content, renderErr := c.render(ctx, comm, itemId)
+	if renderErr != nil {
+		return nil, fmt.Errorf("could not get metadata of item %s for the sidecar: %w", itemId, renderErr)
+	}
+	return content, nil
+}
+
+/**
+add the metadata sidecar for the file that went in as `name`. If another entry already has the sidecar's name, the
+item ID is added to it. The journal records which file the sidecar goes with, so that one lost by an interrupted run
+can be put back when the bundle is resumed
+*/
+func addSidecar(w ArchiveWriter, namer *EntryNamer, fileData *vidispine.VSFileDocument, itemId string, name string, content io.Reader, size int64, format SidecarFormat) error {
+	entry := &ArchiveEntry{
+		Name:      namer.Unique(sidecarName(name, format), itemId),
+		Size:      size,
+		Modified:  time.Now(),
+		Compress:  true,
+		SidecarOf: itemKey(fileData.StorageId, fileData.Id),
+	}
+	_, addErr := w.AddEntry(entry, content)
+	return addErr
+}
@@ -0,0 +1,291 @@
+package bundle
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"github.com/guardian/deliverable_bundler/apierror"
+	"github.com/guardian/deliverable_bundler/vidispine"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"testing"
+)
+
+var sampleMetadata = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<MetadataListDocument xmlns="http://xml.vidispine.com/schema/vidispine">
+    <item id="VX-123">
+        <metadata>
+            <timespan start="-INF" end="+INF">
+                <field><name>title</name><value>Rich &amp; Famous</value></field>
+                <field><name>gnm_rights</name><value>Guardian only</value></field>
+                <group>
+                    <name>Credits</name>
+                    <field><name>gnm_credit</name><value>Camera: A</value><value>Sound: B</value></field>
+                </group>
+            </timespan>
+            <timespan start="100" end="200">
+                <field><name>title</name><value>A clip within the item</value></field>
+            </timespan>
+        </metadata>
+    </item>
+</MetadataListDocument>`
+
+func sampleFields(t *testing.T) map[string][]string {
+	var doc vidispine.VSMetadataListDocument
+	if err := xml.Unmarshal([]byte(sampleMetadata), &doc); err != nil {
+		t.Fatal(err)
+	}
+	return doc.Flatten()
+}
+
+func TestFlattenMetadata(t *testing.T) {
+	fields := sampleFields(t)
+	if len(fields) != 3 || fields["title"][0] != "Rich & Famous" || len(fields["title"]) != 1 || len(fields["gnm_credit"]) != 2 {
+		t.Errorf("Unexpected fields: %v", fields)
+	}
+
+	config := SidecarConfig{Format: SidecarJSON, Fields: []string{"title", "gnm_credit", "not_there"}}
+	selected := config.selectFields(fields)
+	if len(selected) != 2 || selected["gnm_rights"] != nil {
+		t.Errorf("Expected only the listed fields, got %v", selected)
+	}
+}
+
+func TestJSONSidecar(t *testing.T) {
+	content, err := renderJSONSidecar("VX-123", sampleFields(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded struct {
+		ItemId string                 `json:"itemId"`
+		Fields map[string]interface{} `json:"fields"`
+	}
+	if err := json.Unmarshal(content, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.ItemId != "VX-123" || decoded.Fields["title"] != "Rich & Famous" {
+		t.Errorf("Unexpected sidecar: %s", content)
+	}
+	if credits, isList := decoded.Fields["gnm_credit"].([]interface{}); !isList || len(credits) != 2 {
+		t.Errorf("Expected a field with several values to be a list, got %v", decoded.Fields["gnm_credit"])
+	}
+}
+
+func TestXMPSidecar(t *testing.T) {
+	content := string(renderXMPSidecar("VX-123", sampleFields(t)))
+	for _, expected := range []string{
+		`<dc:title><rdf:Alt><rdf:li xml:lang="x-default">Rich &amp; Famous</rdf:li></rdf:Alt></dc:title>`,
+		`<vs:gnm_rights>Guardian only</vs:gnm_rights>`,
+		`<vs:gnm_credit><rdf:Bag><rdf:li>Camera: A</rdf:li><rdf:li>Sound: B</rdf:li></rdf:Bag></vs:gnm_credit>`,
+		`<vs:itemId>VX-123</vs:itemId>`,
+	} {
+		if !strings.Contains(content, expected) {
+			t.Errorf("Expected the sidecar to contain %s, got:\n%s", expected, content)
+		}
+	}
+
+	//the packet has to be well-formed for anything to read it
+	decoder := xml.NewDecoder(strings.NewReader(content))
+	for {
+		_, err := decoder.Token()
+		if err != nil {
+			if err != io.EOF {
+				t.Errorf("Sidecar is not well-formed: %s", err)
+			}
+			break
+		}
+	}
+}
+
+func TestXMPElementNames(t *testing.T) {
+	content := string(renderXMPSidecar("VX-123", map[string][]string{
+		"1stField":  {"first"},
+		"-dashed":   {"second"},
+		"gnm:extra": {"third"},
+	}))
+	for _, expected := range []string{
+		`<vs:_1stField>first</vs:_1stField>`,
+		`<vs:_-dashed>second</vs:_-dashed>`,
+		`<vs:gnm_extra>third</vs:gnm_extra>`,
+	} {
+		if !strings.Contains(content, expected) {
+			t.Errorf("Expected the sidecar to contain %s, got:\n%s", expected, content)
+		}
+	}
+}
+
+func TestSidecarNames(t *testing.T) {
+	tests := map[SidecarFormat]string{
+		SidecarXML:  "Rushes/A001.mov.metadata.xml",
+		SidecarJSON: "Rushes/A001.mov.metadata.json",
+		SidecarXMP:  "Rushes/A001.xmp",
+	}
+	for format, expected := range tests {
+		if name := sidecarName("Rushes/A001.mov", format); name != expected {
+			t.Errorf("Expected the %s sidecar to be %s, got %s", format, expected, name)
+		}
+	}
+
+	if _, err := ParseSidecarFormat("yaml"); err == nil {
+		t.Error("Expected an unknown sidecar format to be rejected")
+	}
+}
+
+/**
+files on VX-1 called clip.mxf and clip.mov, which belong to items VX-100 and VX-101
+*/
+func sidecarFiles() map[string]*testFile {
+	files := map[string]*testFile{"VX-10": newTestFile(1000, 0), "VX-11": newTestFile(1000, 1)}
+	files["VX-10"].path, files["VX-10"].itemId = "media/a/clip.mxf", "VX-100"
+	files["VX-11"].path, files["VX-11"].itemId = "media/b/clip.mov", "VX-101"
+	return files
+}
+
+/**
+answers metadata requests for the items in `available`, and says any other item doesn't exist
+*/
+func metadataIntercept(available ...string) func(w http.ResponseWriter, r *http.Request) bool {
+	return func(w http.ResponseWriter, r *http.Request) bool {
+		itemId, isMetadata := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/API/item/"), "/metadata")
+		if !isMetadata {
+			return false
+		}
+		for _, id := range available {
+			if id == itemId {
+				w.Write([]byte(strings.Replace(sampleMetadata, "VX-123", itemId, 1)))
+				return true
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+		return true
+	}
+}
+
+func TestSidecarsInBundle(t *testing.T) {
+	comm := fileCommunicator(t, sidecarFiles(), nil, metadataIntercept("VX-100", "VX-101"))
+	config := testBundleConfig()
+	config.Sidecar = SidecarConfig{Format: SidecarXMP}
+
+	result, entries, err := buildTestBundle(t, comm, testItems("VX-10", "VX-11"), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//both files have the stem "clip", so the second sidecar gets its item ID rather than being dropped
+	expected := map[string]string{"clip.mxf": "clip.xmp", "clip.mov": "clip_VX-101.xmp"}
+	for _, entry := range result.Manifest.Entries {
+		if entry.Sidecar != expected[entry.ArchivePath] {
+			t.Errorf("Expected the sidecar of %s to be %s, got '%s'", entry.ArchivePath, expected[entry.ArchivePath], entry.Sidecar)
+		}
+		if !strings.Contains(string(entries[entry.Sidecar]), "<vs:itemId>"+sidecarFiles()[entry.FileId].itemId+"</vs:itemId>") {
+			t.Errorf("Expected %s to hold the metadata of the file's item", entry.Sidecar)
+		}
+	}
+	if len(result.Manifest.Entries) != 2 {
+		t.Errorf("Expected the sidecars to be listed with their files rather than as entries, got %+v", result.Manifest.Entries)
+	}
+}
+
+func TestSidecarMemoryBudget(t *testing.T) {
+	comm := fileCommunicator(t, sidecarFiles(), nil, metadataIntercept("VX-100"))
+	sidecarInMemory := func(memoryLimit int64) bool {
+		config := DefaultPipelineConfig()
+		config.BufferSize = 256
+		config.MemoryLimit = memoryLimit
+		config.StagingDir = t.TempDir()
+		config.sidecar = &SidecarConfig{Format: SidecarXML}
+
+		inMemory := false
+		err := RunPipeline(context.Background(), comm, testItems("VX-10"), config, func(staged *StagedFile) error {
+			if staged.Err != nil {
+				return staged.Err
+			}
+			content, _ := io.ReadAll(staged.Sidecar)
+			if !strings.Contains(string(content), `<item id="VX-100">`) || staged.SidecarSize != int64(len(content)) {
+				t.Errorf("Expected the sidecar to be the item's metadata, got %d bytes", len(content))
+			}
+			inMemory = staged.sidecarBuffer.memory != nil
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return inMemory
+	}
+
+	//one worker's buffers take 512 bytes of the limit, and the sidecar is staged before the file
+	if !sidecarInMemory(512 + int64(len(sampleMetadata))) {
+		t.Error("Expected the sidecar to be held in memory when it fits in the limit")
+	}
+	if sidecarInMemory(512) {
+		t.Error("Expected the sidecar to be staged to disk when the limit has no room for it")
+	}
+}
+
+func TestSidecarFailure(t *testing.T) {
+	comm := fileCommunicator(t, sidecarFiles(), nil, metadataIntercept("VX-100"))
+	config := testBundleConfig()
+	config.Sidecar = SidecarConfig{Format: SidecarJSON}
+
+	if _, _, err := buildTestBundle(t, comm, testItems("VX-10", "VX-11"), config); !errors.Is(err, apierror.ErrNotFound) {
+		t.Errorf("Expected the missing metadata to stop the bundle, got %v", err)
+	}
+
+	config.FailurePolicy = SkipMissing
+	result, entries, err := buildTestBundle(t, comm, testItems("VX-10", "VX-11"), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Skipped) != 1 || result.Skipped[0].FileId != "VX-11" || result.Skipped[0].StatusCode != 404 {
+		t.Errorf("Expected VX-11 to be skipped, got %+v", result.Skipped)
+	}
+	if _, present := entries["clip.mov"]; present {
+		t.Error("Expected a file whose sidecar failed to be left out along with it")
+	}
+}
+
+func TestSidecarRestoredOnResume(t *testing.T) {
+	comm := fileCommunicator(t, sidecarFiles(), nil, metadataIntercept("VX-100", "VX-101"))
+	outputFile := path.Join(t.TempDir(), "test.zip")
+
+	//the first run gets as far as the file but not its sidecar
+	first, _ := OpenArchive(FormatZip, outputFile, "file:///list.json", true, nil)
+	config := testBundleConfig()
+	config.ManifestFormats = ManifestFormats{}
+	if _, err := BuildBundle(context.Background(), comm, "file:///list.json", testItems("VX-10"), first, config); err != nil {
+		t.Fatal(err)
+	}
+	first.Abort()
+
+	second, _ := OpenArchive(FormatZip, outputFile, "file:///list.json", true, nil)
+	config = testBundleConfig()
+	config.Sidecar = SidecarConfig{Format: SidecarXML}
+	result, err := BuildBundle(context.Background(), comm, "file:///list.json", testItems("VX-10", "VX-11"), second, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if closeErr := second.Close(); closeErr != nil {
+		t.Fatal(closeErr)
+	}
+
+	for _, entry := range result.Manifest.Entries {
+		if entry.Sidecar != entry.ArchivePath+".metadata.xml" {
+			t.Errorf("Expected %s to have a sidecar, got '%s'", entry.ArchivePath, entry.Sidecar)
+		}
+	}
+	reader, readErr := zip.OpenReader(outputFile)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	defer reader.Close()
+	var names []string
+	for _, file := range reader.File {
+		names = append(names, file.Name)
+	}
+	if strings.Join(names, ",") != "clip.mxf,clip.mxf.metadata.xml,clip.mov,clip.mov.metadata.xml,manifest.json" {
+		t.Errorf("Unexpected archive entries %v", names)
+	}
+}
@@ -0,0 +1,151 @@
+package bundle
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+var errAborted = errors.New("pipeline aborted")
+
+/**
+memoryBudget keeps track of how many bytes are currently staged in memory across all workers
+*/
+type memoryBudget struct {
+	mutex sync.Mutex
+	limit int64
+	used  int64
+}
+
+/**
+try to reserve the given number of bytes. Returns false if there is not enough room left, in which case
+the caller should stage to disk instead
+*/
+func (b *memoryBudget) tryReserve(size int64) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if size < 0 || b.used+size > b.limit {
+		return false
+	}
+	b.used += size
+	return true
+}
+
+func (b *memoryBudget) release(size int64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.used -= size
+}
+
+/**
+stagingBuffer holds the content of a single downloaded file until the archive writer is ready for it.
+Content is held either in memory or in a temporary file in the staging directory
+*/
+type stagingBuffer struct {
+	memory   *bytes.Buffer
+	file     *os.File
+	reserved int64
+	budget   *memoryBudget
+	abort    <-chan struct{}
+	crc      hash.Hash32
+	sha      hash.Hash
+}
+
+/**
+create a staging buffer for a file of the given size. If the memory budget allows it the content is held
+in memory, otherwise it goes to a temporary file in stagingDir
+*/
+func newStagingBuffer(size int64, budget *memoryBudget, stagingDir string, abort <-chan struct{}) (*stagingBuffer, error) {
+	if budget.tryReserve(size) {
+		return &stagingBuffer{
+			memory:   bytes.NewBuffer(make([]byte, 0, size)),
+			reserved: size,
+			budget:   budget,
+			abort:    abort,
+			crc:      crc32.NewIEEE(),
+			sha:      sha1.New(),
+		}, nil
+	}
+
+	fp, createErr := ioutil.TempFile(stagingDir, "bundler-staging-")
+	if createErr != nil {
+		return nil, createErr
+	}
+	return &stagingBuffer{
+		file:   fp,
+		budget: budget,
+		abort:  abort,
+		crc:    crc32.NewIEEE(),
+		sha:    sha1.New(),
+	}, nil
+}
+
+func (s *stagingBuffer) Write(p []byte) (int, error) {
+	select {
+	case <-s.abort:
+		return 0, errAborted
+	default:
+	}
+
+	s.crc.Write(p)
+	s.sha.Write(p)
+	if s.memory != nil {
+		return s.memory.Write(p)
+	} else {
+		return s.file.Write(p)
+	}
+}
+
+/**
+returns the CRC-32 of everything written so far. Zip needs this up front for entries that are stored uncompressed
+*/
+func (s *stagingBuffer) CRC32() uint32 {
+	return s.crc.Sum32()
+}
+
+/**
+returns the SHA-1 of everything written so far as a hex string, so that the content can be checked against the
+Vidispine hash before it goes into the archive
+*/
+func (s *stagingBuffer) SHA1() string {
+	return hex.EncodeToString(s.sha.Sum(nil))
+}
+
+/**
+returns a reader for the staged content. This must only be called once all data has been written
+*/
+func (s *stagingBuffer) Reader() (io.Reader, error) {
+	if s.memory != nil {
+		return s.memory, nil
+	}
+
+	_, seekErr := s.file.Seek(0, io.SeekStart)
+	if seekErr != nil {
+		return nil, seekErr
+	}
+	return s.file, nil
+}
+
+/**
+release any memory reservation and remove the temporary file, if there is one
+*/
+func (s *stagingBuffer) Release() {
+	if s.memory != nil {
+		s.memory = nil
+		s.budget.release(s.reserved)
+		s.reserved = 0
+	}
+	if s.file != nil {
+		s.file.Close()
+		os.Remove(s.file.Name())
+		s.file = nil
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/guardian/deliverable_bundler/jobs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func writeJson(w http.ResponseWriter, status int, content interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encodeErr := json.NewEncoder(w).Encode(content)
+	if encodeErr != nil {
+		slog.Warn("Could not write response", "error", encodeErr)
+	}
+}
+
+func writeJsonError(w http.ResponseWriter, status int, err error) {
+	writeJson(w, status, map[string]string{"error": err.Error()})
+}
+
+/**
+build a job filter from the status, source, content_list, since (RFC3339) and limit query parameters
+*/
+func jobFilterFromQuery(query url.Values) (jobs.JobFilter, error) {
+	filter := jobs.JobFilter{
+		Status:      jobs.JobStatus(query.Get("status")),
+		Source:      query.Get("source"),
+		ContentList: query.Get("content_list"),
+		Limit:       100,
+	}
+	if since := query.Get("since"); since != "" {
+		var parseErr error
+		filter.Since, parseErr = time.Parse(time.RFC3339, since)
+		if parseErr != nil {
+			return filter, fmt.Errorf("could not parse since: %s", parseErr)
+		}
+	}
+	if limit := query.Get("limit"); limit != "" {
+		var parseErr error
+		filter.Limit, parseErr = strconv.Atoi(limit)
+		if parseErr != nil {
+			return filter, fmt.Errorf("could not parse limit: %s", parseErr)
+		}
+	}
+	return filter, nil
+}
+
+/**
+GET /jobs lists recent jobs, newest first, optionally filtered by the query parameters. POST /jobs submits a new one, with a JSON JobRequest as the body
+*/
+func (s *bundleServer) handleJobs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		filter, filterErr := jobFilterFromQuery(r.URL.Query())
+		if filterErr != nil {
+			writeJsonError(w, http.StatusBadRequest, filterErr)
+			return
+		}
+		results, queryErr := s.jobs.Query(filter)
+		if queryErr != nil {
+			slog.Error("Could not list jobs", "error", queryErr)
+			writeJsonError(w, http.StatusInternalServerError, queryErr)
+			return
+		}
+		writeJson(w, http.StatusOK, results)
+	case http.MethodPost:
+		var request jobs.JobRequest
+		decodeErr := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024*1024)).Decode(&request)
+		if decodeErr != nil {
+			writeJsonError(w, http.StatusBadRequest, decodeErr)
+			return
+		}
+		if !s.contentListAllowed(request.ContentList) {
+			writeJsonError(w, http.StatusForbidden, errors.New("content list is not allowed"))
+			return
+		}
+
+		job, submitErr := s.jobs.Submit(request)
+		switch {
+		case submitErr == jobs.ErrQueueFull:
+			writeJsonError(w, http.StatusServiceUnavailable, submitErr)
+		case submitErr == jobs.ErrOutputInUse:
+			writeJsonError(w, http.StatusConflict, submitErr)
+		case submitErr != nil:
+			writeJsonError(w, http.StatusBadRequest, submitErr)
+		default:
+			w.Header().Set("Location", "/jobs/"+job.Id)
+			writeJson(w, http.StatusAccepted, job)
+		}
+	default:
+		writeJsonError(w, http.StatusMethodNotAllowed, errors.New("only GET and POST are supported"))
+	}
+}
+
+/**
+GET /jobs/{id} returns the job with its per-file progress. DELETE /jobs/{id} or POST /jobs/{id}/cancel cancels it
+*/
+func (s *bundleServer) handleJob(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/")
+	id := parts[0]
+	cancel := false
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		cancel = true
+	case len(parts) == 2 && parts[1] == "cancel" && r.Method == http.MethodPost:
+		cancel = true
+	default:
+		writeJsonError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+
+	if cancel {
+		cancelErr := s.jobs.Cancel(id)
+		switch {
+		case cancelErr == jobs.ErrJobNotFound:
+			writeJsonError(w, http.StatusNotFound, cancelErr)
+			return
+		case cancelErr == jobs.ErrJobFinished:
+			writeJsonError(w, http.StatusConflict, cancelErr)
+			return
+		}
+	}
+
+	job := s.jobs.Get(id)
+	if job == nil {
+		writeJsonError(w, http.StatusNotFound, jobs.ErrJobNotFound)
+		return
+	}
+	writeJson(w, http.StatusOK, job)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/guardian/deliverable_bundler/jobs"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+const jobsUsage = `Usage:
+  bundler jobs list [-store path] [-status status] [-source cli|server] [-content-list uri] [-since time] [-limit n]
+  bundler jobs show [-store path] <job id>
+
+The store defaults to job_store from the environment.
+`
+
+func formatJobTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04:05")
+}
+
+/**
+run the "jobs" subcommand, which lists and inspects jobs in the job store. Returns the exit code
+*/
+func runJobsCommand(args []string) int {
+	if len(args) == 0 || (args[0] != "list" && args[0] != "show") {
+		fmt.Fprint(os.Stderr, jobsUsage)
+		return 1
+	}
+
+	flags := flag.NewFlagSet("jobs "+args[0], flag.ExitOnError)
+	flags.Usage = func() { fmt.Fprint(os.Stderr, jobsUsage) }
+	storePath := flags.String("store", os.Getenv("job_store"), "path to the job store")
+	status := flags.String("status", "", "only list jobs with this status")
+	source := flags.String("source", "", "only list jobs started from the cli or the server")
+	contentList := flags.String("content-list", "", "only list jobs for this content list")
+	since := flags.String("since", "", "only list jobs submitted after this time, in RFC3339 format")
+	limit := flags.Int("limit", 20, "maximum number of jobs to list, 0 for no limit")
+	flags.Parse(args[1:])
+
+	if *storePath == "" {
+		fmt.Fprintln(os.Stderr, "You need to set job_store in the environment or pass -store")
+		return 1
+	}
+	//a running server or bundle keeps the store open for writing, and until it stops the store can't be read
+	store, storeErr := jobs.OpenStoreReadOnly(*storePath)
+	if storeErr != nil {
+		fmt.Fprintf(os.Stderr, "Could not open job store %s, it may be in use by a running bundler: %s\n", *storePath, storeErr)
+		return 1
+	}
+	defer store.Close()
+
+	if args[0] == "show" {
+		if flags.NArg() != 1 {
+			fmt.Fprint(os.Stderr, jobsUsage)
+			return 1
+		}
+		job, getErr := store.Get(flags.Arg(0))
+		if getErr != nil {
+			fmt.Fprintf(os.Stderr, "Could not get job %s: %s\n", flags.Arg(0), getErr)
+			return 1
+		}
+		content, _ := json.MarshalIndent(job, "", "  ")
+		fmt.Println(string(content))
+		return 0
+	}
+
+	filter := jobs.JobFilter{
+		Status:      jobs.JobStatus(*status),
+		Source:      *source,
+		ContentList: *contentList,
+		Limit:       *limit,
+	}
+	if *since != "" {
+		var parseErr error
+		filter.Since, parseErr = time.Parse(time.RFC3339, *since)
+		if parseErr != nil {
+			fmt.Fprintf(os.Stderr, "Could not parse -since: %s\n", parseErr)
+			return 1
+		}
+	}
+
+	results, listErr := store.List(filter)
+	if listErr != nil {
+		fmt.Fprintf(os.Stderr, "Could not list jobs: %s\n", listErr)
+		return 1
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "ID\tSTATUS\tSOURCE\tSTARTED\tFINISHED\tFILES\tBYTES\tOUTPUT")
+	for _, job := range results {
+		done := 0
+		for _, file := range job.Files {
+			if file.Status == jobs.FileDone {
+				done++
+			}
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%d/%d\t%d\t%s\n", job.Id, job.Status, job.Source,
+			formatJobTime(job.Started), formatJobTime(job.Finished), done, len(job.Files), job.Bytes, job.Output)
+	}
+	table.Flush()
+	return 0
+}
@@ -1,129 +1,532 @@
 package main
 
 import (
-	"archive/zip"
+	"context"
+	"errors"
+	"github.com/guardian/deliverable_bundler/bundle"
 	"github.com/guardian/deliverable_bundler/contentlist"
+	"github.com/guardian/deliverable_bundler/jobs"
+	"github.com/guardian/deliverable_bundler/logging"
+	"github.com/guardian/deliverable_bundler/metrics"
+	"github.com/guardian/deliverable_bundler/progress"
+	"github.com/guardian/deliverable_bundler/retry"
 	"github.com/guardian/deliverable_bundler/vidispine"
+	"github.com/guardian/deliverable_bundler/webhook"
 	"io"
 	"log"
+	"log/slog"
 	"net/url"
 	"os"
-	"path"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
-func initialiseZip(filename string) (*zip.Writer, error) {
-	newFile, openErr := os.Create(filename)
-	if openErr != nil {
-		return nil, openErr
+/**
+read a string value from the environment, falling back to defaultValue if it is not set
+*/
+func getEnvString(name string, defaultValue string) string {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
+
+/**
+read an integer value from the environment, falling back to defaultValue if it is not set
+*/
+func getEnvInt(name string, defaultValue int64) int64 {
+	stringValue := os.Getenv(name)
+	if stringValue == "" {
+		return defaultValue
 	}
 
-	zipWriter := zip.NewWriter(newFile)
-	return zipWriter, nil
+	value, parseErr := strconv.ParseInt(stringValue, 10, 64)
+	if parseErr != nil {
+		log.Fatalf("Could not parse %s value '%s' as a number: %s", name, stringValue, parseErr.Error())
+	}
+	return value
 }
 
-func addToZip(zipWriter *zip.Writer, src io.Reader, name string, size int64) error {
-	header := zip.FileHeader{
-		Name:               name,
-		UncompressedSize64: uint64(size),
+/**
+read a number of retries from the environment and return the total number of attempts that makes, counting the first.
+`defaultAttempts` is used if it is not set. Every *_retries setting means the same thing: how many times to try
+again after the first attempt fails, so 0 disables retries
+*/
+func getEnvAttempts(name string, defaultAttempts int) int {
+	retries := getEnvInt(name, int64(defaultAttempts-1))
+	if retries < 0 {
+		log.Fatalf("%s can't be negative, use 0 to disable retries", name)
 	}
+	return 1 + int(retries)
+}
 
-	dest, writErr := zipWriter.CreateHeader(&header)
-	if writErr != nil {
-		return writErr
+/**
+read a duration, like "1s" or "500ms", from the environment, falling back to defaultValue if it is not set
+*/
+func getEnvDuration(name string, defaultValue time.Duration) time.Duration {
+	stringValue := os.Getenv(name)
+	if stringValue == "" {
+		return defaultValue
 	}
 
-	_, copyErr := vidispine.BufferedCopy(dest, src, 4*1024*1024)
+	value, parseErr := time.ParseDuration(stringValue)
+	if parseErr != nil {
+		log.Fatalf("Could not parse %s value '%s' as a duration: %s", name, stringValue, parseErr.Error())
+	}
+	return value
+}
 
-	if copyErr != nil {
-		return copyErr
+/**
+build the download pipeline configuration from the environment
+*/
+func pipelineConfigFromEnv() bundle.PipelineConfig {
+	config := bundle.DefaultPipelineConfig()
+	config.Concurrency = int(getEnvInt("concurrency", int64(config.Concurrency)))
+	config.BufferSize = int(getEnvInt("buffer_size", int64(config.BufferSize)))
+	config.MemoryLimit = getEnvInt("memory_limit", config.MemoryLimit)
+	config.Prefetch = int(getEnvInt("prefetch", int64(config.Prefetch)))
+	config.ReadRetry.MaxAttempts = getEnvAttempts("read_retries", config.ReadRetry.MaxAttempts)
+	config.ReadRetry.InitialDelay = getEnvDuration("read_retry_delay", config.ReadRetry.InitialDelay)
+	config.ReadRetry.MaxDelay = getEnvDuration("read_retry_max_delay", config.ReadRetry.MaxDelay)
+	config.ItemAttempts = getEnvAttempts("item_retries", config.ItemAttempts)
+
+	//file_states is a list of STATE=action, e.g. LOST=skip,OPEN=wait, that changes the default for those states
+	config.StatePolicy = bundle.DefaultStatePolicy()
+	if stateErr := config.StatePolicy.ParseActions(os.Getenv("file_states")); stateErr != nil {
+		log.Fatal(stateErr)
+	}
+	config.StatePolicy.WaitTimeout = getEnvDuration("file_state_wait", config.StatePolicy.WaitTimeout)
+	config.StatePolicy.PollInterval = getEnvDuration("file_state_poll", config.StatePolicy.PollInterval)
+	config.StatePolicy.Rescan = os.Getenv("rescan_storage") == "true"
+	if stagingDir := os.Getenv("staging_dir"); stagingDir != "" {
+		config.StagingDir = stagingDir
+	}
+	return config
+}
+
+/**
+build the bundle configuration from the environment
+*/
+func bundleConfigFromEnv() *bundle.BundleConfig {
+	config := bundle.DefaultBundleConfig()
+	config.Pipeline = pipelineConfigFromEnv()
+	config.NamingStripPrefix = os.Getenv("naming_strip_prefix")
+	config.NamingTemplate = os.Getenv("naming_template")
+	config.ManifestName = getEnvString("manifest_name", "manifest")
+	if storageList := os.Getenv("preferred_storages"); storageList != "" {
+		for _, storageId := range strings.Split(storageList, ",") {
+			config.PreferredStorages = append(config.PreferredStorages, strings.TrimSpace(storageId))
+		}
 	}
 
-	return nil
+	var err error
+	config.ManifestFormats, err = bundle.ParseManifestFormats(getEnvString("manifest", "json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	config.NamingMode, err = bundle.ParseNamingMode(os.Getenv("naming"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	config.Compression, err = bundle.ParseCompressionPolicy(os.Getenv("compression"), os.Getenv("store_types"), os.Getenv("compress_types"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	config.ChecksumPolicy, err = bundle.ParseChecksumPolicy(getEnvString("checksum_policy", "flag"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	config.FailurePolicy, err = bundle.ParseFailurePolicy(os.Getenv("on_failure"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	config.Sidecar.Format, err = bundle.ParseSidecarFormat(os.Getenv("metadata_sidecar"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if fieldList := os.Getenv("metadata_fields"); fieldList != "" {
+		for _, field := range strings.Split(fieldList, ",") {
+			config.Sidecar.Fields = append(config.Sidecar.Fields, strings.TrimSpace(field))
+		}
+	}
+
+	//fail now rather than on the first bundle if the naming options don't work together
+	_, namerErr := bundle.NewEntryNamer(config.NamingMode, config.NamingStripPrefix, config.NamingTemplate)
+	if namerErr != nil {
+		log.Fatal(namerErr)
+	}
+	return config
 }
 
-func main() {
-	contentListUri := os.Getenv("content_list")
-	serverToken := os.Getenv("server_token")
-	outputFile := os.Getenv("output_file")
+/**
+set up the default logger from log_format (text or json) and log_level (debug, info, warn or error) in the
+environment. Logs always go to stderr, so they never get mixed in with a bundle streamed to stdout
+*/
+func setupLogging() {
+	logger, loggerErr := logging.New(os.Stderr, os.Getenv("log_format"), os.Getenv("log_level"))
+	if loggerErr != nil {
+		log.Fatal(loggerErr)
+	}
+	slog.SetDefault(logger)
+}
 
-	vsUri := os.Getenv("vidispine_url")
-	vsUser := os.Getenv("vidispine_user")
-	vsPass := os.Getenv("vidispine_password")
-	vsToken := os.Getenv("vidispine_token")
+/**
+build the retry policy for requests to Vidispine and the content list server from the environment. http_retries
+is the number of retries after the first attempt, and http_retry_statuses a comma-separated list of status codes to retry
+*/
+func retryPolicyFromEnv() *retry.Policy {
+	policy := retry.DefaultPolicy()
+	policy.MaxAttempts = getEnvAttempts("http_retries", policy.MaxAttempts)
+	policy.InitialDelay = getEnvDuration("http_retry_delay", policy.InitialDelay)
+	policy.MaxDelay = getEnvDuration("http_retry_max_delay", policy.MaxDelay)
 
-	if contentListUri == "" || serverToken == "" || outputFile == "" {
-		log.Fatal("You need to set content_list, server_token and output_file in the environment")
+	if statusList := os.Getenv("http_retry_statuses"); statusList != "" {
+		policy.RetryableStatuses = nil
+		for _, part := range strings.Split(statusList, ",") {
+			status, parseErr := strconv.Atoi(strings.TrimSpace(part))
+			if parseErr != nil {
+				log.Fatalf("Could not parse http_retry_statuses value '%s' as a status code", part)
+			}
+			policy.RetryableStatuses = append(policy.RetryableStatuses, status)
+		}
 	}
+	return policy
+}
 
+/**
+build the Vidispine communicator from the environment
+*/
+func communicatorFromEnv() *vidispine.VidispineCommunicator {
+	vsUri := os.Getenv("vidispine_url")
 	vsUriData, uriParseErr := url.Parse(vsUri)
 	if uriParseErr != nil {
 		log.Fatalf("Could not parse provided Vidispine URI '%s': %s", vsUri, uriParseErr.Error())
 	}
 
-	downloadsList, downloadErr := contentlist.DownloadContentList(contentListUri, serverToken)
+	portPart, _ := strconv.Atoi(vsUriData.Port())
 
-	if downloadErr != nil {
-		log.Fatal("Could not download content list from ", contentListUri)
+	return &vidispine.VidispineCommunicator{
+		Protocol:       vsUriData.Scheme,
+		Hostname:       vsUriData.Host,
+		Port:           portPart,
+		User:           os.Getenv("vidispine_user"),
+		Password:       os.Getenv("vidispine_password"),
+		Token:          os.Getenv("vidispine_token"),
+		RequestTimeout: getEnvDuration("request_timeout", 5*time.Minute),
+		Retry:          retryPolicyFromEnv(),
 	}
+}
 
-	writer, initErr := initialiseZip(outputFile)
+/**
+set up progress reporting from the environment. `progress` is "bar" for a progress bar on stderr, or "json" for a
+stream of JSON reports, one per line, written to progress_file or stderr. Returns nil if progress is not wanted
+*/
+func progressTrackerFromEnv() *progress.Tracker {
+	interval := getEnvDuration("progress_interval", time.Second)
 
-	if initErr != nil {
-		log.Fatal("Could not initialise output writer: ", initErr.Error())
+	switch os.Getenv("progress") {
+	case "", "none":
+		return nil
+	case "bar":
+		return progress.NewTracker(interval, progress.Bar(os.Stderr))
+	case "json":
+		var dest io.Writer = os.Stderr
+		if progressFile := os.Getenv("progress_file"); progressFile != "" {
+			fp, createErr := os.Create(progressFile)
+			if createErr != nil {
+				log.Fatalf("Could not create progress file %s: %s", progressFile, createErr)
+			}
+			dest = fp
+		}
+		return progress.NewTracker(interval, progress.JSONLines(dest))
+	default:
+		log.Fatalf("Unknown progress mode '%s', expected none, bar or json", os.Getenv("progress"))
+		return nil
 	}
+}
 
-	portPart, _ := strconv.Atoi(vsUriData.Port())
+/**
+set up completion webhooks from the environment. webhook_urls is a comma-separated list of URLs, and payloads are
+signed with webhook_secret if it is set. Returns nil if there are no webhooks
+*/
+func notifierFromEnv() *webhook.Notifier {
+	urls := webhook.ParseURLs(os.Getenv("webhook_urls"))
+	if len(urls) == 0 {
+		return nil
+	}
 
-	comm := vidispine.VidispineCommunicator{
-		Protocol: vsUriData.Scheme,
-		Hostname: vsUriData.Host,
-		Port:     int16(portPart),
-		User:     vsUser,
-		Password: vsPass,
-		Token:    vsToken,
+	config := webhook.DefaultConfig()
+	config.URLs = urls
+	config.Secret = os.Getenv("webhook_secret")
+	config.MaxAttempts = getEnvAttempts("webhook_retries", config.MaxAttempts)
+	config.InitialDelay = getEnvDuration("webhook_retry_delay", config.InitialDelay)
+	config.MaxDelay = getEnvDuration("webhook_retry_max_delay", config.MaxDelay)
+	config.Timeout = getEnvDuration("webhook_timeout", config.Timeout)
+	if config.Secret == "" {
+		slog.Warn("webhook_secret is not set, so webhook payloads will not be signed")
 	}
+	return webhook.NewNotifier(config)
+}
 
-	success := true
+/**
+tell the webhooks, if there are any, that the job has finished
+*/
+func notifyFinished(notifier *webhook.Notifier, job *jobs.Job, result *bundle.BundleResult) {
+	if notifier == nil {
+		return
+	}
+	sendErr := notifier.Send(webhook.NewPayload(job, result))
+	if sendErr != nil {
+		job.Logger().Error("Could not send completion webhook", "error", sendErr)
+	}
+}
 
-	for _, item := range downloadsList {
-		fileData, vsErr := vidispine.VSFileInfo(&comm, item.StorageId, item.FileId)
+/**
+record how a one-shot run ended, send out the completion webhooks, and write the metrics for the textfile
+collector if metrics_textfile is set
+*/
+func finishJob(job *jobs.Job, notifier *webhook.Notifier, status jobs.JobStatus, result *bundle.BundleResult, err error) {
+	job.Finish(status, err)
+	notifyFinished(notifier, job.Snapshot(), result)
 
-		if vsErr != nil {
-			log.Printf("Could not open file connection to VS: %s", vsErr.Error())
-			success = false
-			break
+	if textfile := os.Getenv("metrics_textfile"); textfile != "" {
+		if writeErr := metrics.WriteTextfile(textfile); writeErr != nil {
+			job.Logger().Error("Could not write metrics", "path", textfile, "error", writeErr)
 		}
+	}
+}
 
-		basename := path.Base(fileData.Path)
+/**
+run the item search given in the environment as field=value;field=value, with search_page_size items per request
+and at most search_max_results items, and return a content list of the shape given by shape for each item found
+*/
+func searchFromEnv(ctx context.Context, comm *vidispine.VidispineCommunicator, query string, logger *slog.Logger) ([]contentlist.ContentList, error) {
+	search, parseErr := vidispine.ParseItemSearch(query)
+	if parseErr != nil {
+		log.Fatal(parseErr)
+	}
+	config := vidispine.DefaultSearchConfig()
+	config.PageSize = int(getEnvInt("search_page_size", int64(config.PageSize)))
+	config.MaxResults = int(getEnvInt("search_max_results", int64(config.MaxResults)))
+	return bundle.SearchContentList(ctx, comm, search, os.Getenv("shape"), config, logger)
+}
 
-		reader, readErr := vidispine.NewVSFileReader(&comm, fileData)
-		if readErr != nil {
-			log.Printf("Could not read from %s on %s", item.FileId, item.StorageId)
-			success = false
-			break
+/**
+write the failure report to the file named by failure_report in the environment, if it is set, so that it can be
+picked up without opening the bundle
+*/
+func writeFailureReport(skipped []bundle.SkippedItem, logger *slog.Logger) {
+	reportPath := os.Getenv("failure_report")
+	if reportPath == "" {
+		return
+	}
+	f, createErr := os.Create(reportPath)
+	if createErr != nil {
+		logger.Error("Could not create failure report", "path", reportPath, "error", createErr)
+		return
+	}
+	defer f.Close()
+	if writeErr := bundle.WriteFailureReport(f, skipped); writeErr != nil {
+		logger.Error("Could not write failure report", "path", reportPath, "error", writeErr)
+	}
+}
+
+/**
+open the job store named by job_store in the environment. Returns nil if it is not set
+*/
+func jobStoreFromEnv() *jobs.Store {
+	storePath := os.Getenv("job_store")
+	if storePath == "" {
+		return nil
+	}
+	store, storeErr := jobs.OpenStore(storePath)
+	if storeErr != nil {
+		log.Fatalf("Could not open job store %s: %s", storePath, storeErr)
+	}
+	return store
+}
+
+func main() {
+	setupLogging()
+	if len(os.Args) > 1 && os.Args[1] == "jobs" {
+		os.Exit(runJobsCommand(os.Args[2:]))
+	}
+
+	contentListUri := os.Getenv("content_list")
+	serverToken := os.Getenv("server_token")
+	outputFile := os.Getenv("output_file")
+	listenAddress := os.Getenv("listen_address")
+
+	outputFormat, formatErr := bundle.ParseArchiveFormat(os.Getenv("output_format"))
+	if formatErr != nil {
+		log.Fatal(formatErr)
+	}
+
+	//SIGTERM or ctrl-C stops whatever is running cleanly, keeping the journal so the bundle can be resumed
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	if listenAddress != "" {
+		if serverToken == "" {
+			log.Fatal("You need to set server_token in the environment")
+		}
+		server := &bundleServer{
+			comm:              communicatorFromEnv(),
+			config:            bundleConfigFromEnv(),
+			format:            outputFormat,
+			serverToken:       serverToken,
+			apiToken:          os.Getenv("api_token"),
+			contentListPrefix: os.Getenv("content_list_prefix"),
 		}
+		//the job API writes bundles to disk, so it is only available if there is somewhere to put them
+		if outputDir := os.Getenv("output_dir"); outputDir != "" {
+			notifier := notifierFromEnv()
+			//with no workers, every job would sit in the queue forever
+			jobWorkers := int(getEnvInt("job_workers", 1))
+			if jobWorkers < 1 {
+				log.Fatal("job_workers must be at least 1")
+			}
+			server.jobs = jobs.NewManager(ctx, server.comm, jobs.ManagerConfig{
+				Workers:        jobWorkers,
+				QueueSize:      int(getEnvInt("job_queue_size", 10)),
+				History:        int(getEnvInt("job_history", 100)),
+				OutputDir:      outputDir,
+				ServerToken:    serverToken,
+				Format:         outputFormat,
+				Bundle:         server.config,
+				Store:          jobStoreFromEnv(),
+				JobTimeout:     getEnvDuration("job_timeout", 0),
+				Retry:          server.comm.Retry,
+				RequestTimeout: server.comm.RequestTimeout,
+				OnFinished: func(job *jobs.Job, result *bundle.BundleResult) {
+					notifyFinished(notifier, job, result)
+				},
+			})
+		}
+		if serveErr := server.ListenAndServe(ctx, listenAddress); serveErr != nil {
+			log.Fatal(serveErr)
+		}
+		if server.jobs != nil {
+			server.jobs.Wait()
+		}
+		os.Exit(0)
+	}
 
-		addErr := addToZip(writer, reader, basename, fileData.Size)
+	//a collection or the results of a search can be bundled without a content list, taking the shape given in the
+	//environment from each item
+	collectionId := os.Getenv("collection")
+	searchQuery := os.Getenv("search")
+	switch {
+	case collectionId != "":
+		contentListUri = "collection:" + collectionId
+	case searchQuery != "":
+		contentListUri = "search:" + searchQuery
+	case contentListUri == "" || serverToken == "":
+		log.Fatal("You need to set content_list and server_token, collection, or search in the environment")
+	}
+	if outputFile == "" {
+		log.Fatal("You need to set output_file in the environment")
+	}
+
+	job := jobs.NewJob(jobs.SourceCLI, contentListUri, outputFile, outputFormat.String(), jobStoreFromEnv())
+	logger := job.Logger()
+	comm := communicatorFromEnv().WithLogger(logger)
+	notifier := notifierFromEnv()
+	tracker := progressTrackerFromEnv()
+	baseConfig := bundleConfigFromEnv()
+	baseConfig.Pipeline.Progress = tracker
+	config := job.BundleConfig(baseConfig)
+	job.Start()
+
+	if timeout := getEnvDuration("bundle_timeout", 0); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var downloadsList []contentlist.ContentList
+	var downloadErr error
+	switch {
+	case collectionId != "":
+		downloadsList = []contentlist.ContentList{{CollectionId: collectionId, Shape: os.Getenv("shape")}}
+	case searchQuery != "":
+		downloadsList, downloadErr = searchFromEnv(ctx, comm, searchQuery, logger)
+	default:
+		downloadsList, downloadErr = contentlist.DownloadContentList(ctx, contentListUri, serverToken, comm.Retry, comm.RequestTimeout, logger)
+	}
+
+	if downloadErr != nil {
+		finishJob(job, notifier, jobs.JobFailed, nil, downloadErr)
+		logger.Error("Could not download content list", "contentList", contentListUri, "error", downloadErr)
+		os.Exit(1)
+	}
+	downloadsList, expandErr := bundle.ExpandCollections(ctx, comm, downloadsList, logger)
+	if expandErr != nil {
+		finishJob(job, notifier, jobs.JobFailed, nil, expandErr)
+		logger.Error("Could not expand collections", "error", expandErr)
+		os.Exit(1)
+	}
+	job.SetItems(downloadsList)
+
+	//an output file of "-" streams the bundle to stdout. Log messages go to stderr so they don't get mixed in
+	streaming := outputFile == "-"
+	resume := os.Getenv("resume") != "false" && !streaming
+
+	var writer bundle.ArchiveWriter
+	var initErr error
+	if streaming {
+		writer, initErr = bundle.OpenArchiveStream(outputFormat, os.Stdout, contentListUri)
+	} else {
+		writer, initErr = bundle.OpenArchive(outputFormat, outputFile, contentListUri, resume, logger)
+	}
+
+	if initErr != nil {
+		finishJob(job, notifier, jobs.JobFailed, nil, initErr)
+		logger.Error("Could not initialise output writer", "error", initErr)
+		os.Exit(1)
+	}
+
+	result, bundleErr := bundle.BuildBundle(ctx, comm, contentListUri, downloadsList, writer, config)
+	tracker.Stop()
 
-		if addErr != nil {
-			log.Printf("Could not add stream to zip: %s", addErr.Error())
-			success = false
-			break
+	if bundleErr != nil {
+		logger.Error("Could not create bundle", "error", bundleErr)
+		if resume {
+			writer.Abort()
+			logger.Info("Completed entries are kept so the bundle can be resumed", "journal", bundle.JournalPath(outputFile))
+		} else {
+			writer.Discard()
 		}
+		if errors.Is(bundleErr, bundle.ErrCancelled) {
+			finishJob(job, notifier, jobs.JobCancelled, result, nil)
+		} else {
+			finishJob(job, notifier, jobs.JobFailed, result, bundleErr)
+		}
+		os.Exit(2)
 	}
 
 	closeErr := writer.Close()
 	if closeErr != nil {
-		log.Printf("Could not close zip writer: %s", closeErr.Error())
+		logger.Error("Could not close archive writer", "error", closeErr)
+		finishJob(job, notifier, jobs.JobFailed, result, closeErr)
+		os.Exit(2)
 	}
+	if result.Partial() {
+		writeFailureReport(result.Skipped, logger)
+		finishJob(job, notifier, jobs.JobPartial, result, nil)
+		logger.Warn("Bundle is missing some items", "skipped", len(result.Skipped))
+		os.Exit(3)
+	}
+	finishJob(job, notifier, jobs.JobCompleted, result, nil)
 
-	if success == false {
-		log.Printf("Could not create file")
-		os.Remove(outputFile)
-		os.Exit(2)
+	if streaming {
+		logger.Info("Bundle written to stdout")
 	} else {
-		log.Printf("Output file completed at %s", outputFile)
-		os.Exit(0)
+		logger.Info("Output file completed", "output", outputFile)
 	}
+	os.Exit(0)
 }
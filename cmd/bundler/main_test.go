@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestRetrySettingsAgree(t *testing.T) {
+	t.Setenv("read_retries", "3")
+	t.Setenv("item_retries", "3")
+	t.Setenv("http_retries", "3")
+
+	pipeline := pipelineConfigFromEnv()
+	policy := retryPolicyFromEnv()
+	if pipeline.ReadRetry.MaxAttempts != 4 || pipeline.ItemAttempts != 4 || policy.MaxAttempts != 4 {
+		t.Errorf("Expected 3 retries to mean 4 attempts everywhere, got read %d, item %d, http %d",
+			pipeline.ReadRetry.MaxAttempts, pipeline.ItemAttempts, policy.MaxAttempts)
+	}
+}
+
+func TestRetryDefaultsUnchanged(t *testing.T) {
+	pipeline := pipelineConfigFromEnv()
+	if pipeline.ReadRetry.MaxAttempts != 5 || pipeline.ItemAttempts != 1 {
+		t.Errorf("Expected the default attempts to be kept, got read %d, item %d", pipeline.ReadRetry.MaxAttempts, pipeline.ItemAttempts)
+	}
+}
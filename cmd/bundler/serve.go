@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"github.com/guardian/deliverable_bundler/bundle"
+	"github.com/guardian/deliverable_bundler/contentlist"
+	"github.com/guardian/deliverable_bundler/jobs"
+	"github.com/guardian/deliverable_bundler/metrics"
+	"github.com/guardian/deliverable_bundler/vidispine"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+/**
+bundleServer streams bundles straight back as the HTTP response, so a web front-end can offer a
+"download bundle" link without the bundle ever being written to disk
+*/
+type bundleServer struct {
+	comm              *vidispine.VidispineCommunicator
+	config            *bundle.BundleConfig
+	format            bundle.ArchiveFormat
+	serverToken       string
+	apiToken          string        //callers of /bundle and /jobs have to send this as a bearer token
+	contentListPrefix string        //only content lists under this URI can be bundled
+	jobs              *jobs.Manager //nil if the job API is not enabled
+}
+
+func contentTypeFor(format bundle.ArchiveFormat) string {
+	switch format {
+	case bundle.FormatTar:
+		return "application/x-tar"
+	case bundle.FormatTarGzip:
+		return "application/gzip"
+	case bundle.FormatTarZstd:
+		return "application/zstd"
+	default:
+		return "application/zip"
+	}
+}
+
+/**
+serve until `ctx` is cancelled. Requests in progress are cancelled along with it, and nil is returned once the
+server has shut down
+*/
+func (s *bundleServer) ListenAndServe(ctx context.Context, address string) error {
+	//content lists are fetched with the server token, so don't start without something limiting where they can come from
+	if _, prefixErr := parseContentListPrefix(s.contentListPrefix); prefixErr != nil {
+		return prefixErr
+	}
+	if s.apiToken == "" {
+		return errors.New("api_token must be set, so that only known callers can ask for bundles")
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/bundle", s.requireToken(s.handleBundle))
+	mux.Handle("/metrics", metrics.Handler())
+	if s.jobs != nil {
+		mux.HandleFunc("/jobs", s.requireToken(s.handleJobs))
+		mux.HandleFunc("/jobs/", s.requireToken(s.handleJob))
+	}
+	server := &http.Server{
+		Addr:        address,
+		Handler:     mux,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	shutdownDone := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		slog.Info("Shutting down")
+		shutdownDone <- server.Shutdown(context.Background())
+	}()
+
+	slog.Info("Serving bundles", "address", address)
+	serveErr := server.ListenAndServe()
+	if !errors.Is(serveErr, http.ErrServerClosed) {
+		return serveErr
+	}
+	return <-shutdownDone
+}
+
+/**
+only pass on requests that have the API token as a bearer token in their Authorization header
+*/
+func (s *bundleServer) requireToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, isBearer := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if s.apiToken == "" || !isBearer || subtle.ConstantTimeCompare([]byte(token), []byte(s.apiToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "a valid API token is needed", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+/**
+parse the content_list_prefix setting, which has to be an absolute http or https URI. The path always ends with a /,
+so that a prefix of https://host/lists can't match https://host/lists-elsewhere
+*/
+func parseContentListPrefix(prefix string) (*url.URL, error) {
+	if prefix == "" {
+		return nil, errors.New("content_list_prefix must be set, to limit where content lists can be fetched from")
+	}
+	parsed, parseErr := url.Parse(prefix)
+	if parseErr != nil {
+		return nil, fmt.Errorf("could not parse content_list_prefix: %s", parseErr)
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, fmt.Errorf("content_list_prefix '%s' should be an http or https URI with a host", prefix)
+	}
+	if !strings.HasSuffix(parsed.Path, "/") {
+		parsed.Path += "/"
+	}
+	return parsed, nil
+}
+
+/**
+returns true if the content list URI has the same scheme and host as content_list_prefix, and a path within the
+prefix's. Anything that can't be parsed, has user information or steps up with .. is refused
+*/
+func (s *bundleServer) contentListAllowed(contentListUri string) bool {
+	prefix, prefixErr := parseContentListPrefix(s.contentListPrefix)
+	if prefixErr != nil {
+		return false
+	}
+	parsed, parseErr := url.Parse(contentListUri)
+	if parseErr != nil || parsed.User != nil {
+		return false
+	}
+	for _, segment := range strings.Split(parsed.Path, "/") {
+		if segment == ".." {
+			return false
+		}
+	}
+	return strings.EqualFold(parsed.Scheme, prefix.Scheme) &&
+		strings.EqualFold(parsed.Host, prefix.Host) &&
+		strings.HasPrefix(parsed.Path, prefix.Path)
+}
+
+/**
+GET /bundle?content_list=<uri>[&format=zip|tar|tar.gz|tar.zst][&name=<filename>]
+*/
+func (s *bundleServer) handleBundle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	contentListUri := r.URL.Query().Get("content_list")
+	if contentListUri == "" {
+		http.Error(w, "you need to specify content_list", http.StatusBadRequest)
+		return
+	}
+	if !s.contentListAllowed(contentListUri) {
+		http.Error(w, "content list is not allowed", http.StatusForbidden)
+		return
+	}
+
+	format := s.format
+	if formatName := r.URL.Query().Get("format"); formatName != "" {
+		var formatErr error
+		format, formatErr = bundle.ParseArchiveFormat(formatName)
+		if formatErr != nil {
+			http.Error(w, formatErr.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	logger := slog.With("contentList", contentListUri, "remoteAddr", r.RemoteAddr)
+	downloadsList, downloadErr := contentlist.DownloadContentList(r.Context(), contentListUri, s.serverToken, s.comm.Retry, s.comm.RequestTimeout, logger)
+	if downloadErr != nil {
+		logger.Error("Could not download content list", "error", downloadErr)
+		http.Error(w, "could not download content list", http.StatusBadGateway)
+		return
+	}
+	downloadsList, expandErr := bundle.ExpandCollections(r.Context(), s.comm.WithLogger(logger), downloadsList, logger)
+	if expandErr != nil {
+		logger.Error("Could not expand collections", "error", expandErr)
+		http.Error(w, "could not expand collections", http.StatusBadGateway)
+		return
+	}
+
+	filename := path.Base(r.URL.Query().Get("name"))
+	if filename == "." || filename == "/" {
+		filename = "bundle"
+	}
+	if !strings.HasSuffix(filename, "."+format.String()) {
+		filename += "." + format.String()
+	}
+
+	w.Header().Set("Content-Type", contentTypeFor(format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+	writer, initErr := bundle.OpenArchiveStream(format, w, contentListUri)
+	if initErr != nil {
+		logger.Error("Could not initialise output writer", "error", initErr)
+		http.Error(w, "could not start bundle", http.StatusInternalServerError)
+		return
+	}
+
+	config := *s.config
+	config.Logger = logger
+	logger.Info("Streaming bundle")
+	metrics.JobStarted()
+	defer metrics.JobFinished()
+	_, bundleErr := bundle.BuildBundle(r.Context(), s.comm.WithLogger(logger), contentListUri, downloadsList, writer, &config)
+	if bundleErr == nil {
+		bundleErr = writer.Close()
+	}
+	if bundleErr != nil {
+		//the status has already gone out, so the only way to tell the client is to cut the connection off
+		//rather than letting it think a truncated bundle is complete
+		logger.Error("Could not stream bundle", "error", bundleErr)
+		writer.Discard()
+		panic(http.ErrAbortHandler)
+	}
+	logger.Info("Finished streaming bundle")
+}
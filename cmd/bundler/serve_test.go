@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestContentListAllowed(t *testing.T) {
+	server := &bundleServer{contentListPrefix: "https://vs.example/lists"}
+	tests := map[string]bool{
+		"https://vs.example/lists/one.json":              true,
+		"https://VS.example/lists/nested/two.json":       true,
+		"https://vs.example.evil.com/lists/one.json":     false,
+		"https://vs.example/lists-elsewhere/one.json":    false,
+		"https://vs.example/lists/../admin/secrets.json": false,
+		"https://vs.example/lists/%2e%2e/admin.json":     false,
+		"https://user@vs.example/lists/one.json":         false,
+		"http://vs.example/lists/one.json":               false,
+		"/lists/one.json":                                false,
+		"":                                               false,
+	}
+	for uri, expected := range tests {
+		if server.contentListAllowed(uri) != expected {
+			t.Errorf("Expected contentListAllowed(%q) to be %t", uri, expected)
+		}
+	}
+
+	unset := &bundleServer{}
+	if unset.contentListAllowed("https://vs.example/lists/one.json") {
+		t.Error("Expected every content list to be refused when there is no prefix")
+	}
+}
+
+func TestServerRefusesToStartUnconfigured(t *testing.T) {
+	tests := []*bundleServer{
+		{apiToken: "secret"},
+		{apiToken: "secret", contentListPrefix: "vs.example/lists"},
+		{contentListPrefix: "https://vs.example/lists"},
+	}
+	for _, server := range tests {
+		if err := server.ListenAndServe(context.Background(), "127.0.0.1:0"); err == nil {
+			t.Errorf("Expected the server to refuse to start with %+v", server)
+		}
+	}
+}
+
+func TestRequireToken(t *testing.T) {
+	server := &bundleServer{apiToken: "secret"}
+	handler := server.requireToken(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	tests := map[string]int{
+		"":              http.StatusUnauthorized,
+		"secret":        http.StatusUnauthorized,
+		"Bearer wrong":  http.StatusUnauthorized,
+		"Basic secret":  http.StatusUnauthorized,
+		"Bearer secret": http.StatusNoContent,
+	}
+	for header, expected := range tests {
+		request := httptest.NewRequest(http.MethodGet, "/bundle", nil)
+		if header != "" {
+			request.Header.Set("Authorization", header)
+		}
+		recorder := httptest.NewRecorder()
+		handler(recorder, request)
+		if recorder.Code != expected {
+			t.Errorf("Expected Authorization %q to give %d, got %d", header, expected, recorder.Code)
+		}
+	}
+}
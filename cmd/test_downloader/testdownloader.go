@@ -1,14 +1,23 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"github.com/guardian/deliverable_bundler/logging"
+	"github.com/guardian/deliverable_bundler/progress"
 	"github.com/guardian/deliverable_bundler/vidispine"
 	"io/ioutil"
 	"log"
+	"log/slog"
 	"os"
+	"os/signal"
 	"regexp"
+	"syscall"
+	"time"
 )
 
+const blockSize = 40 * 1024 * 1024
+
 func main() {
 	var storageId string
 	var fileId string
@@ -18,6 +27,13 @@ func main() {
 	var port int
 	var user string
 	var passfile string
+	var prefetch int
+	var retries int
+	var retryDelay time.Duration
+	var progressMode string
+	var logFormat string
+	var logLevel string
+	var requestTimeout time.Duration
 
 	flag.StringVar(&storageId, "storage-id", "", "Vidispine storage ID to read from")
 	flag.StringVar(&fileId, "file-id", "", "Vidispine file ID to read")
@@ -27,12 +43,28 @@ func main() {
 	flag.StringVar(&server, "server", "localhost", "Hostname to communicate with Vidispine")
 	flag.StringVar(&user, "user", "admin", "Username to communicate with Vidispine")
 	flag.StringVar(&passfile, "passfile", ".vspass", "file that contains password to authenticate")
+	flag.IntVar(&retries, "retries", vidispine.DefaultReadRetryConfig().MaxAttempts-1, "Number of times to retry reading a chunk after the first attempt fails. 0 disables retries")
+	flag.DurationVar(&retryDelay, "retry-delay", vidispine.DefaultReadRetryConfig().InitialDelay, "Delay before the first retry of a chunk. This doubles with each attempt")
+	flag.IntVar(&prefetch, "prefetch", 0, "Number of range requests to keep in flight ahead of the copy. 0 disables prefetching")
+	flag.StringVar(&progressMode, "progress", "bar", "Progress reporting: bar for a progress bar, json for a JSON report per line, or none")
+	flag.DurationVar(&requestTimeout, "request-timeout", 5*time.Minute, "Limit for each request to Vidispine. 0 means no limit")
+	flag.StringVar(&logFormat, "log-format", "text", "Log format: text or json")
+	flag.StringVar(&logLevel, "log-level", "info", "Minimum level to log: debug, info, warn or error")
 	flag.Parse()
 
+	logger, loggerErr := logging.New(os.Stderr, logFormat, logLevel)
+	if loggerErr != nil {
+		log.Fatal(loggerErr)
+	}
+	slog.SetDefault(logger)
+
 	if storageId == "" || fileId == "" {
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
+	if retries < 0 {
+		log.Fatal("-retries can't be negative, use 0 to disable retries")
+	}
 
 	fileContent, readErr := ioutil.ReadFile(passfile)
 	replacer := regexp.MustCompile("\\s+")
@@ -42,16 +74,20 @@ func main() {
 		log.Fatal("Could not open ", passfile, ": ", readErr)
 	}
 
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
 	comm := vidispine.VidispineCommunicator{
-		Protocol: proto,
-		Hostname: server,
-		Port:     int16(port),
-		User:     user,
-		Password: string(passwdContent),
-		Token:    "",
+		Protocol:       proto,
+		Hostname:       server,
+		Port:           port,
+		User:           user,
+		Password:       string(passwdContent),
+		Token:          "",
+		RequestTimeout: requestTimeout,
 	}
 
-	fileData, vsLookupErr := vidispine.VSFileInfo(&comm, storageId, fileId)
+	fileData, vsLookupErr := vidispine.VSFileInfo(ctx, &comm, storageId, fileId)
 
 	if vsLookupErr != nil {
 		log.Fatal("Could not look up file")
@@ -59,10 +95,32 @@ func main() {
 
 	log.Print("Found file ", fileData.Path, " with size ", fileData.Size, " and hash ", fileData.Hash)
 
-	reader, err := vidispine.NewVSFileReader(&comm, fileData) //default to 2Mb block size
+	reader, err := vidispine.NewPrefetchingVSFileReader(ctx, &comm, fileData, blockSize, prefetch)
 	if err != nil {
 		log.Fatal("Could not set up file reader: ", err.Error())
 	}
+	defer reader.Close()
+
+	retryConfig := vidispine.DefaultReadRetryConfig()
+	retryConfig.MaxAttempts = retries + 1
+	retryConfig.InitialDelay = retryDelay
+	reader.SetRetryConfig(retryConfig)
+
+	var tracker *progress.Tracker
+	switch progressMode {
+	case "bar":
+		tracker = progress.NewTracker(500*time.Millisecond, progress.Bar(os.Stderr))
+	case "json":
+		tracker = progress.NewTracker(time.Second, progress.JSONLines(os.Stdout))
+	case "none":
+	default:
+		log.Fatal("Unknown progress mode ", progressMode)
+	}
+	tracker.AddFiles(1)
+	tracker.FileStarted(storageId, fileId, fileData.Size)
+	reader.SetProgressFunc(func(bytes int) {
+		tracker.FileBytes(storageId, fileId, bytes)
+	})
 
 	fp, openErr := os.Create(output)
 	if openErr != nil {
@@ -72,7 +130,9 @@ func main() {
 	defer fp.Close()
 	log.Print("Copying data into ", output, "....\n")
 
-	_, copyErr := vidispine.BufferedCopy(fp, reader, 40*1024*1024)
+	_, copyErr := vidispine.BufferedCopy(fp, reader, blockSize)
+	tracker.FileDone(storageId, fileId, copyErr)
+	tracker.Stop()
 
 	if copyErr != nil {
 		log.Fatal("Could not copy data: ", copyErr.Error())
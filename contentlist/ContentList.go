@@ -1,19 +1,53 @@
 package contentlist
 
 import (
+	"context"
 	"encoding/json"
-	"errors"
-	"fmt"
+	"github.com/guardian/deliverable_bundler/apierror"
+	"github.com/guardian/deliverable_bundler/logging"
+	"github.com/guardian/deliverable_bundler/metrics"
+	"github.com/guardian/deliverable_bundler/retry"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"time"
 )
 
+/**
+an entry of the content list. This names either a file, by fileId and storageId, an item and one of its shapes, by
+itemId and shape, or a collection, by collectionId and the shape to take from each of its items. The bundler expands
+collections into their items, then looks up which file an item's shape is and fills in fileId and storageId
+*/
 type ContentList struct {
-	FileId    string `json:"fileId"`
-	StorageId string `json:"storageId"`
+	FileId       string `json:"fileId"`
+	StorageId    string `json:"storageId"`
+	ItemId       string `json:"itemId,omitempty"`
+	Shape        string `json:"shape,omitempty"` //shape tag, "original" if not given
+	CollectionId string `json:"collectionId,omitempty"`
+	Folder       string `json:"folder,omitempty"` //directory in the archive to put the file in
+}
+
+/**
+the shape tag used for an item entry that doesn't give one
+*/
+const DefaultShape = "original"
+
+/**
+returns true if the entry names an item whose file has not been looked up yet
+*/
+func (c *ContentList) NeedsResolving() bool {
+	return c.FileId == "" && c.ItemId != ""
+}
+
+/**
+returns the shape tag to look up for an item entry
+*/
+func (c *ContentList) ShapeTag() string {
+	if c.Shape == "" {
+		return DefaultShape
+	}
+	return c.Shape
 }
 
 /**
@@ -26,57 +60,31 @@ func readBody(response *http.Response) ([]byte, error) {
 	return rtn, readErr
 }
 
-func handleResponse(response *http.Response) ([]byte, error) {
-	switch response.StatusCode {
-	case 200:
-		return readBody(response)
-	case 400:
-		body, readErr := readBody(response)
-		if readErr != nil {
-			return nil, readErr
-		} else {
-			bodyString := string(body)
-			errMsg := fmt.Sprintf("API returned bad data: %s", bodyString)
-			return nil, errors.New(errMsg)
-		}
-	case 403:
-		body, readErr := readBody(response)
-		if readErr != nil {
-			return nil, readErr
-		} else {
-			bodyString := string(body)
-			errMsg := fmt.Sprintf("API returned permission denied: %s", bodyString)
-			return nil, errors.New(errMsg)
-		}
-	case 500:
-	case 502:
-	case 503:
-	case 504:
-		body, readErr := readBody(response)
-		if readErr != nil {
-			return nil, readErr
-		} else {
-			bodyString := string(body)
-			errMsg := fmt.Sprintf("API returned not available: %s", bodyString)
-			return nil, errors.New(errMsg)
-		}
-	default:
-		body, readErr := readBody(response)
-		if readErr != nil {
-			return nil, readErr
-		} else {
-			bodyString := string(body)
-			errMsg := fmt.Sprintf("API returned unexpected status %d: %s", response.StatusCode, bodyString)
-			return nil, errors.New(errMsg)
-		}
+/**
+returns the body if the response was successful, otherwise an *apierror.StatusError describing the failure
+*/
+func handleResponse(response *http.Response, policy *retry.Policy) ([]byte, error) {
+	body, readErr := readBody(response)
+	if readErr != nil {
+		return nil, readErr
+	}
+	if response.StatusCode == 200 {
+		return body, nil
+	}
+	return nil, &apierror.StatusError{
+		Method:     response.Request.Method,
+		URL:        response.Request.URL.String(),
+		StatusCode: response.StatusCode,
+		Body:       string(body),
+		Retryable:  policy.RetryableStatus(response.StatusCode),
 	}
-	return nil, errors.New("code bug, should not reach this point")
 }
 
 /**
-get content list data from either a file:// or an http:// URL
+get content list data from either a file:// or an http:// URL. `policy` and `logger` can be nil for the defaults, and
+`timeout` limits each request to download the list, 0 meaning no limit
 */
-func GetContentList(uriString string, token string) ([]ContentList, error) {
+func GetContentList(ctx context.Context, uriString string, token string, policy *retry.Policy, timeout time.Duration, logger *slog.Logger) ([]ContentList, error) {
 	uriData, err := url.Parse(uriString)
 
 	if err != nil {
@@ -86,7 +94,7 @@ func GetContentList(uriString string, token string) ([]ContentList, error) {
 	if uriData.Scheme == "file" {
 		return GetFileContentList(uriData.Path)
 	} else {
-		return DownloadContentList(uriString, token)
+		return DownloadContentList(ctx, uriString, token, policy, timeout, logger)
 	}
 }
 
@@ -101,7 +109,7 @@ func GetFileContentList(path string) ([]ContentList, error) {
 		return nil, readErr
 	}
 
-	parseErr := json.Unmarshal(fileContent, rtn)
+	parseErr := json.Unmarshal(fileContent, &rtn)
 	if parseErr != nil {
 		return nil, parseErr
 	} else {
@@ -110,42 +118,43 @@ func GetFileContentList(path string) ([]ContentList, error) {
 }
 
 /**
-download the given URL and parse it as JSON into an array of ContentList objects. This is automatically called by GetContentList
+download the given URL and parse it as JSON into an array of ContentList objects. Failed requests are retried
+according to `policy`, and each one, including reading the list, is given up after `timeout` unless that is 0.
+This is automatically called by GetContentList
 */
-func DownloadContentList(uri string, token string) ([]ContentList, error) {
-	client := http.Client{}
+func DownloadContentList(ctx context.Context, uri string, token string, policy *retry.Policy, timeout time.Duration, logger *slog.Logger) ([]ContentList, error) {
+	logger = logging.OrDefault(logger).With("contentList", uri)
+	client := http.Client{Timeout: timeout}
 	var contentList []ContentList
-	req, err := http.NewRequest("GET", uri, nil)
 
-	if err != nil {
-		return nil, err
-	}
-
-	req.Header.Set("X-Authentication-Token", token)
-
-	for {
-		response, doErr := client.Do(req)
-		if doErr != nil {
-			return nil, doErr
+	send := func() (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
+		if err != nil {
+			return nil, err
 		}
+		req.Header.Set("X-Authentication-Token", token)
+		return client.Do(req)
+	}
 
-		bodyContent, responseErr := handleResponse(response)
+	policy = retry.OrDefault(policy)
+	response, doErr := policy.Do(ctx, send, func(attempt retry.Attempt) {
+		metrics.Retry(metrics.RetryContentList)
+		logger.Warn("Could not download content list, retrying", "attempt", attempt.Number, "delay", attempt.Delay,
+			"error", attempt.Err)
+	})
+	if doErr != nil {
+		return nil, doErr
+	}
 
-		if responseErr != nil {
-			return nil, responseErr
-		}
+	bodyContent, responseErr := handleResponse(response, policy)
+	if responseErr != nil {
+		return nil, responseErr
+	}
 
-		if response.StatusCode == 502 || response.StatusCode == 503 {
-			log.Printf("Got a server unavailable error, retrying in 3s...")
-			time.Sleep(3 * time.Second)
-		} else {
-			jsonErr := json.Unmarshal(bodyContent, contentList)
-			if jsonErr != nil {
-				log.Printf("Could not understand response from server: %s", jsonErr.Error())
-				return nil, jsonErr
-			} else {
-				return contentList, nil
-			}
-		}
+	jsonErr := json.Unmarshal(bodyContent, &contentList)
+	if jsonErr != nil {
+		logger.Error("Could not understand response from server", "error", jsonErr)
+		return nil, jsonErr
 	}
+	return contentList, nil
 }
@@ -0,0 +1,94 @@
+package contentlist
+
+import (
+	"context"
+	"errors"
+	"github.com/guardian/deliverable_bundler/apierror"
+	"github.com/guardian/deliverable_bundler/retry"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDownloadRetriesUnavailable(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if r.Header.Get("X-Authentication-Token") != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if attempts < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`[{"fileId":"VX-10","storageId":"VX-1"}]`))
+	}))
+	defer server.Close()
+
+	policy := retry.DefaultPolicy()
+	policy.InitialDelay = time.Millisecond
+	list, err := DownloadContentList(context.Background(), server.URL, "secret", policy, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].FileId != "VX-10" || attempts != 3 {
+		t.Errorf("Unexpected result %+v after %d attempts", list, attempts)
+	}
+}
+
+func TestDownloadServerError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("database is down"))
+	}))
+	defer server.Close()
+
+	policy := retry.DefaultPolicy()
+	policy.MaxAttempts = 1
+	_, err := DownloadContentList(context.Background(), server.URL, "secret", policy, 0, nil)
+	if err == nil || !strings.Contains(err.Error(), "not available: database is down") {
+		t.Errorf("Expected a not available error with the body, got %v", err)
+	}
+}
+
+func TestDownloadPermissionDenied(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	_, err := DownloadContentList(context.Background(), server.URL, "wrong", nil, 0, nil)
+	var statusErr *apierror.StatusError
+	if !errors.Is(err, apierror.ErrPermissionDenied) || !errors.As(err, &statusErr) || statusErr.Retryable {
+		t.Errorf("Expected a permanent permission denied error, got %v", err)
+	}
+}
+
+func TestDownloadTimesOut(t *testing.T) {
+	//the server sends its headers, then stalls before the body
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	policy := retry.DefaultPolicy()
+	policy.MaxAttempts = 1
+	done := make(chan error)
+	go func() {
+		_, err := DownloadContentList(context.Background(), server.URL, "secret", policy, 50*time.Millisecond, nil)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Expected a stalled download to fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the download to give up once the timeout had passed")
+	}
+}
@@ -0,0 +1,358 @@
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/guardian/deliverable_bundler/bundle"
+	"github.com/guardian/deliverable_bundler/contentlist"
+	"github.com/guardian/deliverable_bundler/logging"
+	"github.com/guardian/deliverable_bundler/metrics"
+	"github.com/guardian/deliverable_bundler/progress"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+type JobStatus string
+
+const (
+	JobQueued    JobStatus = "queued"
+	JobRunning   JobStatus = "running"
+	JobCompleted JobStatus = "completed"
+	JobPartial   JobStatus = "partial" //completed, but some items were skipped under the failure policy
+	JobFailed    JobStatus = "failed"
+	JobCancelled JobStatus = "cancelled"
+)
+
+/**
+returns true once the job has stopped, one way or another
+*/
+func (s JobStatus) Finished() bool {
+	return s == JobCompleted || s == JobPartial || s == JobFailed || s == JobCancelled
+}
+
+type FileStatus string
+
+const (
+	FilePending FileStatus = "pending"
+	FileDone    FileStatus = "done"
+	FileFailed  FileStatus = "failed"
+	FileSkipped FileStatus = "skipped"
+)
+
+/**
+FileProgress is the state of one item of the content list within a job
+*/
+type FileProgress struct {
+	StorageId string     `json:"storageId"`
+	FileId    string     `json:"fileId"`
+	ItemId    string     `json:"itemId,omitempty"` //for an entry that names an item and shape. The file is filled in once it is found
+	Shape     string     `json:"shape,omitempty"`
+	Name      string     `json:"name,omitempty"` //name of the entry in the archive, once it has been added
+	Size      int64      `json:"size,omitempty"`
+	Status    FileStatus `json:"status"`
+	Error     string     `json:"error,omitempty"`
+}
+
+/**
+JobRequest is what a client sends to start a bundle job
+*/
+type JobRequest struct {
+	ContentList string `json:"contentList"`
+	Output      string `json:"output"`           //output file name, relative to the server's output directory
+	Format      string `json:"format,omitempty"` //zip, tar, tar.gz or tar.zst. Empty uses the server default
+}
+
+const (
+	SourceCLI    = "cli"
+	SourceServer = "server"
+)
+
+/**
+Job is a single bundle run. All access to a running job goes through its methods, since the worker updates it
+while clients are reading it. If the job has a store, every change is saved to it
+*/
+type Job struct {
+	Id          string           `json:"id"`
+	Source      string           `json:"source"` //where the job was started from, SourceCLI or SourceServer
+	ContentList string           `json:"contentList"`
+	Output      string           `json:"output"`
+	Format      string           `json:"format"`
+	Status      JobStatus        `json:"status"`
+	Error       string           `json:"error,omitempty"`
+	Submitted   time.Time        `json:"submitted"`
+	Started     *time.Time       `json:"started,omitempty"`
+	Finished    *time.Time       `json:"finished,omitempty"`
+	Bytes       int64            `json:"bytes"` //total size of the files added to the archive so far
+	Files       []FileProgress   `json:"files"`
+	Progress    *progress.Report `json:"progress,omitempty"` //the latest download progress, while the job is running
+
+	mutex     sync.Mutex
+	saveMutex sync.Mutex //makes sure snapshots reach the store in the order they were taken
+	lastSaved time.Time  //when the job was last written to its store. Guarded by saveMutex
+	cancel    chan struct{}
+	store     *Store
+	tracker   *progress.Tracker //set if the job made its own progress tracker, so it can stop it
+	logger    *slog.Logger
+}
+
+/**
+how often the progress of each item is written to the store. Changes of status are always written straight away
+*/
+const itemSaveInterval = 5 * time.Second
+
+func newJobId() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+/**
+create a new queued job. `store` can be nil if the job doesn't need to be kept
+*/
+func NewJob(source string, contentList string, output string, format string, store *Store) *Job {
+	j := &Job{
+		Id:          newJobId(),
+		Source:      source,
+		ContentList: contentList,
+		Output:      output,
+		Format:      format,
+		Status:      JobQueued,
+		Submitted:   time.Now(),
+		Files:       []FileProgress{},
+		cancel:      make(chan struct{}),
+		store:       store,
+	}
+	j.logger = logging.ForJob(nil, j.Id)
+	j.save()
+	return j
+}
+
+/**
+write the current state of the job to its store, if it has one. A job that can't be saved carries on regardless,
+since losing its history is better than losing the bundle
+*/
+func (j *Job) save() {
+	if j.store == nil {
+		return
+	}
+	j.saveMutex.Lock()
+	defer j.saveMutex.Unlock()
+
+	saveErr := j.store.Save(j.Snapshot())
+	if saveErr != nil {
+		j.Logger().Warn("Could not save job", "error", saveErr)
+	}
+	j.lastSaved = time.Now()
+}
+
+/**
+save the job if it hasn't been saved for itemSaveInterval. The job is saved whenever its status changes, so
+anything that this leaves out is written when it finishes
+*/
+func (j *Job) saveIfDue() {
+	if j.store == nil {
+		return
+	}
+	j.saveMutex.Lock()
+	due := time.Since(j.lastSaved) >= itemSaveInterval
+	j.saveMutex.Unlock()
+	if due {
+		j.save()
+	}
+}
+
+/**
+returns a logger that tags every line with the job ID
+*/
+func (j *Job) Logger() *slog.Logger {
+	if j.logger == nil {
+		return logging.ForJob(nil, j.Id)
+	}
+	return j.logger
+}
+
+/**
+returns a copy of the job as it is right now, which is safe to read or encode without holding the lock
+*/
+func (j *Job) Snapshot() *Job {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	return &Job{
+		Id:          j.Id,
+		Source:      j.Source,
+		ContentList: j.ContentList,
+		Output:      j.Output,
+		Format:      j.Format,
+		Status:      j.Status,
+		Error:       j.Error,
+		Submitted:   j.Submitted,
+		Started:     j.Started,
+		Finished:    j.Finished,
+		Bytes:       j.Bytes,
+		Files:       append([]FileProgress{}, j.Files...),
+		Progress:    j.Progress,
+	}
+}
+
+/**
+move the job from queued to running. Returns false if it was cancelled while it was in the queue
+*/
+func (j *Job) Start() bool {
+	j.mutex.Lock()
+	if j.Status != JobQueued {
+		j.mutex.Unlock()
+		return false
+	}
+	now := time.Now()
+	j.Status = JobRunning
+	j.Started = &now
+	j.mutex.Unlock()
+	metrics.JobStarted()
+
+	j.save()
+	return true
+}
+
+/**
+set up the per-file progress from the content list, once it has been downloaded
+*/
+func (j *Job) SetItems(items []contentlist.ContentList) {
+	files := make([]FileProgress, len(items))
+	for i, item := range items {
+		files[i] = FileProgress{StorageId: item.StorageId, FileId: item.FileId, ItemId: item.ItemId, Shape: item.Shape, Status: FilePending}
+	}
+
+	j.mutex.Lock()
+	j.Files = files
+	j.mutex.Unlock()
+	j.save()
+}
+
+/**
+record the outcome of one item of the content list. This has the signature of BundleConfig.ItemDone. The store is
+brought up to date every itemSaveInterval rather than for every item
+*/
+func (j *Job) ItemDone(index int, item contentlist.ContentList, entry *bundle.JournalEntry, err error) {
+	j.mutex.Lock()
+	if index < 0 || index >= len(j.Files) {
+		j.mutex.Unlock()
+		return
+	}
+	file := &j.Files[index]
+	file.StorageId = item.StorageId
+	file.FileId = item.FileId
+	if err != nil {
+		file.Status = FileFailed
+		if errors.Is(err, bundle.ErrSkipped) {
+			file.Status = FileSkipped
+		}
+		file.Error = err.Error()
+	} else {
+		file.Status = FileDone
+		if entry != nil {
+			file.Name = entry.Name
+			if entry.File != nil {
+				file.Size = entry.File.Size
+				j.Bytes += entry.File.Size
+			}
+		}
+	}
+	j.mutex.Unlock()
+	j.saveIfDue()
+}
+
+/**
+returns a copy of `base` with the hooks pointed at this job, so that it records progress and can be cancelled
+*/
+func (j *Job) BundleConfig(base *bundle.BundleConfig) *bundle.BundleConfig {
+	config := *base
+	config.Pipeline.Cancel = j.cancel
+	config.ItemDone = j.ItemDone
+	config.Logger = logging.ForJob(base.Logger, j.Id)
+	if config.Pipeline.Progress != nil {
+		config.Pipeline.Progress.AddListener(j.setProgress)
+	} else {
+		j.tracker = progress.NewTracker(time.Second, j.setProgress)
+		config.Pipeline.Progress = j.tracker
+	}
+	return &config
+}
+
+/**
+keep the latest progress report. This is only held in memory, the store gets it along with the next change
+*/
+func (j *Job) setProgress(report *progress.Report) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.Progress = report
+}
+
+/**
+mark the job as finished with the given status, and the error that stopped it if there is one
+*/
+func (j *Job) Finish(status JobStatus, err error) {
+	j.tracker.Stop()
+
+	j.mutex.Lock()
+	wasRunning := j.Status == JobRunning
+	now := time.Now()
+	j.Status = status
+	j.Finished = &now
+	if err != nil {
+		j.Error = err.Error()
+	}
+	j.mutex.Unlock()
+	if wasRunning {
+		metrics.JobFinished()
+	}
+	j.save()
+}
+
+/**
+returns a context derived from `parent` that is cancelled as well once RequestCancel is called, so that everything
+the job does can be stopped through it. The cancel function must be called once the job is done with it
+*/
+func (j *Job) Context(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	go func() {
+		select {
+		case <-j.cancel:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+/**
+ask the job to stop. A queued job is cancelled straight away, a running one stops as soon as the current downloads
+notice. Returns false if the job had already finished
+*/
+func (j *Job) RequestCancel() bool {
+	j.mutex.Lock()
+	if j.Status.Finished() {
+		j.mutex.Unlock()
+		return false
+	}
+	select {
+	case <-j.cancel:
+	default:
+		close(j.cancel)
+	}
+	wasQueued := j.Status == JobQueued
+	if wasQueued {
+		now := time.Now()
+		j.Status = JobCancelled
+		j.Finished = &now
+	}
+	j.mutex.Unlock()
+
+	if wasQueued {
+		j.save()
+	}
+	return true
+}
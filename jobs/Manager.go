@@ -0,0 +1,379 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/guardian/deliverable_bundler/bundle"
+	"github.com/guardian/deliverable_bundler/contentlist"
+	"github.com/guardian/deliverable_bundler/logging"
+	"github.com/guardian/deliverable_bundler/retry"
+	"github.com/guardian/deliverable_bundler/vidispine"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrQueueFull = errors.New("the job queue is full")
+var ErrJobNotFound = errors.New("no such job")
+var ErrJobFinished = errors.New("the job has already finished")
+var ErrOutputInUse = errors.New("another job is already writing to that output")
+
+/**
+ManagerConfig controls how a Manager runs jobs
+*/
+type ManagerConfig struct {
+	Workers     int    //number of jobs that run at the same time. With none, jobs are queued but never run
+	QueueSize   int    //number of jobs that can wait for a worker before submissions are refused
+	History     int    //number of finished jobs to remember
+	OutputDir   string //every job writes its bundle somewhere under here
+	ServerToken string //token for downloading content lists
+	Format      bundle.ArchiveFormat
+	Bundle      *bundle.BundleConfig
+	Store       *Store        //if set, every job is recorded here
+	JobTimeout  time.Duration //jobs that run for longer than this fail. 0 means no limit
+	Retry       *retry.Policy //how content list downloads are retried. nil means retry.DefaultPolicy()
+	//limit for each request to download a content list. 0 means no limit
+	RequestTimeout time.Duration
+	//if set, this is called from a goroutine of its own once a job has finished. `result` is nil if the job
+	//stopped before the bundle was built
+	OnFinished func(job *Job, result *bundle.BundleResult)
+}
+
+/**
+Manager runs bundle jobs from a bounded queue on a fixed number of workers, and keeps track of recent ones
+*/
+type Manager struct {
+	comm    *vidispine.VidispineCommunicator
+	config  ManagerConfig
+	queue   chan *Job
+	mutex   sync.Mutex
+	jobs    map[string]*Job
+	order   []string //job IDs, oldest first
+	ctx     context.Context
+	workers sync.WaitGroup
+}
+
+/**
+create a manager and start its workers. Once `ctx` is cancelled the running jobs are cancelled, no more jobs are
+started, and Wait returns when the workers have tidied up
+*/
+func NewManager(ctx context.Context, comm *vidispine.VidispineCommunicator, config ManagerConfig) *Manager {
+	if config.QueueSize < 1 {
+		config.QueueSize = 1
+	}
+	if config.History < 1 {
+		config.History = 100
+	}
+	if config.Bundle == nil {
+		config.Bundle = bundle.DefaultBundleConfig()
+	}
+
+	m := &Manager{
+		comm:   comm,
+		config: config,
+		queue:  make(chan *Job, config.QueueSize),
+		jobs:   make(map[string]*Job),
+		ctx:    ctx,
+	}
+	if config.Store != nil {
+		m.recoverInterrupted()
+	}
+	for i := 0; i < config.Workers; i++ {
+		m.workers.Add(1)
+		go m.worker()
+	}
+	return m
+}
+
+/**
+any server job that the store still thinks is queued or running was interrupted when the server last stopped
+*/
+func (m *Manager) recoverInterrupted() {
+	for _, status := range []JobStatus{JobQueued, JobRunning} {
+		stale, listErr := m.config.Store.List(JobFilter{Status: status, Source: SourceServer})
+		if listErr != nil {
+			slog.Error("Could not look for interrupted jobs", "error", listErr)
+			return
+		}
+		for _, job := range stale {
+			job.Logger().Warn("Job was interrupted when the server stopped, marking it as failed", "status", job.Status)
+			now := time.Now()
+			job.Status = JobFailed
+			job.Finished = &now
+			job.Error = "interrupted by a server restart"
+			if saveErr := m.config.Store.Save(job); saveErr != nil {
+				job.Logger().Warn("Could not save job", "error", saveErr)
+			}
+		}
+	}
+}
+
+/**
+work out where a job's output goes. The name has to stay inside the output directory
+*/
+func (m *Manager) outputPath(output string) (string, error) {
+	if output == "" {
+		return "", errors.New("you need to specify an output file")
+	}
+	cleaned := filepath.Clean("/" + output)
+	if cleaned == "/" || strings.HasSuffix(output, "/") {
+		return "", fmt.Errorf("output '%s' is not a file name", output)
+	}
+	return filepath.Join(m.config.OutputDir, cleaned), nil
+}
+
+/**
+validate the request and put a new job on the queue. Returns ErrQueueFull if there is no room for it
+*/
+func (m *Manager) Submit(request JobRequest) (*Job, error) {
+	if request.ContentList == "" {
+		return nil, errors.New("you need to specify a content list")
+	}
+	outputPath, outputErr := m.outputPath(request.Output)
+	if outputErr != nil {
+		return nil, outputErr
+	}
+	format := m.config.Format
+	if request.Format != "" {
+		var formatErr error
+		format, formatErr = bundle.ParseArchiveFormat(request.Format)
+		if formatErr != nil {
+			return nil, formatErr
+		}
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, other := range m.jobs {
+		if other.Output == outputPath && !other.Snapshot().Status.Finished() {
+			return nil, ErrOutputInUse
+		}
+	}
+	if len(m.queue) == cap(m.queue) {
+		return nil, ErrQueueFull
+	}
+
+	//only the submitting goroutine adds to the queue and it holds the lock, so there is definitely room
+	job := NewJob(SourceServer, request.ContentList, outputPath, format.String(), m.config.Store)
+	m.queue <- job
+	m.jobs[job.Id] = job
+	m.order = append(m.order, job.Id)
+	m.prune()
+	job.Logger().Info("Queued job", "contentList", job.ContentList)
+	return job.Snapshot(), nil
+}
+
+/**
+forget the oldest finished jobs once there are more than the history limit. Must be called with the lock held
+*/
+func (m *Manager) prune() {
+	excess := len(m.order) - m.config.History
+	if excess <= 0 {
+		return
+	}
+
+	kept := m.order[:0]
+	for _, id := range m.order {
+		if excess > 0 && m.jobs[id].Snapshot().Status.Finished() {
+			delete(m.jobs, id)
+			excess--
+		} else {
+			kept = append(kept, id)
+		}
+	}
+	m.order = kept
+}
+
+/**
+returns the current state of the given job, or nil if there is no such job. Jobs that have dropped out of the
+manager's history are looked up in the store, if there is one
+*/
+func (m *Manager) Get(id string) *Job {
+	m.mutex.Lock()
+	job, found := m.jobs[id]
+	m.mutex.Unlock()
+
+	if found {
+		return job.Snapshot()
+	}
+	if m.config.Store != nil {
+		stored, storeErr := m.config.Store.Get(id)
+		if storeErr == nil {
+			return stored
+		}
+		if storeErr != ErrJobNotFound {
+			slog.Error("Could not look up job", logging.JobKey, id, "error", storeErr)
+		}
+	}
+	return nil
+}
+
+/**
+returns the current state of every job the manager knows about, newest first
+*/
+func (m *Manager) List() []*Job {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	rtn := make([]*Job, 0, len(m.order))
+	for i := len(m.order) - 1; i >= 0; i-- {
+		rtn = append(rtn, m.jobs[m.order[i]].Snapshot())
+	}
+	return rtn
+}
+
+/**
+returns the jobs matching the filter, newest first. With a store this covers every job it has recorded, otherwise
+just the ones in the manager's history
+*/
+func (m *Manager) Query(filter JobFilter) ([]*Job, error) {
+	if m.config.Store != nil {
+		return m.config.Store.List(filter)
+	}
+
+	rtn := []*Job{}
+	for _, job := range m.List() {
+		if filter.Limit > 0 && len(rtn) >= filter.Limit {
+			break
+		}
+		if filter.matches(job) && !job.Submitted.Before(filter.Since) {
+			rtn = append(rtn, job)
+		}
+	}
+	return rtn, nil
+}
+
+/**
+cancel the given job, whether it is still queued or already running
+*/
+func (m *Manager) Cancel(id string) error {
+	m.mutex.Lock()
+	job, found := m.jobs[id]
+	m.mutex.Unlock()
+
+	if !found {
+		return ErrJobNotFound
+	}
+	if !job.RequestCancel() {
+		return ErrJobFinished
+	}
+	job.Logger().Info("Cancelling job")
+	//a queued job is cancelled straight away, and never reaches a worker
+	if job.Snapshot().Status == JobCancelled {
+		m.finished(job, nil)
+	}
+	return nil
+}
+
+func (m *Manager) finished(job *Job, result *bundle.BundleResult) {
+	if m.config.OnFinished != nil {
+		go m.config.OnFinished(job.Snapshot(), result)
+	}
+}
+
+func (m *Manager) worker() {
+	defer m.workers.Done()
+	for {
+		select {
+		case job := <-m.queue:
+			if job.Start() {
+				result := m.run(job)
+				m.finished(job, result)
+			}
+		case <-m.ctx.Done():
+			return
+		}
+	}
+}
+
+/**
+wait for the workers to stop after the manager's context has been cancelled. Jobs still in the queue are left as
+they are, so a store will show them as interrupted next time
+*/
+func (m *Manager) Wait() {
+	m.workers.Wait()
+}
+
+/**
+if `err` is down to the job being cancelled, or the manager shutting down, record the job as cancelled and return true
+*/
+func finishCancelled(ctx context.Context, job *Job, err error) bool {
+	if !errors.Is(err, bundle.ErrCancelled) && !errors.Is(ctx.Err(), context.Canceled) {
+		return false
+	}
+	job.Logger().Info("Job was cancelled")
+	job.Finish(JobCancelled, nil)
+	return true
+}
+
+func (m *Manager) run(job *Job) *bundle.BundleResult {
+	logger := job.Logger()
+	logger.Info("Starting job", "contentList", job.ContentList, "output", job.Output)
+
+	//cancelling the job stops whichever step it is on, not just the downloads
+	ctx, cancel := job.Context(m.ctx)
+	defer cancel()
+	if m.config.JobTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, m.config.JobTimeout)
+		defer cancel()
+	}
+
+	items, downloadErr := contentlist.DownloadContentList(ctx, job.ContentList, m.config.ServerToken, m.config.Retry, m.config.RequestTimeout, logger)
+	if downloadErr != nil {
+		if !finishCancelled(ctx, job, downloadErr) {
+			logger.Error("Could not download content list", "contentList", job.ContentList, "error", downloadErr)
+			job.Finish(JobFailed, fmt.Errorf("could not download content list: %w", downloadErr))
+		}
+		return nil
+	}
+	items, expandErr := bundle.ExpandCollections(ctx, m.comm.WithLogger(logger), items, logger)
+	if expandErr != nil {
+		if !finishCancelled(ctx, job, expandErr) {
+			logger.Error("Could not expand collections", "error", expandErr)
+			job.Finish(JobFailed, expandErr)
+		}
+		return nil
+	}
+	job.SetItems(items)
+
+	format, _ := bundle.ParseArchiveFormat(job.Format)
+	if dirErr := os.MkdirAll(filepath.Dir(job.Output), 0755); dirErr != nil {
+		job.Finish(JobFailed, fmt.Errorf("could not create output directory: %s", dirErr))
+		return nil
+	}
+	writer, openErr := bundle.OpenArchive(format, job.Output, job.ContentList, true, logger)
+	if openErr != nil {
+		job.Finish(JobFailed, fmt.Errorf("could not open output: %s", openErr))
+		return nil
+	}
+
+	result, bundleErr := bundle.BuildBundle(ctx, m.comm.WithLogger(logger), job.ContentList, items, writer, job.BundleConfig(m.config.Bundle))
+	if bundleErr != nil {
+		//keep what has been done so far, so that submitting the same job again carries on from here
+		writer.Abort()
+		if !finishCancelled(ctx, job, bundleErr) {
+			logger.Error("Job failed", "error", bundleErr)
+			job.Finish(JobFailed, bundleErr)
+		}
+		return result
+	}
+
+	closeErr := writer.Close()
+	if closeErr != nil {
+		logger.Error("Could not close archive writer", "error", closeErr)
+		job.Finish(JobFailed, closeErr)
+		return result
+	}
+	if result.Partial() {
+		logger.Warn("Job completed without some items", "output", job.Output, "skipped", len(result.Skipped))
+		job.Finish(JobPartial, nil)
+		return result
+	}
+	logger.Info("Job completed", "output", job.Output)
+	job.Finish(JobCompleted, nil)
+	return result
+}
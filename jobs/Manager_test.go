@@ -0,0 +1,96 @@
+package jobs
+
+import (
+	"context"
+	"github.com/guardian/deliverable_bundler/retry"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQueueAndCancel(t *testing.T) {
+	//no workers, so jobs stay in the queue
+	m := NewManager(context.Background(), nil, ManagerConfig{QueueSize: 1, OutputDir: "/bundles"})
+
+	job, submitErr := m.Submit(JobRequest{ContentList: "file:///list.json", Output: "first.zip"})
+	if submitErr != nil {
+		t.Fatal("Could not submit job: ", submitErr)
+	}
+	if job.Status != JobQueued {
+		t.Errorf("Expected new job to be queued, got %s", job.Status)
+	}
+
+	_, fullErr := m.Submit(JobRequest{ContentList: "file:///list.json", Output: "second.zip"})
+	if fullErr != ErrQueueFull {
+		t.Errorf("Expected ErrQueueFull, got %v", fullErr)
+	}
+
+	if cancelErr := m.Cancel(job.Id); cancelErr != nil {
+		t.Fatal("Could not cancel job: ", cancelErr)
+	}
+	if status := m.Get(job.Id).Status; status != JobCancelled {
+		t.Errorf("Expected cancelled job, got %s", status)
+	}
+	if m.Cancel(job.Id) != ErrJobFinished {
+		t.Error("Expected a second cancel to fail")
+	}
+	if m.Cancel("nonexistent") != ErrJobNotFound {
+		t.Error("Expected cancelling an unknown job to fail")
+	}
+}
+
+func TestCancelWhileDownloadingContentList(t *testing.T) {
+	//the content list server never answers, so the job can only finish by being cancelled
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	m := NewManager(ctx, nil, ManagerConfig{Workers: 1, OutputDir: t.TempDir(), Retry: &retry.Policy{MaxAttempts: 1}})
+
+	job, submitErr := m.Submit(JobRequest{ContentList: server.URL + "/list.json", Output: "bundle.zip"})
+	if submitErr != nil {
+		t.Fatal("Could not submit job: ", submitErr)
+	}
+	for m.Get(job.Id).Status == JobQueued {
+		time.Sleep(time.Millisecond)
+	}
+	if cancelErr := m.Cancel(job.Id); cancelErr != nil {
+		t.Fatal("Could not cancel job: ", cancelErr)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !m.Get(job.Id).Status.Finished() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if status := m.Get(job.Id).Status; status != JobCancelled {
+		t.Errorf("Expected the job to be cancelled while it was downloading its content list, got %s", status)
+	}
+}
+
+func TestOutputPath(t *testing.T) {
+	m := NewManager(context.Background(), nil, ManagerConfig{OutputDir: "/bundles"})
+
+	for output, expected := range map[string]string{
+		"bundle.zip":           "/bundles/bundle.zip",
+		"project/bundle.zip":   "/bundles/project/bundle.zip",
+		"../../etc/bundle.zip": "/bundles/etc/bundle.zip",
+	} {
+		result, pathErr := m.outputPath(output)
+		if pathErr != nil {
+			t.Errorf("Could not get path for %s: %s", output, pathErr)
+		} else if result != filepath.FromSlash(expected) {
+			t.Errorf("Expected %s for %s, got %s", expected, output, result)
+		}
+	}
+
+	for _, output := range []string{"", "/", "project/"} {
+		if _, pathErr := m.outputPath(output); pathErr == nil {
+			t.Errorf("Expected '%s' to be refused", output)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package jobs
+
+import (
+	"encoding/json"
+	bolt "go.etcd.io/bbolt"
+	"time"
+)
+
+var jobsBucket = []byte("jobs")           //job ID -> JSON job record
+var submittedBucket = []byte("submitted") //submitted time + job ID -> job ID, for listing in order
+
+/**
+the format of the keys in the submitted bucket, chosen so that byte order is time order
+*/
+const submittedKeyFormat = "20060102T150405.000000000Z"
+
+/**
+Store keeps the history of bundle jobs in a BoltDB file. The database is opened once and kept open until Close, and
+BoltDB only lets one process write to a file at a time, so another process that opens the same store waits for up
+to Timeout for it to be let go of
+*/
+type Store struct {
+	Path    string
+	Timeout time.Duration //how long to wait for another process to let go of the database
+	db      *bolt.DB
+}
+
+/**
+JobFilter narrows down the jobs returned by Store.List. Empty fields match everything
+*/
+type JobFilter struct {
+	Status      JobStatus
+	Source      string
+	ContentList string
+	Since       time.Time //only jobs submitted at or after this time
+	Limit       int       //maximum number of jobs to return, 0 for no limit
+}
+
+func (f *JobFilter) matches(job *Job) bool {
+	return (f.Status == "" || job.Status == f.Status) &&
+		(f.Source == "" || job.Source == f.Source) &&
+		(f.ContentList == "" || job.ContentList == f.ContentList)
+}
+
+/**
+open the store at the given path, creating it if it doesn't exist yet
+*/
+func OpenStore(path string) (*Store, error) {
+	s := &Store{Path: path, Timeout: 10 * time.Second}
+	db, openErr := bolt.Open(s.Path, 0644, &bolt.Options{Timeout: s.Timeout})
+	if openErr != nil {
+		return nil, openErr
+	}
+	s.db = db
+
+	initErr := s.update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(jobsBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(submittedBucket)
+		return err
+	})
+	if initErr != nil {
+		db.Close()
+		return nil, initErr
+	}
+	return s, nil
+}
+
+/**
+open an existing store for reading only, which several processes can do at the same time as long as none of them
+has it open for writing
+*/
+func OpenStoreReadOnly(path string) (*Store, error) {
+	s := &Store{Path: path, Timeout: 10 * time.Second}
+	db, openErr := bolt.Open(s.Path, 0644, &bolt.Options{Timeout: s.Timeout, ReadOnly: true})
+	if openErr != nil {
+		return nil, openErr
+	}
+	s.db = db
+	return s, nil
+}
+
+/**
+let go of the database, so that other processes can open it
+*/
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+func (s *Store) update(fn func(tx *bolt.Tx) error) error {
+	return s.db.Update(fn)
+}
+
+func (s *Store) view(fn func(tx *bolt.Tx) error) error {
+	return s.db.View(fn)
+}
+
+func submittedKey(job *Job) []byte {
+	return []byte(job.Submitted.UTC().Format(submittedKeyFormat) + "/" + job.Id)
+}
+
+/**
+write a job record, replacing any earlier version of it
+*/
+func (s *Store) Save(job *Job) error {
+	content, marshalErr := json.Marshal(job)
+	if marshalErr != nil {
+		return marshalErr
+	}
+
+	return s.update(func(tx *bolt.Tx) error {
+		putErr := tx.Bucket(jobsBucket).Put([]byte(job.Id), content)
+		if putErr != nil {
+			return putErr
+		}
+		return tx.Bucket(submittedBucket).Put(submittedKey(job), []byte(job.Id))
+	})
+}
+
+/**
+returns the job with the given ID, or ErrJobNotFound
+*/
+func (s *Store) Get(id string) (*Job, error) {
+	var job *Job
+	viewErr := s.view(func(tx *bolt.Tx) error {
+		content := tx.Bucket(jobsBucket).Get([]byte(id))
+		if content == nil {
+			return ErrJobNotFound
+		}
+		job = &Job{}
+		return json.Unmarshal(content, job)
+	})
+	if viewErr != nil {
+		return nil, viewErr
+	}
+	return job, nil
+}
+
+/**
+returns the jobs that match the filter, newest first
+*/
+func (s *Store) List(filter JobFilter) ([]*Job, error) {
+	rtn := []*Job{}
+	viewErr := s.view(func(tx *bolt.Tx) error {
+		jobs := tx.Bucket(jobsBucket)
+		cursor := tx.Bucket(submittedBucket).Cursor()
+		for key, id := cursor.Last(); key != nil; key, id = cursor.Prev() {
+			if filter.Limit > 0 && len(rtn) >= filter.Limit {
+				break
+			}
+
+			job := &Job{}
+			if unmarshalErr := json.Unmarshal(jobs.Get(id), job); unmarshalErr != nil {
+				return unmarshalErr
+			}
+			if !filter.Since.IsZero() && job.Submitted.Before(filter.Since) {
+				break
+			}
+			if filter.matches(job) {
+				rtn = append(rtn, job)
+			}
+		}
+		return nil
+	})
+	if viewErr != nil {
+		return nil, viewErr
+	}
+	return rtn, nil
+}
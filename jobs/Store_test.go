@@ -0,0 +1,81 @@
+package jobs
+
+import (
+	"errors"
+	"github.com/guardian/deliverable_bundler/bundle"
+	"github.com/guardian/deliverable_bundler/contentlist"
+	"github.com/guardian/deliverable_bundler/vidispine"
+	"path"
+	"testing"
+)
+
+func TestStoreRecordsJobs(t *testing.T) {
+	store, openErr := OpenStore(path.Join(t.TempDir(), "jobs.db"))
+	if openErr != nil {
+		t.Fatal("Could not open store: ", openErr)
+	}
+	defer store.Close()
+
+	first := NewJob(SourceCLI, "file:///first.json", "/bundles/first.zip", "zip", store)
+	first.Start()
+	items := []contentlist.ContentList{{StorageId: "VX-1", FileId: "VX-10"}, {StorageId: "VX-1", FileId: "VX-11"}}
+	first.SetItems(items)
+	first.ItemDone(0, items[0], &bundle.JournalEntry{Name: "a.mov", File: &vidispine.VSFileDocument{Size: 1234}}, nil)
+	first.ItemDone(1, items[1], nil, errors.New("could not download"))
+	first.Finish(JobFailed, errors.New("could not download"))
+
+	second := NewJob(SourceServer, "file:///second.json", "/bundles/second.zip", "zip", store)
+
+	stored, getErr := store.Get(first.Id)
+	if getErr != nil {
+		t.Fatal("Could not get job: ", getErr)
+	}
+	if stored.Status != JobFailed || stored.Bytes != 1234 || stored.Files[0].Name != "a.mov" || stored.Files[1].Status != FileFailed {
+		t.Errorf("Stored job does not match: %+v", stored)
+	}
+	if _, missingErr := store.Get("nonexistent"); missingErr != ErrJobNotFound {
+		t.Errorf("Expected ErrJobNotFound, got %v", missingErr)
+	}
+
+	all, listErr := store.List(JobFilter{})
+	if listErr != nil {
+		t.Fatal("Could not list jobs: ", listErr)
+	}
+	if len(all) != 2 || all[0].Id != second.Id || all[1].Id != first.Id {
+		t.Errorf("Expected both jobs, newest first")
+	}
+
+	queued, _ := store.List(JobFilter{Status: JobQueued})
+	if len(queued) != 1 || queued[0].Id != second.Id {
+		t.Errorf("Expected just the queued job")
+	}
+	limited, _ := store.List(JobFilter{Limit: 1})
+	if len(limited) != 1 {
+		t.Errorf("Expected the limit to apply, got %d jobs", len(limited))
+	}
+}
+
+func TestItemSavesThrottled(t *testing.T) {
+	store, openErr := OpenStore(path.Join(t.TempDir(), "jobs.db"))
+	if openErr != nil {
+		t.Fatal("Could not open store: ", openErr)
+	}
+	defer store.Close()
+
+	job := NewJob(SourceCLI, "file:///list.json", "/bundles/bundle.zip", "zip", store)
+	job.Start()
+	items := []contentlist.ContentList{{StorageId: "VX-1", FileId: "VX-10"}}
+	job.SetItems(items)
+	job.ItemDone(0, items[0], &bundle.JournalEntry{Name: "a.mov"}, nil)
+
+	stored, _ := store.Get(job.Id)
+	if stored.Files[0].Status != FilePending {
+		t.Errorf("Expected the item not to be saved straight after the job was, got %s", stored.Files[0].Status)
+	}
+
+	job.Finish(JobCompleted, nil)
+	stored, _ = store.Get(job.Id)
+	if stored.Status != JobCompleted || stored.Files[0].Status != FileDone {
+		t.Errorf("Expected the finished job to have every item saved, got %+v", stored)
+	}
+}
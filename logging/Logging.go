@@ -0,0 +1,72 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+/**
+the names of the fields that tie a log line to a job and to the file it is about, so they can be filtered on in
+log aggregation
+*/
+const (
+	JobKey     = "jobId"
+	StorageKey = "storageId"
+	FileKey    = "fileId"
+)
+
+/**
+build a logger that writes to `w`. `format` is "text" or "json", and `level` is debug, info, warn or error.
+Empty strings give text at info level
+*/
+func New(w io.Writer, format string, level string) (*slog.Logger, error) {
+	var minLevel slog.Level
+	switch strings.ToLower(level) {
+	case "debug":
+		minLevel = slog.LevelDebug
+	case "", "info":
+		minLevel = slog.LevelInfo
+	case "warn", "warning":
+		minLevel = slog.LevelWarn
+	case "error":
+		minLevel = slog.LevelError
+	default:
+		return nil, fmt.Errorf("unknown log level '%s', expected debug, info, warn or error", level)
+	}
+
+	options := &slog.HandlerOptions{Level: minLevel}
+	switch strings.ToLower(format) {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, options)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, options)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format '%s', expected text or json", format)
+	}
+}
+
+/**
+returns `logger`, or the default logger if it is nil
+*/
+func OrDefault(logger *slog.Logger) *slog.Logger {
+	if logger == nil {
+		return slog.Default()
+	}
+	return logger
+}
+
+/**
+returns a logger that adds the job ID to every line
+*/
+func ForJob(logger *slog.Logger, jobId string) *slog.Logger {
+	return OrDefault(logger).With(JobKey, jobId)
+}
+
+/**
+returns a logger that adds the storage and file IDs to every line
+*/
+func ForFile(logger *slog.Logger, storageId string, fileId string) *slog.Logger {
+	return OrDefault(logger).With(StorageKey, storageId, FileKey, fileId)
+}
@@ -0,0 +1,59 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestJsonLoggerFields(t *testing.T) {
+	var out bytes.Buffer
+	logger, newErr := New(&out, "json", "info")
+	if newErr != nil {
+		t.Fatal(newErr)
+	}
+
+	ForFile(ForJob(logger, "abc123"), "VX-1", "VX-10").Warn("Something happened", "attempt", 2)
+
+	var line map[string]interface{}
+	if decodeErr := json.Unmarshal(out.Bytes(), &line); decodeErr != nil {
+		t.Fatalf("Could not decode log line %q: %s", out.String(), decodeErr)
+	}
+	expected := map[string]interface{}{
+		"level":    "WARN",
+		"msg":      "Something happened",
+		JobKey:     "abc123",
+		StorageKey: "VX-1",
+		FileKey:    "VX-10",
+		"attempt":  float64(2),
+	}
+	for k, v := range expected {
+		if line[k] != v {
+			t.Errorf("Expected %s to be %v, got %v", k, v, line[k])
+		}
+	}
+}
+
+func TestLevelFilter(t *testing.T) {
+	var out bytes.Buffer
+	logger, newErr := New(&out, "text", "warn")
+	if newErr != nil {
+		t.Fatal(newErr)
+	}
+
+	logger.Info("not shown")
+	logger.Error("shown")
+	if strings.Contains(out.String(), "not shown") || !strings.Contains(out.String(), "shown") {
+		t.Errorf("Unexpected output: %q", out.String())
+	}
+}
+
+func TestUnknownSettings(t *testing.T) {
+	if _, err := New(&bytes.Buffer{}, "xml", ""); err == nil {
+		t.Error("Expected an error for an unknown format")
+	}
+	if _, err := New(&bytes.Buffer{}, "", "loud"); err == nil {
+		t.Error("Expected an error for an unknown level")
+	}
+}
@@ -2,12 +2,13 @@ package main
 
 import (
 	"archive/zip"
+	"context"
+	"github.com/guardian/deliverable_bundler/bundle"
 	"github.com/guardian/deliverable_bundler/contentlist"
 	"github.com/guardian/deliverable_bundler/vidispine"
 	"io"
 	"log"
 	"os"
-	"path"
 )
 
 func initialiseZip(filename string) (*zip.Writer, error) {
@@ -49,7 +50,7 @@ func main() {
 		log.Fatal("You need to set content_list, server_token and output_file in the environment")
 	}
 
-	downloadsList, downloadErr := contentlist.DownloadContentList(contentListUri, serverToken)
+	downloadsList, downloadErr := contentlist.DownloadContentList(context.Background(), contentListUri, serverToken, nil, 0, nil)
 
 	if downloadErr != nil {
 		log.Fatal("Could not download content list from ", contentListUri)
@@ -63,10 +64,19 @@ func main() {
 
 	comm := vidispine.VidispineCommunicator{}
 
+	namingMode, modeErr := bundle.ParseNamingMode(os.Getenv("naming"))
+	if modeErr != nil {
+		log.Fatal(modeErr)
+	}
+	namer, namerErr := bundle.NewEntryNamer(namingMode, os.Getenv("naming_strip_prefix"), os.Getenv("naming_template"))
+	if namerErr != nil {
+		log.Fatal(namerErr)
+	}
+
 	success := true
 
 	for _, item := range downloadsList {
-		fileData, vsErr := vidispine.VSFileInfo(&comm, item.StorageId, item.FileId)
+		fileData, vsErr := vidispine.VSFileInfo(context.Background(), &comm, item.StorageId, item.FileId)
 
 		if vsErr != nil {
 			log.Printf("Could not open file connection to VS: %s", vsErr.Error())
@@ -74,16 +84,18 @@ func main() {
 			break
 		}
 
-		basename := path.Base(fileData.Path)
+		name := namer.NameFor(fileData)
 
-		reader, readErr := vidispine.NewVSFileReader(&comm, fileData)
+		reader, readErr := vidispine.NewVSFileReader(context.Background(), &comm, fileData)
 		if readErr != nil {
 			log.Printf("Could not read from %s on %s", item.FileId, item.StorageId)
 			success = false
 			break
 		}
 
-		addErr := addToZip(writer, reader, basename, fileData.Size)
+		addErr := addToZip(writer, reader, name, fileData.Size)
+		//closed here rather than deferred, so each reader's prefetch stops before the next file is opened
+		reader.Close()
 
 		if addErr != nil {
 			log.Printf("Could not add stream to zip: %s", addErr.Error())
@@ -0,0 +1,141 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+/**
+the kinds of operation that are counted by bundler_retries_total
+*/
+const (
+	RetryVidispine   = "vidispine_request" //Vidispine said it was unavailable, so the request was sent again
+	RetryChunk       = "chunk"             //a range request failed part way through and was resumed
+	RetryContentList = "content_list"      //the content list server said it was unavailable
+	RetryWebhook     = "webhook"           //a completion webhook could not be delivered
+)
+
+/**
+Registry holds every bundler metric, along with the standard Go runtime and process ones
+*/
+var Registry = prometheus.NewRegistry()
+
+var vidispineRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "bundler",
+	Name:      "vidispine_requests_total",
+	Help:      "Requests made to Vidispine, by method and status code. The code is \"error\" if there was no response",
+}, []string{"method", "code"})
+
+var retries = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "bundler",
+	Name:      "retries_total",
+	Help:      "Operations that were retried, by kind",
+}, []string{"operation"})
+
+var downloadedBytes = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "bundler",
+	Name:      "downloaded_bytes_total",
+	Help:      "Bytes of file content downloaded from Vidispine",
+})
+
+var fileDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Namespace: "bundler",
+	Name:      "file_download_duration_seconds",
+	Help:      "Time taken to download each file, from the first read to the end of the data",
+	Buckets:   prometheus.ExponentialBuckets(0.1, 2, 14), //100ms up to about 14 minutes
+})
+
+var bundleSize = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Namespace: "bundler",
+	Name:      "bundle_size_bytes",
+	Help:      "Total size of the files in each completed bundle",
+	Buckets:   prometheus.ExponentialBuckets(1024*1024, 4, 10), //1MiB up to 256GiB
+})
+
+var checksumFailures = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "bundler",
+	Name:      "checksum_failures_total",
+	Help:      "Files whose content did not match the hash Vidispine has for them",
+})
+
+var activeJobs = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: "bundler",
+	Name:      "active_jobs",
+	Help:      "Bundle jobs that are running right now",
+})
+
+func init() {
+	Registry.MustRegister(
+		vidispineRequests,
+		retries,
+		downloadedBytes,
+		fileDuration,
+		bundleSize,
+		checksumFailures,
+		activeJobs,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+/**
+count a request to Vidispine. `status` is the HTTP status code, or 0 if no response came back
+*/
+func VidispineRequest(method string, status int) {
+	code := "error"
+	if status > 0 {
+		code = strconv.Itoa(status)
+	}
+	vidispineRequests.WithLabelValues(method, code).Inc()
+}
+
+/**
+count a retry of the given kind of operation, one of the Retry constants
+*/
+func Retry(operation string) {
+	retries.WithLabelValues(operation).Inc()
+}
+
+func BytesDownloaded(bytes int) {
+	downloadedBytes.Add(float64(bytes))
+}
+
+func FileDownloaded(duration time.Duration) {
+	fileDuration.Observe(duration.Seconds())
+}
+
+func BundleCompleted(bytes int64) {
+	bundleSize.Observe(float64(bytes))
+}
+
+func ChecksumFailure() {
+	checksumFailures.Inc()
+}
+
+func JobStarted() {
+	activeJobs.Inc()
+}
+
+func JobFinished() {
+	activeJobs.Dec()
+}
+
+/**
+returns a handler that serves the metrics in the Prometheus exposition format, for mounting on /metrics
+*/
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+/**
+write the current metrics to `path` for the node exporter's textfile collector. The file is written under a
+temporary name and then renamed, so the collector never sees half of it. The name must end in .prom for the
+collector to pick it up
+*/
+func WriteTextfile(path string) error {
+	return prometheus.WriteToTextfile(path, Registry)
+}
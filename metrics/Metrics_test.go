@@ -0,0 +1,56 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteTextfile(t *testing.T) {
+	VidispineRequest("GET", 206)
+	VidispineRequest("GET", 0)
+	Retry(RetryChunk)
+	BytesDownloaded(1024)
+	FileDownloaded(2 * time.Second)
+	ChecksumFailure()
+
+	path := filepath.Join(t.TempDir(), "bundler.prom")
+	if writeErr := WriteTextfile(path); writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	content, readErr := ioutil.ReadFile(path)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+
+	for _, expected := range []string{
+		`bundler_vidispine_requests_total{code="206",method="GET"}`,
+		`bundler_vidispine_requests_total{code="error",method="GET"}`,
+		`bundler_retries_total{operation="chunk"}`,
+		`bundler_downloaded_bytes_total`,
+		`bundler_file_download_duration_seconds_count`,
+		`bundler_checksum_failures_total`,
+		`bundler_active_jobs`,
+	} {
+		if !strings.Contains(string(content), expected) {
+			t.Errorf("Expected %s in the textfile", expected)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	JobStarted()
+	defer JobFinished()
+
+	response := httptest.NewRecorder()
+	Handler().ServeHTTP(response, httptest.NewRequest("GET", "/metrics", nil))
+	if response.Code != 200 {
+		t.Fatalf("Expected 200, got %d", response.Code)
+	}
+	if !strings.Contains(response.Body.String(), "bundler_active_jobs 1") {
+		t.Errorf("Expected one active job in:\n%s", response.Body.String())
+	}
+}
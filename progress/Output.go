@@ -0,0 +1,81 @@
+package progress
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const barWidth = 30
+
+/**
+format a number of bytes with a binary unit, like "1.5 GiB"
+*/
+func FormatBytes(bytes float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	unit := 0
+	for bytes >= 1024 && unit < len(units)-1 {
+		bytes /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%.0f %s", bytes, units[unit])
+	}
+	return fmt.Sprintf("%.1f %s", bytes, units[unit])
+}
+
+func formatEta(seconds float64) string {
+	if seconds < 0 {
+		return "--"
+	}
+	return (time.Duration(seconds) * time.Second).String()
+}
+
+/**
+returns a listener that draws a single-line progress bar on a terminal, redrawing it in place on every report
+*/
+func Bar(w io.Writer) Listener {
+	lastLength := 0
+	return func(report *Report) {
+		fraction := 0.0
+		if report.BytesTotal > 0 {
+			fraction = float64(report.BytesDone) / float64(report.BytesTotal)
+		}
+		if fraction > 1 {
+			fraction = 1
+		}
+		filled := int(fraction * barWidth)
+
+		line := fmt.Sprintf("[%s%s] %5.1f%% %s / %s  %s/s  ETA %s  %d/%d files",
+			strings.Repeat("=", filled), strings.Repeat(" ", barWidth-filled), fraction*100,
+			FormatBytes(float64(report.BytesDone)), FormatBytes(float64(report.BytesTotal)),
+			FormatBytes(report.BytesPerSecond), formatEta(report.EtaSeconds), report.FilesDone, report.FilesTotal)
+		if report.FilesFailed > 0 {
+			line += fmt.Sprintf(" (%d failed)", report.FilesFailed)
+		}
+
+		//pad with spaces to rub out the end of a longer previous line
+		padding := ""
+		if len(line) < lastLength {
+			padding = strings.Repeat(" ", lastLength-len(line))
+		}
+		lastLength = len(line)
+
+		fmt.Fprintf(w, "\r%s%s", line, padding)
+		if report.Final {
+			fmt.Fprintln(w)
+		}
+	}
+}
+
+/**
+returns a listener that writes every report to `w` as a single line of JSON, for other tools to follow
+*/
+func JSONLines(w io.Writer) Listener {
+	encoder := json.NewEncoder(w)
+	return func(report *Report) {
+		encoder.Encode(report)
+	}
+}
@@ -0,0 +1,325 @@
+package progress
+
+import (
+	"sync"
+	"time"
+)
+
+/**
+FileReport is the progress of a single file that is being downloaded
+*/
+type FileReport struct {
+	StorageId      string  `json:"storageId"`
+	FileId         string  `json:"fileId"`
+	Size           int64   `json:"size"`
+	BytesDone      int64   `json:"bytesDone"`
+	BytesPerSecond float64 `json:"bytesPerSecond"`
+	EtaSeconds     float64 `json:"etaSeconds"` //-1 if it can't be worked out yet
+}
+
+/**
+Report is the progress of a whole bundle at a point in time
+*/
+type Report struct {
+	Time           time.Time    `json:"time"`
+	Final          bool         `json:"final"` //set on the last report, once the tracker has been stopped
+	FilesTotal     int          `json:"filesTotal"`
+	FilesDone      int          `json:"filesDone"`
+	FilesFailed    int          `json:"filesFailed"`
+	BytesTotal     int64        `json:"bytesTotal"` //estimated from the average file size until every file has been looked up
+	BytesDone      int64        `json:"bytesDone"`
+	BytesPerSecond float64      `json:"bytesPerSecond"`
+	ElapsedSeconds float64      `json:"elapsedSeconds"`
+	EtaSeconds     float64      `json:"etaSeconds"` //-1 if it can't be worked out yet
+	Files          []FileReport `json:"files"`      //the files that are downloading right now
+}
+
+/**
+a Listener is given a report every time the tracker's interval comes round, and a final one when it is stopped.
+Listeners are always called from the same goroutine, one at a time
+*/
+type Listener func(report *Report)
+
+type fileState struct {
+	storageId string
+	fileId    string
+	size      int64
+	done      int64
+	started   time.Time
+}
+
+/**
+the weight given to the latest sample in the moving average of the throughput
+*/
+const rateSmoothing = 0.3
+
+/**
+Tracker adds up the progress of the files in a bundle and reports it to its listeners at a regular interval.
+All of its methods are safe to call from several goroutines, and on a nil Tracker, where they do nothing
+*/
+type Tracker struct {
+	mutex       sync.Mutex
+	listeners   []Listener
+	started     time.Time
+	filesTotal  int
+	filesDone   int
+	filesFailed int
+	knownFiles  int   //number of files whose size is known
+	knownBytes  int64 //total size of those files
+	bytesDone   int64
+	active      map[string]*fileState
+	order       []string //keys of the active files, in the order they started
+
+	rate       float64
+	lastSample time.Time
+	lastBytes  int64
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	finished chan struct{}
+}
+
+/**
+create a tracker that reports to the given listeners every `interval`
+*/
+func NewTracker(interval time.Duration, listeners ...Listener) *Tracker {
+	now := time.Now()
+	t := &Tracker{
+		listeners:  listeners,
+		started:    now,
+		lastSample: now,
+		active:     make(map[string]*fileState),
+		stop:       make(chan struct{}),
+		finished:   make(chan struct{}),
+	}
+	if interval <= 0 {
+		interval = time.Second
+	}
+	go t.run(interval)
+	return t
+}
+
+func (t *Tracker) run(interval time.Duration) {
+	defer close(t.finished)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			t.notify(t.sample(true, false))
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+/**
+add another listener. It gets the next report that goes out
+*/
+func (t *Tracker) AddListener(listener Listener) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.listeners = append(t.listeners, listener)
+}
+
+func (t *Tracker) notify(report *Report) {
+	t.mutex.Lock()
+	listeners := append([]Listener{}, t.listeners...)
+	t.mutex.Unlock()
+
+	for _, listener := range listeners {
+		listener(report)
+	}
+}
+
+func fileKey(storageId string, fileId string) string {
+	return storageId + "/" + fileId
+}
+
+/**
+expect another `count` files in the bundle
+*/
+func (t *Tracker) AddFiles(count int) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.filesTotal += count
+}
+
+/**
+a file has been looked up and is about to be downloaded. If it was already started, this is another attempt at it,
+so the bytes that the earlier attempt downloaded are taken off again and its size is only counted once
+*/
+func (t *Tracker) FileStarted(storageId string, fileId string, size int64) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	key := fileKey(storageId, fileId)
+	if previous, found := t.active[key]; found {
+		t.bytesDone -= previous.done
+		t.lastBytes -= previous.done
+		if t.lastBytes < 0 {
+			t.lastBytes = 0
+		}
+		if previous.size > 0 {
+			t.knownFiles--
+			t.knownBytes -= previous.size
+		}
+	} else {
+		t.order = append(t.order, key)
+	}
+	t.active[key] = &fileState{storageId: storageId, fileId: fileId, size: size, started: time.Now()}
+	if size > 0 {
+		t.knownFiles++
+		t.knownBytes += size
+	}
+}
+
+/**
+another `count` bytes of the file have been downloaded
+*/
+func (t *Tracker) FileBytes(storageId string, fileId string, count int) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if file, found := t.active[fileKey(storageId, fileId)]; found {
+		file.done += int64(count)
+	}
+	t.bytesDone += int64(count)
+}
+
+/**
+the file has finished downloading, or has failed if `err` is set
+*/
+func (t *Tracker) FileDone(storageId string, fileId string, err error) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	key := fileKey(storageId, fileId)
+	if _, found := t.active[key]; found {
+		delete(t.active, key)
+		for i, activeKey := range t.order {
+			if activeKey == key {
+				t.order = append(t.order[:i], t.order[i+1:]...)
+				break
+			}
+		}
+	}
+	if err != nil {
+		t.filesFailed++
+	} else {
+		t.filesDone++
+	}
+}
+
+func eta(remaining int64, rate float64) float64 {
+	if rate <= 0 {
+		return -1
+	}
+	if remaining <= 0 {
+		return 0
+	}
+	return float64(remaining) / rate
+}
+
+/**
+build a report, updating the moving average of the throughput if `updateRate` is set
+*/
+func (t *Tracker) sample(updateRate bool, final bool) *Report {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := time.Now()
+	if elapsed := now.Sub(t.lastSample).Seconds(); elapsed > 0 && updateRate {
+		current := float64(t.bytesDone-t.lastBytes) / elapsed
+		if t.lastBytes == 0 && t.rate == 0 {
+			t.rate = current
+		} else {
+			t.rate = rateSmoothing*current + (1-rateSmoothing)*t.rate
+		}
+		t.lastSample = now
+		t.lastBytes = t.bytesDone
+	}
+
+	bytesTotal := t.knownBytes
+	if t.knownFiles > 0 && t.filesTotal > t.knownFiles {
+		bytesTotal += int64(t.filesTotal-t.knownFiles) * (t.knownBytes / int64(t.knownFiles))
+	}
+
+	report := &Report{
+		Time:           now,
+		Final:          final,
+		FilesTotal:     t.filesTotal,
+		FilesDone:      t.filesDone,
+		FilesFailed:    t.filesFailed,
+		BytesTotal:     bytesTotal,
+		BytesDone:      t.bytesDone,
+		BytesPerSecond: t.rate,
+		ElapsedSeconds: now.Sub(t.started).Seconds(),
+		EtaSeconds:     eta(bytesTotal-t.bytesDone, t.rate),
+		Files:          make([]FileReport, 0, len(t.order)),
+	}
+	if final {
+		//the moving average is meaningless once everything has stopped, so give the overall figure instead
+		if report.ElapsedSeconds > 0 {
+			report.BytesPerSecond = float64(t.bytesDone) / report.ElapsedSeconds
+		}
+		report.EtaSeconds = 0
+	}
+
+	for _, key := range t.order {
+		file := t.active[key]
+		fileRate := 0.0
+		if elapsed := now.Sub(file.started).Seconds(); elapsed > 0 {
+			fileRate = float64(file.done) / elapsed
+		}
+		report.Files = append(report.Files, FileReport{
+			StorageId:      file.storageId,
+			FileId:         file.fileId,
+			Size:           file.size,
+			BytesDone:      file.done,
+			BytesPerSecond: fileRate,
+			EtaSeconds:     eta(file.size-file.done, fileRate),
+		})
+	}
+	return report
+}
+
+/**
+returns the progress right now, without waiting for the next interval
+*/
+func (t *Tracker) Report() *Report {
+	if t == nil {
+		return nil
+	}
+	return t.sample(false, false)
+}
+
+/**
+stop reporting, and send a final report to the listeners. It is safe to call this more than once
+*/
+func (t *Tracker) Stop() {
+	if t == nil {
+		return
+	}
+	t.stopOnce.Do(func() {
+		close(t.stop)
+		<-t.finished
+		t.notify(t.sample(false, true))
+	})
+}
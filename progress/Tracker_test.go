@@ -0,0 +1,92 @@
+package progress
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTrackerTotals(t *testing.T) {
+	var final *Report
+	tracker := NewTracker(time.Hour, func(report *Report) { final = report })
+
+	tracker.AddFiles(4)
+	tracker.FileStarted("VX-1", "VX-10", 1000)
+	tracker.FileStarted("VX-1", "VX-11", 3000)
+	tracker.FileBytes("VX-1", "VX-10", 600)
+	tracker.FileBytes("VX-1", "VX-11", 400)
+
+	report := tracker.Report()
+	if report.BytesDone != 1000 {
+		t.Errorf("Expected 1000 bytes done, got %d", report.BytesDone)
+	}
+	//two files haven't been looked up yet, so they are assumed to be the average size
+	if report.BytesTotal != 8000 {
+		t.Errorf("Expected an estimated total of 8000 bytes, got %d", report.BytesTotal)
+	}
+	if len(report.Files) != 2 || report.Files[0].FileId != "VX-10" || report.Files[0].BytesDone != 600 {
+		t.Errorf("Unexpected file reports: %+v", report.Files)
+	}
+
+	tracker.FileBytes("VX-1", "VX-10", 400)
+	tracker.FileDone("VX-1", "VX-10", nil)
+	tracker.FileDone("VX-1", "VX-11", errors.New("failed"))
+	tracker.Stop()
+
+	if final == nil || !final.Final {
+		t.Fatal("Expected a final report when the tracker was stopped")
+	}
+	if final.FilesDone != 1 || final.FilesFailed != 1 || len(final.Files) != 0 {
+		t.Errorf("Unexpected final report: %+v", final)
+	}
+}
+
+func TestTrackerRetriedFile(t *testing.T) {
+	tracker := NewTracker(time.Hour)
+	defer tracker.Stop()
+
+	tracker.AddFiles(2)
+	tracker.FileStarted("VX-1", "VX-10", 1000)
+	tracker.FileStarted("VX-1", "VX-11", 2000)
+	tracker.FileBytes("VX-1", "VX-10", 700)
+	tracker.FileBytes("VX-1", "VX-11", 100)
+
+	//the first attempt at VX-10 failed part way through, so it starts again from nothing
+	tracker.FileStarted("VX-1", "VX-10", 1000)
+	tracker.FileBytes("VX-1", "VX-10", 200)
+
+	report := tracker.Report()
+	if report.BytesTotal != 3000 {
+		t.Errorf("Expected the retried file to be counted once, for a total of 3000 bytes, got %d", report.BytesTotal)
+	}
+	if report.BytesDone != 300 {
+		t.Errorf("Expected the failed attempt's bytes to be taken off, leaving 300, got %d", report.BytesDone)
+	}
+	if len(report.Files) != 2 || report.Files[0].FileId != "VX-10" || report.Files[0].BytesDone != 200 {
+		t.Errorf("Unexpected file reports: %+v", report.Files)
+	}
+}
+
+func TestNilTracker(t *testing.T) {
+	var tracker *Tracker
+	tracker.AddFiles(1)
+	tracker.FileStarted("VX-1", "VX-10", 100)
+	tracker.FileBytes("VX-1", "VX-10", 100)
+	tracker.FileDone("VX-1", "VX-10", nil)
+	tracker.Stop()
+	if tracker.Report() != nil {
+		t.Error("Expected no report from a nil tracker")
+	}
+}
+
+func TestBar(t *testing.T) {
+	var output bytes.Buffer
+	Bar(&output)(&Report{Final: true, FilesTotal: 2, FilesDone: 1, BytesTotal: 2048, BytesDone: 1024, EtaSeconds: -1})
+
+	line := output.String()
+	if !strings.Contains(line, " 50.0%") || !strings.Contains(line, "1.0 KiB / 2.0 KiB") || !strings.HasSuffix(line, "\n") {
+		t.Errorf("Unexpected progress bar '%s'", line)
+	}
+}
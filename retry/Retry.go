@@ -0,0 +1,186 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+/**
+Policy decides which failed HTTP requests are tried again, and how long to wait in between
+*/
+type Policy struct {
+	MaxAttempts       int           //total number of attempts, including the first. 1 disables retries
+	InitialDelay      time.Duration //delay before the first retry
+	MaxDelay          time.Duration //upper limit for the delay between attempts, including one asked for by Retry-After
+	Multiplier        float64       //each delay is this many times the one before. 1 gives a fixed delay
+	Jitter            float64       //fraction of each delay that is randomised, from 0 for none to 1 for all of it
+	RetryableStatuses []int         //status codes that are worth trying again
+	RetryNetworkError bool          //whether to try again when the server could not be reached or the connection dropped
+	HonourRetryAfter  bool          //wait as long as a Retry-After header asks, up to MaxDelay
+}
+
+/**
+returns the policy used when none is given: five attempts, starting at 3s and doubling up to a minute, for
+connection failures and the statuses a busy or restarting server sends
+*/
+func DefaultPolicy() *Policy {
+	return &Policy{
+		MaxAttempts:       5,
+		InitialDelay:      3 * time.Second,
+		MaxDelay:          time.Minute,
+		Multiplier:        2,
+		Jitter:            0.5,
+		RetryableStatuses: []int{http.StatusTooManyRequests, 500, 502, 503, 504},
+		RetryNetworkError: true,
+		HonourRetryAfter:  true,
+	}
+}
+
+/**
+returns `policy`, or the default policy if it is nil
+*/
+func OrDefault(policy *Policy) *Policy {
+	if policy == nil {
+		return DefaultPolicy()
+	}
+	return policy
+}
+
+/**
+returns the delay before the given retry, where 1 is the first retry
+*/
+func (p *Policy) Delay(attempt int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	delay := float64(p.InitialDelay) * math.Pow(multiplier, float64(attempt-1))
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+	if delay <= 0 {
+		return 0
+	}
+
+	jitter := math.Min(math.Max(p.Jitter, 0), 1)
+	fixed := delay * (1 - jitter)
+	return time.Duration(fixed + rand.Float64()*(delay-fixed))
+}
+
+func (p *Policy) RetryableStatus(status int) bool {
+	for _, retryable := range p.RetryableStatuses {
+		if status == retryable {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+returns true if the request failed in a way that might go away if it is tried again. A cancelled context never does
+*/
+func (p *Policy) RetryableError(err error) bool {
+	if !p.RetryNetworkError || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+/**
+returns how long the response's Retry-After header asks to wait for, if it has one. Both the number of seconds and
+the HTTP date forms are understood
+*/
+func RetryAfter(response *http.Response) (time.Duration, bool) {
+	value := response.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, parseErr := strconv.Atoi(value); parseErr == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if when, parseErr := http.ParseTime(value); parseErr == nil {
+		delay := time.Until(when)
+		if delay < 0 {
+			delay = 0
+		}
+		return delay, true
+	}
+	return 0, false
+}
+
+/**
+Attempt describes a failed attempt that is about to be retried, for logging and metrics
+*/
+type Attempt struct {
+	Number int           //the attempt that failed, starting from 1
+	Delay  time.Duration //how long until the next one
+	Err    error         //why it failed
+}
+
+/**
+call `send` until it succeeds, fails in a way that isn't retryable, or runs out of attempts. `send` must build a
+new request each time it is called. If every attempt gets a retryable status, the last response is returned so that
+the caller can report it. `onRetry` can be nil, otherwise it is called before waiting for each retry.
+Waiting stops with the context's error if `ctx` is cancelled
+*/
+func (p *Policy) Do(ctx context.Context, send func() (*http.Response, error), onRetry func(attempt Attempt)) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		response, sendErr := send()
+		lastAttempt := attempt >= p.MaxAttempts
+
+		var delay time.Duration
+		var reason error
+		switch {
+		case sendErr != nil:
+			if lastAttempt || !p.RetryableError(sendErr) {
+				return nil, sendErr
+			}
+			delay = p.Delay(attempt)
+			reason = sendErr
+		case p.RetryableStatus(response.StatusCode) && !lastAttempt:
+			delay = p.Delay(attempt)
+			if requested, hasRetryAfter := RetryAfter(response); hasRetryAfter && p.HonourRetryAfter {
+				delay = requested
+				if p.MaxDelay > 0 && delay > p.MaxDelay {
+					delay = p.MaxDelay
+				}
+			}
+			reason = fmt.Errorf("server returned %s", response.Status)
+			io.Copy(ioutil.Discard, response.Body)
+			response.Body.Close()
+		default:
+			return response, nil
+		}
+
+		if onRetry != nil {
+			onRetry(Attempt{Number: attempt, Delay: delay, Err: reason})
+		}
+		if sleepErr := Sleep(ctx, delay); sleepErr != nil {
+			return nil, sleepErr
+		}
+	}
+}
+
+/**
+wait for the given time, or until the context is done, in which case its error is returned
+*/
+func Sleep(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,200 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func fastPolicy() *Policy {
+	policy := DefaultPolicy()
+	policy.InitialDelay = time.Millisecond
+	policy.MaxDelay = 10 * time.Millisecond
+	return policy
+}
+
+/**
+returns a server that sends the given statuses in turn, then 200 for every request after that
+*/
+func statusServer(t *testing.T, headers map[string]string, statuses ...int) (*httptest.Server, *int32) {
+	var count int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(atomic.AddInt32(&count, 1))
+		if n <= len(statuses) {
+			for k, v := range headers {
+				w.Header().Set(k, v)
+			}
+			w.WriteHeader(statuses[n-1])
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	t.Cleanup(server.Close)
+	return server, &count
+}
+
+func get(url string) func() (*http.Response, error) {
+	return func() (*http.Response, error) {
+		return http.Get(url)
+	}
+}
+
+func TestRetriesUntilSuccess(t *testing.T) {
+	server, count := statusServer(t, nil, 503, 502)
+
+	var retries []Attempt
+	response, err := fastPolicy().Do(context.Background(), get(server.URL), func(attempt Attempt) {
+		retries = append(retries, attempt)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != 200 || *count != 3 {
+		t.Errorf("Expected success on the third attempt, got %d after %d", response.StatusCode, *count)
+	}
+	if len(retries) != 2 || retries[0].Number != 1 || retries[1].Number != 2 {
+		t.Errorf("Unexpected retries: %+v", retries)
+	}
+}
+
+func TestGivesUpWithLastResponse(t *testing.T) {
+	server, count := statusServer(t, nil, 500, 500, 500, 500)
+	policy := fastPolicy()
+	policy.MaxAttempts = 3
+
+	response, err := policy.Do(context.Background(), get(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != 500 || *count != 3 {
+		t.Errorf("Expected the third 500 to be returned, got %d after %d attempts", response.StatusCode, *count)
+	}
+}
+
+func TestNonRetryableStatus(t *testing.T) {
+	server, count := statusServer(t, nil, 404)
+
+	response, err := fastPolicy().Do(context.Background(), get(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != 404 || *count != 1 {
+		t.Errorf("Expected a single 404, got %d after %d attempts", response.StatusCode, *count)
+	}
+}
+
+func TestRetryAfterIsCapped(t *testing.T) {
+	server, _ := statusServer(t, map[string]string{"Retry-After": "120"}, 429)
+
+	var delay time.Duration
+	response, err := fastPolicy().Do(context.Background(), get(server.URL), func(attempt Attempt) {
+		delay = attempt.Delay
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if delay != 10*time.Millisecond {
+		t.Errorf("Expected Retry-After to be capped at the max delay, waited %s", delay)
+	}
+}
+
+func TestRetryAfterParsing(t *testing.T) {
+	for value, expected := range map[string]time.Duration{
+		"30":                            30 * time.Second,
+		"0":                             0,
+		"Wed, 21 Oct 2015 07:28:00 GMT": 0, //in the past
+	} {
+		response := &http.Response{Header: http.Header{"Retry-After": []string{value}}}
+		delay, ok := RetryAfter(response)
+		if !ok || delay != expected {
+			t.Errorf("Expected %q to give %s, got %s (%v)", value, expected, delay, ok)
+		}
+	}
+
+	if _, ok := RetryAfter(&http.Response{Header: http.Header{"Retry-After": []string{"soon"}}}); ok {
+		t.Error("Expected an unparseable Retry-After to be ignored")
+	}
+}
+
+func TestNetworkErrors(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	url := server.URL
+	server.Close()
+
+	attempts := 0
+	policy := fastPolicy()
+	policy.MaxAttempts = 2
+	_, err := policy.Do(context.Background(), func() (*http.Response, error) {
+		attempts++
+		return http.Get(url)
+	}, nil)
+	if err == nil || attempts != 2 {
+		t.Errorf("Expected two attempts to fail, got %d (%v)", attempts, err)
+	}
+
+	policy.RetryNetworkError = false
+	attempts = 0
+	policy.Do(context.Background(), func() (*http.Response, error) {
+		attempts++
+		return http.Get(url)
+	}, nil)
+	if attempts != 1 {
+		t.Errorf("Expected network errors not to be retried, got %d attempts", attempts)
+	}
+}
+
+func TestCancelledWhileWaiting(t *testing.T) {
+	server, _ := statusServer(t, nil, 503, 503, 503)
+	policy := fastPolicy()
+	policy.InitialDelay = time.Hour
+	policy.MaxDelay = time.Hour
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := policy.Do(ctx, get(server.URL), nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the wait to be cut short, got %v", err)
+	}
+}
+
+func TestDelayCurve(t *testing.T) {
+	policy := &Policy{InitialDelay: time.Second, MaxDelay: 5 * time.Second, Multiplier: 2}
+	for attempt, expected := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second} {
+		if delay := policy.Delay(attempt); delay != expected {
+			t.Errorf("Expected retry %d to wait %s, got %s", attempt, expected, delay)
+		}
+	}
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if delay := policy.Delay(1); delay < 500*time.Millisecond || delay > time.Second {
+			t.Fatalf("Jittered delay %s is out of range", delay)
+		}
+	}
+}
+
+func TestSleep(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	started := time.Now()
+	err := Sleep(ctx, time.Hour)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the deadline to stop the sleep, got %v", err)
+	}
+	if time.Since(started) > time.Second {
+		t.Errorf("Sleep was not interrupted")
+	}
+
+	if sleepErr := Sleep(context.Background(), time.Millisecond); sleepErr != nil {
+		t.Errorf("Expected a short sleep to finish, got %s", sleepErr)
+	}
+}
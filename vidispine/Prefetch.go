@@ -0,0 +1,104 @@
+package vidispine
+
+import (
+	"io"
+	"sync"
+)
+
+type prefetchChunk struct {
+	data []byte
+	err  error
+}
+
+/**
+prefetcher keeps a number of range requests running ahead of the reader and hands the results back in order
+*/
+type prefetcher struct {
+	queue    chan chan prefetchChunk
+	current  []byte
+	done     chan struct{}
+	stopOnce sync.Once
+	started  bool
+	reader   *VSFileReader
+	chunk    int
+	err      error
+}
+
+func newPrefetcher(reader *VSFileReader, chunkSize int, depth int) *prefetcher {
+	return &prefetcher{
+		queue:  make(chan chan prefetchChunk, depth),
+		done:   make(chan struct{}),
+		reader: reader,
+		chunk:  chunkSize,
+	}
+}
+
+/**
+starts a request for each chunk of the file in turn. The queue capacity limits how many can run ahead of the consumer
+*/
+func (p *prefetcher) schedule(chunkSize int) {
+	defer close(p.queue)
+	size := p.reader.fileData.Size
+
+	for offset := int64(0); offset < size; offset += int64(chunkSize) {
+		length := chunkSize
+		if offset+int64(length) > size {
+			length = int(size - offset)
+		}
+
+		result := make(chan prefetchChunk, 1)
+		select {
+		case p.queue <- result:
+		case <-p.done:
+			return
+		}
+
+		go func(start int64, length int) {
+			data, err := p.reader.fetchRange(start, length)
+			if err == nil && len(data) != length {
+				err = io.ErrUnexpectedEOF
+			}
+			result <- prefetchChunk{data, err}
+		}(offset, length)
+	}
+}
+
+func (p *prefetcher) Read(buf []byte) (int, error) {
+	if p.err != nil {
+		return 0, p.err
+	}
+
+	//requests only start on the first read, so that the reader can still be configured after it is created
+	if !p.started {
+		p.started = true
+		go p.schedule(p.chunk)
+	}
+
+	if len(p.current) == 0 {
+		result, ok := <-p.queue
+		if !ok {
+			p.reader.logger.Debug("Download completed", "bytes", p.reader.fileData.Size)
+			p.err = io.EOF
+			return 0, io.EOF
+		}
+
+		chunk := <-result
+		if chunk.err != nil {
+			p.err = chunk.err
+			p.stop()
+			return 0, chunk.err
+		}
+		p.current = chunk.data
+	}
+
+	copied := copy(buf, p.current)
+	p.current = p.current[copied:]
+	p.reader.bytesRead += int64(copied)
+	return copied, nil
+}
+
+func (p *prefetcher) stop() {
+	p.stopOnce.Do(func() {
+		close(p.done)
+	})
+}
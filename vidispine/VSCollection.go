@@ -0,0 +1,46 @@
+package vidispine
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+)
+
+/**
+one member of a collection, which is either an item or another collection
+*/
+type VSCollectionContent struct {
+	Id   string `xml:"id"`
+	Type string `xml:"type"` //"item" or "collection"
+}
+
+type VSCollectionDocument struct {
+	Id      string                `xml:"id,attr"`
+	Name    string                `xml:"name"`
+	Content []VSCollectionContent `xml:"content"`
+}
+
+/**
+get the name and members of a collection
+*/
+func VSCollectionInfo(ctx context.Context, communicator *VidispineCommunicator, collectionId string) (*VSCollectionDocument, error) {
+	var collectionData VSCollectionDocument
+	requestUrl := fmt.Sprintf("/API/collection/%s", collectionId)
+	headers := map[string]string{
+		"Accept": "application/xml",
+	}
+	logger := communicator.logger().With("collectionId", collectionId)
+	result, vsErr := communicator.MakeRequest(ctx, "GET", requestUrl, map[string]string{}, map[string]string{}, headers, nil)
+
+	if vsErr != nil {
+		logger.Error("Could not request collection", "error", vsErr)
+		return nil, vsErr
+	}
+
+	parseErr := xml.Unmarshal(result, &collectionData)
+	if parseErr != nil {
+		logger.Error("Could not decode server response", "error", parseErr)
+		return nil, parseErr
+	}
+	return &collectionData, nil
+}
@@ -1,11 +1,17 @@
 package vidispine
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"github.com/guardian/deliverable_bundler/apierror"
+	"github.com/guardian/deliverable_bundler/logging"
+	"github.com/guardian/deliverable_bundler/metrics"
+	"github.com/guardian/deliverable_bundler/retry"
 	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"strings"
@@ -15,10 +21,40 @@ import (
 type VidispineCommunicator struct {
 	Protocol string
 	Hostname string
-	Port     int16
+	Port     int
 	User     string
 	Password string
 	Token    string
+	Logger   *slog.Logger //nil means the default logger
+	//limit for each request, including reading the response body. 0 means no limit, so a server that stops
+	//responding will hold things up until the context is cancelled
+	RequestTimeout time.Duration
+	Retry          *retry.Policy //which failed requests are tried again. nil means retry.DefaultPolicy()
+}
+
+func (comm *VidispineCommunicator) logger() *slog.Logger {
+	return logging.OrDefault(comm.Logger)
+}
+
+/**
+returns a copy of the communicator that logs to `logger`, so that requests made on behalf of a job can be tagged
+with it
+*/
+func (comm *VidispineCommunicator) WithLogger(logger *slog.Logger) *VidispineCommunicator {
+	rtn := *comm
+	rtn.Logger = logger
+	return &rtn
+}
+
+/**
+returns a copy of the communicator that makes each request only once, for callers that retry in their own way
+*/
+func (comm *VidispineCommunicator) WithoutRetries() *VidispineCommunicator {
+	policy := *retry.OrDefault(comm.Retry)
+	policy.MaxAttempts = 1
+	rtn := *comm
+	rtn.Retry = &policy
+	return &rtn
 }
 
 /**
@@ -34,9 +70,12 @@ func readBody(response *http.Response) ([]byte, error) {
 	return rtn, readErr
 }
 
-func handleResponse(response *http.Response) (*http.Response, error) {
+/**
+returns the response if it was successful, otherwise reads the body and returns an *apierror.StatusError
+describing the failure
+*/
+func handleResponse(response *http.Response, policy *retry.Policy) (*http.Response, error) {
 	if response == nil || response.Body == nil {
-		log.Print("Received no response from server")
 		return nil, errors.New("Received no response from server")
 	}
 
@@ -47,47 +86,23 @@ func handleResponse(response *http.Response) (*http.Response, error) {
 		return response, nil
 	case 206: //partial content
 		return response, nil
-	case 400:
-		body, readErr := readBody(response)
-		if readErr != nil {
-			return nil, readErr
-		} else {
-			bodyString := string(body)
-			errMsg := fmt.Sprintf("API returned bad data: %s", bodyString)
-			return nil, errors.New(errMsg)
-		}
-	case 403:
+	default:
 		body, readErr := readBody(response)
 		if readErr != nil {
 			return nil, readErr
-		} else {
-			bodyString := string(body)
-			errMsg := fmt.Sprintf("API returned permission denied: %s", bodyString)
-			return nil, errors.New(errMsg)
 		}
-	case 500:
-	case 502:
-	case 503:
-	case 504:
-		body, readErr := readBody(response)
-		if readErr != nil {
-			return nil, readErr
-		} else {
-			bodyString := string(body)
-			errMsg := fmt.Sprintf("API returned not available: %s", bodyString)
-			return nil, errors.New(errMsg)
+		rtn := &apierror.StatusError{
+			Method:     response.Request.Method,
+			URL:        response.Request.URL.String(),
+			StatusCode: response.StatusCode,
+			Body:       string(body),
+			Retryable:  policy.RetryableStatus(response.StatusCode),
 		}
-	default:
-		body, readErr := readBody(response)
-		if readErr != nil {
-			return nil, readErr
-		} else {
-			bodyString := string(body)
-			errMsg := fmt.Sprintf("API returned unexpected status %d: %s", response.StatusCode, bodyString)
-			return nil, errors.New(errMsg)
+		if doc := ParseErrorDocument(body); doc != nil {
+			rtn.Detail = doc.Summary()
 		}
+		return nil, rtn
 	}
-	return nil, errors.New("code bug, should not reach this point")
 }
 
 /**
@@ -138,10 +153,10 @@ func (comm *VidispineCommunicator) assembleUrl(subpath string, matrixParams map[
 }
 
 /**
-perform a request to the server
+perform a request to the server. The request is abandoned if `ctx` is cancelled or reaches its deadline
 */
-func (comm *VidispineCommunicator) MakeRequest(verb string, subpath string, matrixParams map[string]string, queryParams map[string]string, headers map[string]string, body io.Reader) ([]byte, error) {
-	response, vsErr := comm.MakeRequestRaw(verb, subpath, matrixParams, queryParams, headers, body)
+func (comm *VidispineCommunicator) MakeRequest(ctx context.Context, verb string, subpath string, matrixParams map[string]string, queryParams map[string]string, headers map[string]string, body io.Reader) ([]byte, error) {
+	response, vsErr := comm.MakeRequestRaw(ctx, verb, subpath, matrixParams, queryParams, headers, body)
 	if vsErr != nil {
 		return nil, vsErr
 	}
@@ -155,44 +170,66 @@ func (comm *VidispineCommunicator) MakeRequest(verb string, subpath string, matr
 	}
 }
 
-func (comm *VidispineCommunicator) MakeRequestRaw(verb string, subpath string, matrixParams map[string]string, queryParams map[string]string, headers map[string]string, body io.Reader) (*http.Response, error) {
-	client := &http.Client{}
+/**
+perform a request to the server and return the response without reading it. The body stays tied to `ctx`, so it
+can't be read once that has been cancelled
+*/
+func (comm *VidispineCommunicator) MakeRequestRaw(ctx context.Context, verb string, subpath string, matrixParams map[string]string, queryParams map[string]string, headers map[string]string, body io.Reader) (*http.Response, error) {
+	client := &http.Client{Timeout: comm.RequestTimeout}
 
 	requestUrl := comm.assembleUrl(subpath, matrixParams, queryParams)
 
-	log.Printf("Connecting to %s", requestUrl)
-	req, err := http.NewRequest(verb, requestUrl, body)
-	if err != nil {
-		return nil, err
+	//a retry needs the body again, so keep hold of it
+	var bodyContent []byte
+	if body != nil {
+		var readErr error
+		bodyContent, readErr = ioutil.ReadAll(body)
+		if readErr != nil {
+			return nil, readErr
+		}
 	}
 
-	if comm.Token == "" {
-		req.SetBasicAuth(comm.User, comm.Password)
-	} else {
-		req.Header.Set("Authorization", fmt.Sprintf("token %s", comm.Token))
-	}
+	send := func() (*http.Response, error) {
+		comm.logger().Debug("Connecting to Vidispine", "verb", verb, "url", requestUrl)
+		var requestBody io.Reader
+		if bodyContent != nil {
+			requestBody = bytes.NewReader(bodyContent)
+		}
+		req, err := http.NewRequestWithContext(ctx, verb, requestUrl, requestBody)
+		if err != nil {
+			return nil, err
+		}
 
-	req.Host = comm.Hostname
+		if comm.Token == "" {
+			req.SetBasicAuth(comm.User, comm.Password)
+		} else {
+			req.Header.Set("Authorization", fmt.Sprintf("token %s", comm.Token))
+		}
 
-	for k, v := range headers {
-		req.Header.Set(k, v)
-	}
+		req.Host = comm.Hostname
 
-	for {
-		response, doErr := client.Do(req)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
 
+		response, doErr := client.Do(req)
 		if doErr != nil {
-			log.Print(doErr.Error())
-			return nil, err
+			metrics.VidispineRequest(verb, 0)
+			comm.logger().Debug("Request failed", "url", requestUrl, "error", doErr)
+			return nil, doErr
 		}
+		metrics.VidispineRequest(verb, response.StatusCode)
+		return response, nil
+	}
 
-		rtn, responseErr := handleResponse(response)
-
-		if response.StatusCode == 502 || response.StatusCode == 503 {
-			log.Printf("Got a server unavailable error, retrying in 3s...")
-			time.Sleep(3 * time.Second)
-		} else {
-			return rtn, responseErr
-		}
+	policy := retry.OrDefault(comm.Retry)
+	response, doErr := policy.Do(ctx, send, func(attempt retry.Attempt) {
+		metrics.Retry(metrics.RetryVidispine)
+		comm.logger().Warn("Vidispine request failed, retrying", "url", requestUrl, "attempt", attempt.Number,
+			"delay", attempt.Delay, "error", attempt.Err)
+	})
+	if doErr != nil {
+		return nil, doErr
 	}
+	return handleResponse(response, policy)
 }
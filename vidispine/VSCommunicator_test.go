@@ -0,0 +1,124 @@
+package vidispine
+
+import (
+	"context"
+	"errors"
+	"github.com/guardian/deliverable_bundler/apierror"
+	"github.com/guardian/deliverable_bundler/retry"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCancelledRequest(t *testing.T) {
+	comm := &VidispineCommunicator{Protocol: "http", Hostname: "vidispine.invalid", Port: 8080}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := comm.MakeRequest(ctx, "GET", "/API/storage", nil, nil, nil, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the request to be cancelled, got %v", err)
+	}
+}
+
+func testCommunicator(t *testing.T, handler http.HandlerFunc) *VidispineCommunicator {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	serverUrl, _ := url.Parse(server.URL)
+	port, _ := strconv.Atoi(serverUrl.Port())
+
+	policy := retry.DefaultPolicy()
+	policy.InitialDelay = time.Millisecond
+	return &VidispineCommunicator{Protocol: "http", Hostname: serverUrl.Hostname(), Port: port, Retry: policy}
+}
+
+func TestRequestRetriesUnavailable(t *testing.T) {
+	attempts := 0
+	comm := testCommunicator(t, func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte("<FileDocument/>"))
+	})
+
+	body, err := comm.MakeRequest(context.Background(), "GET", "/API/storage/VX-1/file/VX-10", nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "<FileDocument/>" || attempts != 3 {
+		t.Errorf("Unexpected body %q after %d attempts", body, attempts)
+	}
+}
+
+func TestRequestServerError(t *testing.T) {
+	comm := testCommunicator(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("out of memory"))
+	})
+	comm.Retry.MaxAttempts = 2
+
+	_, err := comm.MakeRequest(context.Background(), "GET", "/API/storage", nil, nil, nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "not available: out of memory") {
+		t.Errorf("Expected a not available error with the body, got %v", err)
+	}
+}
+
+func TestRequestBodyIsResent(t *testing.T) {
+	var bodies []string
+	comm := testCommunicator(t, func(w http.ResponseWriter, r *http.Request) {
+		content, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(content))
+		if len(bodies) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	_, err := comm.MakeRequest(context.Background(), "PUT", "/API/item/VX-1/metadata", nil, nil, nil, strings.NewReader("<MetadataDocument/>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bodies) != 2 || bodies[1] != "<MetadataDocument/>" {
+		t.Errorf("Expected the body on both attempts, got %q", bodies)
+	}
+}
+
+func TestNotFoundError(t *testing.T) {
+	comm := testCommunicator(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`<ErrorDocument xmlns="http://xml.vidispine.com/schema/vidispine"><notFound><type>File</type><id>VX-10</id></notFound></ErrorDocument>`))
+	})
+
+	_, err := VSFileInfo(context.Background(), comm, "VX-1", "VX-10")
+	if !errors.Is(err, apierror.ErrNotFound) {
+		t.Fatalf("Expected a not found error, got %v", err)
+	}
+	var statusErr *apierror.StatusError
+	if !errors.As(err, &statusErr) {
+		t.Fatal("Expected a StatusError")
+	}
+	if statusErr.Detail != "notFound: File VX-10" || statusErr.Retryable || !strings.Contains(statusErr.URL, "/API/storage/VX-1/file/VX-10?") {
+		t.Errorf("Unexpected error details: %+v", statusErr)
+	}
+}
+
+func TestUnavailableIsRetryable(t *testing.T) {
+	comm := testCommunicator(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	comm.Retry.MaxAttempts = 1
+
+	_, err := comm.MakeRequest(context.Background(), "GET", "/API/storage", nil, nil, nil, nil)
+	var statusErr *apierror.StatusError
+	if !errors.Is(err, apierror.ErrUnavailable) || !errors.As(err, &statusErr) || !statusErr.Retryable {
+		t.Errorf("Expected a retryable unavailable error, got %v", err)
+	}
+}
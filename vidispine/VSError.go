@@ -0,0 +1,61 @@
+package vidispine
+
+import (
+	"encoding/xml"
+	"strings"
+)
+
+/**
+VSErrorDocument is the body Vidispine sends back with a failed request. It holds a single element named after the
+kind of error, such as notFound or invalidInput
+*/
+type VSErrorDocument struct {
+	Errors []VSErrorDetail `xml:",any"`
+}
+
+type VSErrorDetail struct {
+	XMLName     xml.Name
+	Type        string `xml:"type"`
+	Id          string `xml:"id"`
+	Context     string `xml:"context"`
+	Value       string `xml:"value"`
+	Explanation string `xml:"explanation"`
+}
+
+/**
+returns a one-line description of the error, like "notFound: File VX-10"
+*/
+func (d *VSErrorDetail) Summary() string {
+	var parts []string
+	for _, part := range []string{d.Type, d.Id, d.Context, d.Value, d.Explanation} {
+		if part = strings.TrimSpace(part); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	if len(parts) == 0 {
+		return d.XMLName.Local
+	}
+	return d.XMLName.Local + ": " + strings.Join(parts, " ")
+}
+
+/**
+parse an error body from Vidispine. Returns nil if it isn't an ErrorDocument
+*/
+func ParseErrorDocument(body []byte) *VSErrorDocument {
+	var doc VSErrorDocument
+	if xml.Unmarshal(body, &doc) != nil || len(doc.Errors) == 0 {
+		return nil
+	}
+	return &doc
+}
+
+/**
+returns a one-line description of every error in the document
+*/
+func (d *VSErrorDocument) Summary() string {
+	summaries := make([]string, len(d.Errors))
+	for i := range d.Errors {
+		summaries[i] = d.Errors[i].Summary()
+	}
+	return strings.Join(summaries, "; ")
+}
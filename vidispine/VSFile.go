@@ -10,4 +10,39 @@ type VSFileDocument struct {
 	RefreshFlag int8              `xml:"refreshFlag"`
 	StorageId   string            `xml:"storage"`
 	Metadata    []GenericMetadata `xml:"metadata>field"`
+	Items       []VSFileItem      `xml:"item"` //the items the file belongs to, if Vidispine was asked to include them
+}
+
+type VSFileItem struct {
+	Id     string        `xml:"id"`
+	Shapes []VSFileShape `xml:"shape"` //the shapes of the item that the file is part of
+}
+
+type VSFileShape struct {
+	Id   string   `xml:"id"`
+	Tags []string `xml:"tag"`
+}
+
+/**
+returns the ID of the item the file belongs to, or an empty string if it isn't known
+*/
+func (f *VSFileDocument) ItemId() string {
+	if len(f.Items) == 0 {
+		return ""
+	}
+	return f.Items[0].Id
+}
+
+/**
+returns the tag of the shape the file belongs to, or an empty string if it isn't known
+*/
+func (f *VSFileDocument) ShapeTag() string {
+	for _, item := range f.Items {
+		for _, shape := range item.Shapes {
+			if len(shape.Tags) > 0 {
+				return shape.Tags[0]
+			}
+		}
+	}
+	return ""
 }
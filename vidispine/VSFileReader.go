@@ -1,52 +1,159 @@
 package vidispine
 
 import (
+	"context"
 	"encoding/xml"
+	"errors"
 	"fmt"
+	"github.com/guardian/deliverable_bundler/apierror"
+	"github.com/guardian/deliverable_bundler/logging"
+	"github.com/guardian/deliverable_bundler/metrics"
+	"github.com/guardian/deliverable_bundler/retry"
 	"io"
-	"io/ioutil"
-	"log"
+	"log/slog"
+	"math/rand"
+	"time"
 )
 
+/**
+controls how a VSFileReader retries a chunk that fails part way through
+*/
+type ReadRetryConfig struct {
+	MaxAttempts  int           //total number of attempts for each chunk, including the first. 1 disables retries
+	InitialDelay time.Duration //delay before the first retry. This doubles on every attempt
+	MaxDelay     time.Duration //upper limit for the delay between attempts
+}
+
+/**
+returns the retry settings used by new readers
+*/
+func DefaultReadRetryConfig() ReadRetryConfig {
+	return ReadRetryConfig{
+		MaxAttempts:  5,
+		InitialDelay: 1 * time.Second,
+		MaxDelay:     30 * time.Second,
+	}
+}
+
+/**
+work out how long to wait before the given retry attempt (counting from 1). This is exponential backoff with
+"equal jitter", i.e. somewhere between half and all of the exponential delay
+*/
+func (c ReadRetryConfig) delayFor(attempt int) time.Duration {
+	delay := c.InitialDelay
+	for i := 1; i < attempt && delay < c.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > c.MaxDelay {
+		delay = c.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
+
 type VSFileReader struct {
 	storageId string
 	fileId    string
 	bytesRead int64
 	fileData  *VSFileDocument
 	comm      *VidispineCommunicator
+	prefetch  *prefetcher
+	retry     ReadRetryConfig
+	progress  func(bytes int)
+	logger    *slog.Logger
+	started   time.Time //when the first Read happened, for the download duration metric
+	finished  bool
+	ctx       context.Context //requests for the file's content are made under this
+	cancel    context.CancelFunc
 }
 
-func VSFileInfo(communicator *VidispineCommunicator, storageId string, fileId string) (*VSFileDocument, error) {
+/**
+look up the given file in Vidispine, along with the item it belongs to
+*/
+func VSFileInfo(ctx context.Context, communicator *VidispineCommunicator, storageId string, fileId string) (*VSFileDocument, error) {
 	var fileData VSFileDocument
 	requestUrl := fmt.Sprintf("/API/storage/%s/file/%s", storageId, fileId)
 	headers := map[string]string{
 		"Accept": "application/xml",
 	}
-	result, vsErr := communicator.MakeRequest("GET", requestUrl, map[string]string{}, map[string]string{}, headers, nil)
+	logger := logging.ForFile(communicator.logger(), storageId, fileId)
+	result, vsErr := communicator.MakeRequest(ctx, "GET", requestUrl, map[string]string{}, map[string]string{"includeItem": "true"}, headers, nil)
 
 	if vsErr != nil {
-		log.Printf("Could not request file information for %s on %s: %s", fileId, storageId, vsErr)
+		logger.Error("Could not request file information", "error", vsErr)
 		return nil, vsErr
 	}
 
 	parseErr := xml.Unmarshal(result, &fileData)
 	if parseErr != nil {
-		log.Print("Could not decode server response: ", vsErr)
-		return nil, vsErr
+		logger.Error("Could not decode server response", "error", parseErr)
+		return nil, parseErr
 	}
 	return &fileData, nil
 }
 
 /**
-create a new VSFileReader for the given storageId and fileId
+create a new VSFileReader for the given storageId and fileId. Reads fail once `ctx` is cancelled or reaches its
+deadline. Call Close() when finished with the reader to release it
 */
-func NewVSFileReader(communicator *VidispineCommunicator, fileData *VSFileDocument) (*VSFileReader, error) {
-	rtn := VSFileReader{fileData.StorageId, fileData.Id, 0, fileData, communicator}
+func NewVSFileReader(ctx context.Context, communicator *VidispineCommunicator, fileData *VSFileDocument) (*VSFileReader, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	rtn := VSFileReader{
+		storageId: fileData.StorageId,
+		fileId:    fileData.Id,
+		fileData:  fileData,
+		comm:      communicator.WithoutRetries(), //fetchRange does the retrying, and can carry on from where a chunk stopped
+		retry:     DefaultReadRetryConfig(),
+		logger:    logging.ForFile(communicator.logger(), fileData.StorageId, fileData.Id),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
 	return &rtn, nil
 }
 
-func (r *VSFileReader) nextBlockSize(cap int) int {
-	potentialSize := int64(cap)
+/**
+change how failed chunks are retried. This must be called before the first Read
+*/
+func (r *VSFileReader) SetRetryConfig(config ReadRetryConfig) {
+	r.retry = config
+}
+
+/**
+set a function to be called with the number of bytes returned by every Read, so the caller can report progress.
+This must be called before the first Read
+*/
+func (r *VSFileReader) SetProgressFunc(progress func(bytes int)) {
+	r.progress = progress
+}
+
+/**
+create a new VSFileReader that keeps up to `depth` range requests of `chunkSize` bytes in flight ahead of the
+consumer. The chunks are handed back in order, so this can be used anywhere a plain VSFileReader is.
+Call Close() when finished with the reader to stop any outstanding requests.
+*/
+func NewPrefetchingVSFileReader(ctx context.Context, communicator *VidispineCommunicator, fileData *VSFileDocument, chunkSize int, depth int) (*VSFileReader, error) {
+	if fileData.Size == -1 {
+		return nil, errors.New("VS reports file size as -1, can't determine size")
+	}
+	if chunkSize < 1 {
+		return nil, errors.New("prefetch chunk size must be greater than zero")
+	}
+
+	rtn, err := NewVSFileReader(ctx, communicator, fileData)
+	if err != nil || depth < 1 {
+		return rtn, err
+	}
+
+	rtn.prefetch = newPrefetcher(rtn, chunkSize, depth)
+	return rtn, nil
+}
+
+func (r *VSFileReader) nextBlockSize(max int) int {
+	potentialSize := int64(max)
 
 	if r.fileData.Size == -1 {
 		panic("VS reports file size as -1, can't determine size!")
@@ -59,47 +166,133 @@ func (r *VSFileReader) nextBlockSize(cap int) int {
 	}
 }
 
-func (r *VSFileReader) Read(p []byte) (int, error) {
-	bytesToRead := r.nextBlockSize(cap(p))
-	if bytesToRead == 0 {
-		log.Printf("Download completed")
-		return 0, io.EOF
-	}
-	log.Printf("Reading %d bytes, total read %d / %d...", bytesToRead, r.bytesRead, r.fileData.Size)
+/**
+fetch the given byte range of the file from the server. If the request fails, or the connection drops part way
+through, the rest of the range is requested again with a backoff between attempts. This is the only retrying done
+for a chunk, as the reader's communicator makes each request once
+*/
+func (r *VSFileReader) fetchRange(start int64, length int) ([]byte, error) {
+	buf := make([]byte, 0, length)
+	attempt := 1
+
+	for {
+		data, fetchErr := r.requestRange(start+int64(len(buf)), length-len(buf))
+		buf = append(buf, data...)
 
-	fmt.Printf("Bytes=%d-%d\n", r.bytesRead, r.bytesRead+int64(bytesToRead)-1)
+		if fetchErr == nil && len(buf) >= length {
+			return buf[:length], nil
+		}
+		if fetchErr == nil {
+			fetchErr = io.ErrUnexpectedEOF
+		}
 
+		if r.ctx.Err() != nil {
+			return nil, r.ctx.Err()
+		}
+		//the server said no, rather than the connection failing, so trying again won't help
+		var statusErr *apierror.StatusError
+		if errors.As(fetchErr, &statusErr) && !statusErr.Retryable {
+			return nil, fetchErr
+		}
+		if attempt >= r.retry.MaxAttempts {
+			return nil, fmt.Errorf("giving up on bytes %d-%d of %s on %s after %d attempts: %w", start, start+int64(length)-1, r.fileId, r.storageId, attempt, fetchErr)
+		}
+
+		delay := r.retry.delayFor(attempt)
+		metrics.Retry(metrics.RetryChunk)
+		r.logger.Warn("Could not read chunk, retrying", "attempt", attempt, "maxAttempts", r.retry.MaxAttempts,
+			"resumeFrom", start+int64(len(buf)), "delay", delay, "error", fetchErr)
+		if sleepErr := retry.Sleep(r.ctx, delay); sleepErr != nil {
+			return nil, sleepErr
+		}
+		attempt++
+	}
+}
+
+/**
+make a single request for the given byte range. If the body is cut off, whatever was received is returned
+along with the error
+*/
+func (r *VSFileReader) requestRange(start int64, length int) ([]byte, error) {
 	headers := map[string]string{
-		"Range": fmt.Sprintf("Bytes=%d-%d", r.bytesRead, r.bytesRead+int64(bytesToRead)-1),
+		"Range": fmt.Sprintf("Bytes=%d-%d", start, start+int64(length)-1),
 	}
 	query := map[string]string{}
 	matrix := map[string]string{}
 
 	urlpath := fmt.Sprintf("/API/storage/%s/file/%s/data", r.storageId, r.fileId)
-	response, vsErr := r.comm.MakeRequestRaw("GET", urlpath, matrix, query, headers, nil)
+	response, vsErr := r.comm.MakeRequestRaw(r.ctx, "GET", urlpath, matrix, query, headers, nil)
 
 	if vsErr != nil {
-		log.Print("Could not get chunk from server: ", vsErr)
-		return 0, vsErr
+		r.logger.Debug("Could not get chunk from server", "start", start, "error", vsErr)
+		return nil, vsErr
 	}
 
-	buf, readErr := ioutil.ReadAll(response.Body)
+	buf, readErr := readBody(response)
+	if readErr != nil {
+		r.logger.Debug("Could not read request body", "start", start, "received", len(buf), "error", readErr)
+		return buf, readErr
+	}
 
 	if len(buf) == 0 {
-		log.Print(response.Header)
-		log.Print(response.Body)
-		log.Print(response.StatusCode)
-		panic("Zero bytes read")
+		r.logger.Debug("Server sent an empty chunk", "start", start, "status", response.StatusCode, "headers", response.Header)
+		return nil, errors.New("zero bytes read")
 	}
-	log.Printf("Dest capacity %d, buffer length %d", cap(p), len(buf))
-	if readErr != nil {
-		log.Print("Could not read request body: ", readErr)
-		return 0, readErr
+	return buf, nil
+}
+
+func (r *VSFileReader) Read(p []byte) (int, error) {
+	if r.started.IsZero() {
+		r.started = time.Now()
+	}
+
+	var copied int
+	var readErr error
+	if r.prefetch != nil {
+		copied, readErr = r.prefetch.Read(p)
 	} else {
-		copy(p, buf)
-		r.bytesRead += int64(bytesToRead)
-		return bytesToRead, nil
+		copied, readErr = r.readDirect(p)
+	}
+
+	if copied > 0 {
+		metrics.BytesDownloaded(copied)
+		if r.progress != nil {
+			r.progress(copied)
+		}
+	}
+	if readErr == io.EOF && !r.finished {
+		r.finished = true
+		metrics.FileDownloaded(time.Since(r.started))
+	}
+	return copied, readErr
+}
+
+func (r *VSFileReader) readDirect(p []byte) (int, error) {
+	bytesToRead := r.nextBlockSize(len(p))
+	if bytesToRead == 0 {
+		r.logger.Debug("Download completed", "bytes", r.bytesRead)
+		return 0, io.EOF
+	}
+
+	buf, fetchErr := r.fetchRange(r.bytesRead, bytesToRead)
+	if fetchErr != nil {
+		return 0, fetchErr
+	}
+
+	copied := copy(p, buf)
+	r.bytesRead += int64(copied)
+	return copied, nil
+}
+
+/**
+stop any outstanding requests, including prefetches
+*/
+func (r *VSFileReader) Close() error {
+	if r.prefetch != nil {
+		r.prefetch.stop()
 	}
+	r.cancel()
+	return nil
 }
 
 func BufferedCopy(dst io.Writer, src io.Reader, bufsize int) (int, error) {
@@ -125,5 +318,6 @@ func BufferedCopy(dst io.Writer, src io.Reader, bufsize int) (int, error) {
 		if writeErr != nil {
 			return totalRead, writeErr
 		}
+		totalRead += countRead
 	}
 }
@@ -0,0 +1,259 @@
+package vidispine
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/guardian/deliverable_bundler/apierror"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/**
+returns `size` bytes of test content that is different at every offset, so that misplaced data shows up
+*/
+func testContent(size int) []byte {
+	rtn := make([]byte, size)
+	for i := range rtn {
+		rtn[i] = byte(i % 251)
+	}
+	return rtn
+}
+
+/**
+returns a handler that serves byte ranges of `content` as /API/storage/VX-1/file/VX-10/data. `intercept` can be nil,
+otherwise it is called with the start and end of each range first and can write its own response by returning true
+*/
+func rangeHandler(content []byte, intercept func(w http.ResponseWriter, start int, end int) bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/API/storage/VX-1/file/VX-10/data" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var start, end int
+		if _, scanErr := fmt.Sscanf(r.Header.Get("Range"), "Bytes=%d-%d", &start, &end); scanErr != nil || start > end || end >= len(content) {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		if intercept != nil && intercept(w, start, end) {
+			return
+		}
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(content[start : end+1])
+	}
+}
+
+func testFileData(size int) *VSFileDocument {
+	return &VSFileDocument{Id: "VX-10", StorageId: "VX-1", Size: int64(size)}
+}
+
+func TestReadRespectsBufferLength(t *testing.T) {
+	content := testContent(1000)
+	comm := testCommunicator(t, rangeHandler(content, nil))
+
+	reader, _ := NewVSFileReader(context.Background(), comm, testFileData(len(content)))
+	defer reader.Close()
+
+	//a slice with spare capacity must only be filled up to its length
+	backing := make([]byte, 300)
+	var received bytes.Buffer
+	for {
+		n, err := reader.Read(backing[:100])
+		if n > 100 {
+			t.Fatalf("Read returned %d bytes into a 100 byte slice", n)
+		}
+		received.Write(backing[:n])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(received.Bytes(), content) {
+		t.Error("Content read back does not match")
+	}
+}
+
+func TestPrefetchKeepsOrder(t *testing.T) {
+	content := testContent(10000)
+	//answer the later chunks first, so that they complete out of order
+	comm := testCommunicator(t, rangeHandler(content, func(w http.ResponseWriter, start int, end int) bool {
+		time.Sleep(time.Duration(10000-start) * time.Microsecond / 10)
+		return false
+	}))
+
+	reader, err := NewPrefetchingVSFileReader(context.Background(), comm, testFileData(len(content)), 512, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	received, readErr := io.ReadAll(reader)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	if !bytes.Equal(received, content) {
+		t.Error("Prefetched content is out of order or incomplete")
+	}
+}
+
+func TestPrefetchStopsOnClose(t *testing.T) {
+	content := testContent(100 * 64)
+	var requests int32
+	release := make(chan struct{})
+	comm := testCommunicator(t, rangeHandler(content, func(w http.ResponseWriter, start int, end int) bool {
+		atomic.AddInt32(&requests, 1)
+		if start == 0 {
+			return false
+		}
+		//hold every chunk after the first until the test is over, so only the reader can give up on them
+		<-release
+		return true
+	}))
+	t.Cleanup(func() { close(release) })
+
+	reader, _ := NewPrefetchingVSFileReader(context.Background(), comm, testFileData(len(content)), 64, 3)
+	buf := make([]byte, 64)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		t.Fatal(err)
+	}
+	closed := time.Now()
+	reader.Close()
+
+	//give the scheduler a moment, in case it wrongly carries on
+	time.Sleep(50 * time.Millisecond)
+	if made := atomic.LoadInt32(&requests); made > 5 {
+		t.Errorf("Expected no more than the queue depth of requests to be made, got %d", made)
+	}
+	if _, err := reader.Read(buf); err == nil {
+		t.Error("Expected a read after Close to fail")
+	}
+	if time.Since(closed) > 2*time.Second {
+		t.Error("Expected outstanding requests to be abandoned when the reader is closed")
+	}
+}
+
+func TestReadResumesCutOffChunk(t *testing.T) {
+	content := testContent(1000)
+	var mutex sync.Mutex
+	var starts []int
+	comm := testCommunicator(t, rangeHandler(content, func(w http.ResponseWriter, start int, end int) bool {
+		mutex.Lock()
+		starts = append(starts, start)
+		first := len(starts) == 1
+		mutex.Unlock()
+		if !first {
+			return false
+		}
+		//promise the whole range but drop the connection after 400 bytes
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", end-start+1))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(content[start : start+400])
+		return true
+	}))
+
+	reader, _ := NewVSFileReader(context.Background(), comm, testFileData(len(content)))
+	reader.SetRetryConfig(ReadRetryConfig{MaxAttempts: 3, InitialDelay: time.Millisecond, MaxDelay: time.Millisecond})
+	defer reader.Close()
+
+	received, readErr := io.ReadAll(reader)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	if !bytes.Equal(received, content) {
+		t.Error("Content read back does not match")
+	}
+	if len(starts) < 2 || starts[0] != 0 || starts[1] != 400 {
+		t.Errorf("Expected the retry to carry on from byte 400, requests started at %v", starts)
+	}
+}
+
+func TestReadGivesUpOnRefusal(t *testing.T) {
+	content := testContent(1000)
+	var requests int32
+	comm := testCommunicator(t, rangeHandler(content, func(w http.ResponseWriter, start int, end int) bool {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusForbidden)
+		return true
+	}))
+
+	reader, _ := NewVSFileReader(context.Background(), comm, testFileData(len(content)))
+	reader.SetRetryConfig(ReadRetryConfig{MaxAttempts: 3, InitialDelay: time.Millisecond, MaxDelay: time.Millisecond})
+	defer reader.Close()
+
+	_, readErr := io.ReadAll(reader)
+	if !errors.Is(readErr, apierror.ErrPermissionDenied) {
+		t.Errorf("Expected a permission denied error, got %v", readErr)
+	}
+	if made := atomic.LoadInt32(&requests); made != 1 {
+		t.Errorf("Expected a refused chunk not to be retried, but %d requests were made", made)
+	}
+}
+
+func TestReadRetriesChunkOnlyOnce(t *testing.T) {
+	content := testContent(1000)
+	var requests int32
+	comm := testCommunicator(t, rangeHandler(content, func(w http.ResponseWriter, start int, end int) bool {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return true
+	}))
+
+	reader, _ := NewVSFileReader(context.Background(), comm, testFileData(len(content)))
+	reader.SetRetryConfig(ReadRetryConfig{MaxAttempts: 3, InitialDelay: time.Millisecond, MaxDelay: time.Millisecond})
+	defer reader.Close()
+
+	_, readErr := io.ReadAll(reader)
+	if !errors.Is(readErr, apierror.ErrUnavailable) {
+		t.Errorf("Expected an unavailable error, got %v", readErr)
+	}
+	//the communicator's own policy would make five attempts for each of these if it were used as well
+	if made := atomic.LoadInt32(&requests); made != 3 {
+		t.Errorf("Expected one request for each of the reader's 3 attempts, got %d", made)
+	}
+}
+
+func TestReadWritesNothingToStdout(t *testing.T) {
+	content := testContent(5000)
+	comm := testCommunicator(t, rangeHandler(content, nil))
+
+	//a bundle can be streamed to stdout, so the reader must not print anything of its own there
+	pipeReader, pipeWriter, pipeErr := os.Pipe()
+	if pipeErr != nil {
+		t.Fatal(pipeErr)
+	}
+	stdout := os.Stdout
+	os.Stdout = pipeWriter
+	captured := make(chan []byte)
+	go func() {
+		output, _ := io.ReadAll(pipeReader)
+		captured <- output
+	}()
+
+	direct, _ := NewVSFileReader(context.Background(), comm, testFileData(len(content)))
+	_, directErr := io.Copy(io.Discard, direct)
+	direct.Close()
+	prefetching, _ := NewPrefetchingVSFileReader(context.Background(), comm, testFileData(len(content)), 1024, 2)
+	_, prefetchErr := io.Copy(io.Discard, prefetching)
+	prefetching.Close()
+
+	os.Stdout = stdout
+	pipeWriter.Close()
+	output := <-captured
+
+	for _, readErr := range []error{directErr, prefetchErr} {
+		if readErr != nil {
+			t.Error(readErr)
+		}
+	}
+	if len(output) > 0 {
+		t.Errorf("Expected nothing on stdout, got %q", output)
+	}
+}
@@ -62,3 +62,33 @@ func TestUnmarshalDoc(t *testing.T) {
 		t.Error("Did not get expected hash")
 	}
 }
+
+func TestFileItem(t *testing.T) {
+	var test VSFileDocument
+	if err := xml.Unmarshal([]byte(`<FileDocument><id>VX-1</id><item><id>VX-123</id></item></FileDocument>`), &test); err != nil {
+		t.Fatal(err)
+	}
+	if test.ItemId() != "VX-123" {
+		t.Errorf("Expected the file to belong to VX-123, got '%s'", test.ItemId())
+	}
+
+	if (&VSFileDocument{}).ItemId() != "" {
+		t.Error("Expected a file with no item to have no item ID")
+	}
+}
+
+func TestFileShape(t *testing.T) {
+	var test VSFileDocument
+	if err := xml.Unmarshal([]byte(`<FileDocument><id>VX-1</id><item><id>VX-123</id><shape><id>VX-456</id><tag>lowres</tag></shape></item></FileDocument>`), &test); err != nil {
+		t.Fatal(err)
+	}
+	if test.ShapeTag() != "lowres" {
+		t.Errorf("Expected the file to belong to the lowres shape, got '%s'", test.ShapeTag())
+	}
+
+	var noShape VSFileDocument
+	xml.Unmarshal([]byte(`<FileDocument><id>VX-1</id><item><id>VX-123</id></item></FileDocument>`), &noShape)
+	if noShape.ShapeTag() != "" {
+		t.Error("Expected a file with no shape to have no shape tag")
+	}
+}
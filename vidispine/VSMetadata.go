@@ -0,0 +1,101 @@
+package vidispine
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"strings"
+)
+
+type VSMetadataValue struct {
+	Value string `xml:",chardata"`
+}
+
+type VSMetadataField struct {
+	Name   string            `xml:"name"`
+	Values []VSMetadataValue `xml:"value"`
+}
+
+/**
+a group of fields, which can contain further groups
+*/
+type VSMetadataGroup struct {
+	Name   string            `xml:"name"`
+	Fields []VSMetadataField `xml:"field"`
+	Groups []VSMetadataGroup `xml:"group"`
+}
+
+/**
+the metadata for part of an item. Metadata for the whole item runs from -INF to +INF
+*/
+type VSMetadataTimespan struct {
+	Start  string            `xml:"start,attr"`
+	End    string            `xml:"end,attr"`
+	Fields []VSMetadataField `xml:"field"`
+	Groups []VSMetadataGroup `xml:"group"`
+}
+
+type VSMetadataItem struct {
+	Id        string               `xml:"id,attr"`
+	Timespans []VSMetadataTimespan `xml:"metadata>timespan"`
+}
+
+type VSMetadataListDocument struct {
+	Items []VSMetadataItem `xml:"item"`
+}
+
+func flattenFields(rtn map[string][]string, fields []VSMetadataField, groups []VSMetadataGroup) {
+	for _, field := range fields {
+		for _, value := range field.Values {
+			rtn[field.Name] = append(rtn[field.Name], value.Value)
+		}
+	}
+	for _, group := range groups {
+		flattenFields(rtn, group.Fields, group.Groups)
+	}
+}
+
+/**
+returns the values of each field that applies to the whole item, including fields within groups, by field name
+*/
+func (d *VSMetadataListDocument) Flatten() map[string][]string {
+	rtn := make(map[string][]string)
+	for _, item := range d.Items {
+		for _, timespan := range item.Timespans {
+			if timespan.Start == "-INF" && timespan.End == "+INF" {
+				flattenFields(rtn, timespan.Fields, timespan.Groups)
+			}
+		}
+	}
+	return rtn
+}
+
+/**
+get the metadata of an item, limited to the given fields if there are any. Returns the document as Vidispine sent
+it as well as parsed
+*/
+func VSItemMetadata(ctx context.Context, communicator *VidispineCommunicator, itemId string, fields []string) ([]byte, *VSMetadataListDocument, error) {
+	var metadataData VSMetadataListDocument
+	requestUrl := fmt.Sprintf("/API/item/%s/metadata", itemId)
+	headers := map[string]string{
+		"Accept": "application/xml",
+	}
+	query := map[string]string{}
+	if len(fields) > 0 {
+		query["field"] = strings.Join(fields, ",")
+	}
+	logger := communicator.logger().With("itemId", itemId)
+	result, vsErr := communicator.MakeRequest(ctx, "GET", requestUrl, map[string]string{}, query, headers, nil)
+
+	if vsErr != nil {
+		logger.Error("Could not request item metadata", "error", vsErr)
+		return nil, nil, vsErr
+	}
+
+	parseErr := xml.Unmarshal(result, &metadataData)
+	if parseErr != nil {
+		logger.Error("Could not decode server response", "error", parseErr)
+		return nil, nil, parseErr
+	}
+	return result, &metadataData, nil
+}
@@ -0,0 +1,145 @@
+package vidispine
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type VSSearchField struct {
+	Name   string   `xml:"name"`
+	Values []string `xml:"value"`
+}
+
+/**
+an item search. Items match if every field has one of its values
+*/
+type VSItemSearchDocument struct {
+	XMLName xml.Name        `xml:"ItemSearchDocument"`
+	Xmlns   string          `xml:"xmlns,attr,omitempty"`
+	Fields  []VSSearchField `xml:"field"`
+}
+
+/**
+one page of search results, along with the total number of matches
+*/
+type VSItemListDocument struct {
+	Hits  int              `xml:"hits"`
+	Items []VSItemDocument `xml:"item"`
+}
+
+/**
+build an item search from a query of the form field=value;field=value. Giving the same field more than once matches
+any of its values
+*/
+func ParseItemSearch(query string) (*VSItemSearchDocument, error) {
+	rtn := &VSItemSearchDocument{Xmlns: "http://xml.vidispine.com/schema/vidispine"}
+	fieldIndex := make(map[string]int)
+	for _, term := range strings.Split(query, ";") {
+		if strings.TrimSpace(term) == "" {
+			continue
+		}
+		name, value, found := strings.Cut(term, "=")
+		name = strings.TrimSpace(name)
+		if !found || name == "" {
+			return nil, fmt.Errorf("search term '%s' should be field=value", term)
+		}
+		if i, seen := fieldIndex[name]; seen {
+			rtn.Fields[i].Values = append(rtn.Fields[i].Values, strings.TrimSpace(value))
+		} else {
+			fieldIndex[name] = len(rtn.Fields)
+			rtn.Fields = append(rtn.Fields, VSSearchField{Name: name, Values: []string{strings.TrimSpace(value)}})
+		}
+	}
+	if len(rtn.Fields) == 0 {
+		return nil, fmt.Errorf("search query '%s' has no terms", query)
+	}
+	return rtn, nil
+}
+
+/**
+run the search and return one page of results, starting from `first` (counting from 1) with up to `number` items
+*/
+func VSSearchItems(ctx context.Context, communicator *VidispineCommunicator, search *VSItemSearchDocument, first int, number int) (*VSItemListDocument, error) {
+	var listData VSItemListDocument
+	body, marshalErr := xml.Marshal(search)
+	if marshalErr != nil {
+		return nil, marshalErr
+	}
+	headers := map[string]string{
+		"Accept":       "application/xml",
+		"Content-Type": "application/xml",
+	}
+	matrix := map[string]string{
+		"first":  strconv.Itoa(first),
+		"number": strconv.Itoa(number),
+	}
+	result, vsErr := communicator.MakeRequest(ctx, "PUT", "/API/item", matrix, map[string]string{}, headers, bytes.NewReader(body))
+	if vsErr != nil {
+		communicator.logger().Error("Could not search for items", "first", first, "error", vsErr)
+		return nil, vsErr
+	}
+
+	parseErr := xml.Unmarshal(result, &listData)
+	if parseErr != nil {
+		communicator.logger().Error("Could not decode server response", "error", parseErr)
+		return nil, parseErr
+	}
+	return &listData, nil
+}
+
+/**
+controls how search results are fetched
+*/
+type SearchConfig struct {
+	PageSize   int //number of items to ask for in each request
+	MaxResults int //stop after this many items. 0 means no limit
+}
+
+func DefaultSearchConfig() SearchConfig {
+	return SearchConfig{
+		PageSize:   100,
+		MaxResults: 0,
+	}
+}
+
+/**
+returns the IDs of every item that matches the search, paging through the results, up to config.MaxResults
+*/
+func SearchItemIds(ctx context.Context, communicator *VidispineCommunicator, search *VSItemSearchDocument, config SearchConfig) ([]string, error) {
+	pageSize := config.PageSize
+	if pageSize <= 0 {
+		pageSize = DefaultSearchConfig().PageSize
+	}
+
+	var rtn []string
+	first := 1
+	for {
+		number := pageSize
+		if config.MaxResults > 0 && config.MaxResults-len(rtn) < number {
+			number = config.MaxResults - len(rtn)
+		}
+		page, searchErr := VSSearchItems(ctx, communicator, search, first, number)
+		if searchErr != nil {
+			return nil, searchErr
+		}
+		for _, item := range page.Items {
+			rtn = append(rtn, item.Id)
+		}
+		communicator.logger().Debug("Got page of search results", "first", first, "items", len(page.Items), "hits", page.Hits)
+
+		if len(page.Items) == 0 || first+len(page.Items) > page.Hits {
+			break
+		}
+		if config.MaxResults > 0 && len(rtn) >= config.MaxResults {
+			communicator.logger().Warn("Search has more results than the limit", "hits", page.Hits, "limit", config.MaxResults)
+			break
+		}
+		//the server can send back fewer items than were asked for, so the next page starts after the last one received
+		first += len(page.Items)
+	}
+	return rtn, nil
+}
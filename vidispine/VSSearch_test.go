@@ -0,0 +1,119 @@
+package vidispine
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseItemSearch(t *testing.T) {
+	search, err := ParseItemSearch("gnm_project_id=KP-123; gnm_type = rushes;gnm_type=master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(search.Fields) != 2 || search.Fields[0].Name != "gnm_project_id" || len(search.Fields[1].Values) != 2 || search.Fields[1].Values[1] != "master" {
+		t.Errorf("Unexpected search: %+v", search.Fields)
+	}
+
+	body, _ := xml.Marshal(search)
+	if !strings.HasPrefix(string(body), `<ItemSearchDocument xmlns="http://xml.vidispine.com/schema/vidispine"><field><name>gnm_project_id</name><value>KP-123</value></field>`) {
+		t.Errorf("Unexpected search document: %s", body)
+	}
+
+	for _, bad := range []string{"", "gnm_project_id", "=value"} {
+		if _, err := ParseItemSearch(bad); err == nil {
+			t.Errorf("Expected '%s' to be rejected", bad)
+		}
+	}
+}
+
+/**
+returns a communicator for a server that has `hits` matching items, VX-1 onwards, and records the pages asked for.
+If `maxNumber` is more than 0 the server sends back no more than that many items in a page, whatever was asked for
+*/
+func searchServer(t *testing.T, hits int, maxNumber int, pages *[]string) *VidispineCommunicator {
+	return testCommunicator(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Method != "PUT" || !strings.Contains(string(body), "<name>gnm_project_id</name>") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var first, number int
+		for _, param := range strings.Split(r.URL.Path, ";")[1:] {
+			name, value, _ := strings.Cut(param, "=")
+			switch name {
+			case "first":
+				first, _ = strconv.Atoi(value)
+			case "number":
+				number, _ = strconv.Atoi(value)
+			}
+		}
+		*pages = append(*pages, fmt.Sprintf("%d+%d", first, number))
+		if maxNumber > 0 && number > maxNumber {
+			number = maxNumber
+		}
+
+		var items strings.Builder
+		for i := first; i < first+number && i <= hits; i++ {
+			fmt.Fprintf(&items, `<item id="VX-%d"/>`, i)
+		}
+		fmt.Fprintf(w, "<ItemListDocument><hits>%d</hits>%s</ItemListDocument>", hits, items.String())
+	})
+}
+
+func TestSearchPaging(t *testing.T) {
+	search, _ := ParseItemSearch("gnm_project_id=KP-123")
+	var pages []string
+	comm := searchServer(t, 25, 0, &pages)
+
+	itemIds, err := SearchItemIds(context.Background(), comm, search, SearchConfig{PageSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(itemIds) != 25 || itemIds[0] != "VX-1" || itemIds[24] != "VX-25" {
+		t.Errorf("Expected all 25 items, got %v", itemIds)
+	}
+	if strings.Join(pages, ",") != "1+10,11+10,21+10" {
+		t.Errorf("Unexpected pages: %v", pages)
+	}
+}
+
+func TestSearchResultCap(t *testing.T) {
+	search, _ := ParseItemSearch("gnm_project_id=KP-123")
+	var pages []string
+	comm := searchServer(t, 100, 0, &pages)
+
+	itemIds, err := SearchItemIds(context.Background(), comm, search, SearchConfig{PageSize: 10, MaxResults: 15})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(itemIds) != 15 || itemIds[14] != "VX-15" {
+		t.Errorf("Expected the first 15 items, got %v", itemIds)
+	}
+	if strings.Join(pages, ",") != "1+10,11+5" {
+		t.Errorf("Unexpected pages: %v", pages)
+	}
+}
+
+func TestSearchShortPages(t *testing.T) {
+	search, _ := ParseItemSearch("gnm_project_id=KP-123")
+	var pages []string
+	//the server caps pages at 4 items, below the page size asked for
+	comm := searchServer(t, 10, 4, &pages)
+
+	itemIds, err := SearchItemIds(context.Background(), comm, search, SearchConfig{PageSize: 6})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(itemIds) != 10 || itemIds[4] != "VX-5" || itemIds[9] != "VX-10" {
+		t.Errorf("Expected all 10 items, got %v", itemIds)
+	}
+	if strings.Join(pages, ",") != "1+6,5+6,9+6" {
+		t.Errorf("Unexpected pages: %v", pages)
+	}
+}
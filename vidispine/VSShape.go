@@ -0,0 +1,192 @@
+package vidispine
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"github.com/guardian/deliverable_bundler/apierror"
+)
+
+/**
+a component of a shape, and the copies of its file on each storage
+*/
+type VSShapeComponent struct {
+	Id    string           `xml:"id"`
+	Files []VSFileDocument `xml:"file"`
+}
+
+type VSShapeDocument struct {
+	Id                 string             `xml:"id"`
+	Tags               []string           `xml:"tag"`
+	ContainerComponent *VSShapeComponent  `xml:"containerComponent"`
+	BinaryComponents   []VSShapeComponent `xml:"binaryComponent"`
+	VideoComponents    []VSShapeComponent `xml:"videoComponent"`
+	AudioComponents    []VSShapeComponent `xml:"audioComponent"`
+}
+
+/**
+returns true if the shape has the given tag
+*/
+func (s *VSShapeDocument) HasTag(tag string) bool {
+	for _, shapeTag := range s.Tags {
+		if shapeTag == tag {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+returns the copies of the shape's media file: the container if there is one, otherwise the first binary, video
+or audio component that has any files
+*/
+func (s *VSShapeDocument) Files() []VSFileDocument {
+	if s.ContainerComponent != nil && len(s.ContainerComponent.Files) > 0 {
+		return s.ContainerComponent.Files
+	}
+	for _, components := range [][]VSShapeComponent{s.BinaryComponents, s.VideoComponents, s.AudioComponents} {
+		for _, component := range components {
+			if len(component.Files) > 0 {
+				return component.Files
+			}
+		}
+	}
+	return nil
+}
+
+/**
+an item, as returned with content=shape
+*/
+type VSItemDocument struct {
+	Id     string            `xml:"id,attr"`
+	Shapes []VSShapeDocument `xml:"shape"`
+}
+
+/**
+get the shapes of the given item that have `tag`
+*/
+func VSItemShapes(ctx context.Context, communicator *VidispineCommunicator, itemId string, tag string) ([]VSShapeDocument, error) {
+	var itemData VSItemDocument
+	requestUrl := fmt.Sprintf("/API/item/%s", itemId)
+	headers := map[string]string{
+		"Accept": "application/xml",
+	}
+	logger := communicator.logger().With("itemId", itemId)
+	result, vsErr := communicator.MakeRequest(ctx, "GET", requestUrl, map[string]string{}, map[string]string{"content": "shape", "tag": tag}, headers, nil)
+
+	if vsErr != nil {
+		logger.Error("Could not request item shapes", "error", vsErr)
+		return nil, vsErr
+	}
+
+	parseErr := xml.Unmarshal(result, &itemData)
+	if parseErr != nil {
+		logger.Error("Could not decode server response", "error", parseErr)
+		return nil, parseErr
+	}
+
+	//older servers ignore the tag parameter and return every shape
+	var rtn []VSShapeDocument
+	for _, shape := range itemData.Shapes {
+		if shape.HasTag(tag) {
+			rtn = append(rtn, shape)
+		}
+	}
+	return rtn, nil
+}
+
+/**
+ShapeResolver finds the file to download for an item and shape tag, picking the best copy when the shape has
+replicas on several storages. Storage states are looked up once and remembered, so use a new resolver for each bundle
+*/
+type ShapeResolver struct {
+	communicator      *VidispineCommunicator
+	preferredStorages []string //storages to take a copy from, best first. Others are used in the order Vidispine lists them
+	storageStates     map[string]string
+}
+
+func NewShapeResolver(communicator *VidispineCommunicator, preferredStorages []string) *ShapeResolver {
+	return &ShapeResolver{
+		communicator:      communicator,
+		preferredStorages: preferredStorages,
+		storageStates:     make(map[string]string),
+	}
+}
+
+/**
+returns the state of the storage, looking it up the first time it is asked for
+*/
+func (r *ShapeResolver) storageState(ctx context.Context, storageId string) (string, error) {
+	if state, known := r.storageStates[storageId]; known {
+		return state, nil
+	}
+	storage, storageErr := VSStorageInfo(ctx, r.communicator, storageId)
+	if storageErr != nil {
+		return "", storageErr
+	}
+	r.storageStates[storageId] = storage.State
+	return storage.State, nil
+}
+
+/**
+ranks a storage by its place in the preferred list, lower is better
+*/
+func (r *ShapeResolver) rank(storageId string) int {
+	for i, preferred := range r.preferredStorages {
+		if preferred == storageId {
+			return i
+		}
+	}
+	return len(r.preferredStorages)
+}
+
+/**
+returns the copy of the item's file with the given shape tag to download: a closed file on an ONLINE storage,
+preferring the storages given to NewShapeResolver. A copy on a storage that can't be looked up is passed over. The
+error matches apierror.ErrNotFound if the item has no such shape or no copy of it can be read, unless a storage
+lookup failed, in which case it is that failure
+*/
+func (r *ShapeResolver) Resolve(ctx context.Context, itemId string, tag string) (*VSFileDocument, error) {
+	shapes, shapesErr := VSItemShapes(ctx, r.communicator, itemId, tag)
+	if shapesErr != nil {
+		return nil, shapesErr
+	}
+	if len(shapes) == 0 {
+		return nil, fmt.Errorf("item %s has no shape tagged '%s': %w", itemId, tag, apierror.ErrNotFound)
+	}
+
+	var best *VSFileDocument
+	var lookupErr error
+	for _, shape := range shapes {
+		files := shape.Files()
+		for i := range files {
+			file := &files[i]
+			if file.State != "CLOSED" {
+				continue
+			}
+			state, stateErr := r.storageState(ctx, file.StorageId)
+			if stateErr != nil {
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				r.communicator.logger().Warn("Could not look up storage, passing over its copy of the shape", "itemId", itemId, "shape", tag, "storageId", file.StorageId, "error", stateErr)
+				lookupErr = stateErr
+				continue
+			}
+			if state != "ONLINE" {
+				continue
+			}
+			if best == nil || r.rank(file.StorageId) < r.rank(best.StorageId) {
+				best = file
+			}
+		}
+	}
+	if best == nil && lookupErr != nil {
+		return nil, fmt.Errorf("no copy of the '%s' shape of item %s could be checked: %w", tag, itemId, lookupErr)
+	}
+	if best == nil {
+		return nil, fmt.Errorf("no copy of the '%s' shape of item %s is on an online storage: %w", tag, itemId, apierror.ErrNotFound)
+	}
+	r.communicator.logger().Debug("Resolved item shape", "itemId", itemId, "shape", tag, "storageId", best.StorageId, "fileId", best.Id)
+	return best, nil
+}
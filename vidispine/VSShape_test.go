@@ -0,0 +1,118 @@
+package vidispine
+
+import (
+	"context"
+	"errors"
+	"github.com/guardian/deliverable_bundler/apierror"
+	"net/http"
+	"testing"
+)
+
+var sampleItem = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<ItemDocument id="VX-123" xmlns="http://xml.vidispine.com/schema/vidispine">
+    <shape>
+        <id>VX-50</id>
+        <tag>original</tag>
+        <containerComponent>
+            <id>VX-60</id>
+            <file><id>VX-70</id><path>clip.mxf</path><state>CLOSED</state><size>1000</size><storage>VX-1</storage></file>
+            <file><id>VX-71</id><path>clip.mxf</path><state>CLOSED</state><size>1000</size><storage>VX-2</storage></file>
+            <file><id>VX-72</id><path>clip.mxf</path><state>CLOSED</state><size>1000</size><storage>VX-3</storage></file>
+            <file><id>VX-73</id><path>clip.mxf</path><state>LOST</state><size>1000</size><storage>VX-4</storage></file>
+        </containerComponent>
+    </shape>
+    <shape>
+        <id>VX-51</id>
+        <tag>lowres</tag>
+        <videoComponent>
+            <id>VX-61</id>
+            <file><id>VX-80</id><path>clip.mp4</path><state>CLOSED</state><size>100</size><storage>VX-1</storage></file>
+        </videoComponent>
+    </shape>
+</ItemDocument>`
+
+func shapeServer(t *testing.T, storageStates map[string]string) *VidispineCommunicator {
+	return testCommunicator(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/API/item/VX-123":
+			w.Write([]byte(sampleItem))
+		default:
+			for storageId, state := range storageStates {
+				if r.URL.Path == "/API/storage/"+storageId {
+					w.Write([]byte("<StorageDocument><id>" + storageId + "</id><state>" + state + "</state></StorageDocument>"))
+					return
+				}
+			}
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+}
+
+func TestShapeFiles(t *testing.T) {
+	comm := shapeServer(t, nil)
+	shapes, err := VSItemShapes(context.Background(), comm, "VX-123", "lowres")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shapes) != 1 || shapes[0].Id != "VX-51" {
+		t.Fatalf("Expected only the lowres shape, got %+v", shapes)
+	}
+	files := shapes[0].Files()
+	if len(files) != 1 || files[0].Id != "VX-80" || files[0].StorageId != "VX-1" {
+		t.Errorf("Expected the video component's file, got %+v", files)
+	}
+}
+
+func TestResolvePicksOnlineCopy(t *testing.T) {
+	comm := shapeServer(t, map[string]string{"VX-1": "OFFLINE", "VX-2": "ONLINE", "VX-3": "ONLINE", "VX-4": "ONLINE"})
+
+	file, err := NewShapeResolver(comm, nil).Resolve(context.Background(), "VX-123", "original")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.Id != "VX-71" || file.StorageId != "VX-2" {
+		t.Errorf("Expected the first online copy, got %s on %s", file.Id, file.StorageId)
+	}
+
+	file, err = NewShapeResolver(comm, []string{"VX-3"}).Resolve(context.Background(), "VX-123", "original")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.Id != "VX-72" {
+		t.Errorf("Expected the copy on the preferred storage, got %s on %s", file.Id, file.StorageId)
+	}
+}
+
+func TestResolveSkipsStorageLookupFailure(t *testing.T) {
+	//VX-1 can't be looked up, but the shape has another copy on an online storage
+	comm := shapeServer(t, map[string]string{"VX-2": "ONLINE"})
+	resolver := NewShapeResolver(comm, []string{"VX-1"})
+
+	file, err := resolver.Resolve(context.Background(), "VX-123", "original")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.Id != "VX-71" || file.StorageId != "VX-2" {
+		t.Errorf("Expected the copy on the storage that could be looked up, got %s on %s", file.Id, file.StorageId)
+	}
+
+	//the lowres shape's only copy is on VX-1, so there is nothing usable left
+	if _, err := resolver.Resolve(context.Background(), "VX-123", "lowres"); err == nil {
+		t.Error("Expected an error when the only copy's storage can't be looked up")
+	}
+}
+
+func TestResolveNotFound(t *testing.T) {
+	comm := shapeServer(t, map[string]string{"VX-1": "OFFLINE"})
+	resolver := NewShapeResolver(comm, nil)
+
+	if _, err := resolver.Resolve(context.Background(), "VX-123", "proxy"); !errors.Is(err, apierror.ErrNotFound) {
+		t.Errorf("Expected a missing shape to be not found, got %v", err)
+	}
+	if _, err := resolver.Resolve(context.Background(), "VX-123", "lowres"); !errors.Is(err, apierror.ErrNotFound) {
+		t.Errorf("Expected a shape with no online copy to be not found, got %v", err)
+	}
+	if _, err := resolver.Resolve(context.Background(), "VX-999", "original"); !errors.Is(err, apierror.ErrNotFound) {
+		t.Errorf("Expected a missing item to be not found, got %v", err)
+	}
+}
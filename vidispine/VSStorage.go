@@ -0,0 +1,48 @@
+package vidispine
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+)
+
+type VSStorageDocument struct {
+	Id    string `xml:"id"`
+	State string `xml:"state"`
+	Type  string `xml:"type"`
+}
+
+/**
+get information about a storage
+*/
+func VSStorageInfo(ctx context.Context, communicator *VidispineCommunicator, storageId string) (*VSStorageDocument, error) {
+	var storageData VSStorageDocument
+	requestUrl := fmt.Sprintf("/API/storage/%s", storageId)
+	headers := map[string]string{
+		"Accept": "application/xml",
+	}
+	result, vsErr := communicator.MakeRequest(ctx, "GET", requestUrl, map[string]string{}, map[string]string{}, headers, nil)
+	if vsErr != nil {
+		communicator.logger().Error("Could not request storage information", "storageId", storageId, "error", vsErr)
+		return nil, vsErr
+	}
+
+	parseErr := xml.Unmarshal(result, &storageData)
+	if parseErr != nil {
+		return nil, parseErr
+	}
+	return &storageData, nil
+}
+
+/**
+ask Vidispine to rescan a storage now, so that the state of its files is brought up to date. This returns once the
+rescan has been requested, not when it has finished
+*/
+func VSRescanStorage(ctx context.Context, communicator *VidispineCommunicator, storageId string) error {
+	requestUrl := fmt.Sprintf("/API/storage/%s/rescan", storageId)
+	_, vsErr := communicator.MakeRequest(ctx, "POST", requestUrl, map[string]string{}, map[string]string{}, map[string]string{}, nil)
+	if vsErr != nil {
+		communicator.logger().Error("Could not request storage rescan", "storageId", storageId, "error", vsErr)
+	}
+	return vsErr
+}
@@ -0,0 +1,264 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/guardian/deliverable_bundler/bundle"
+	"github.com/guardian/deliverable_bundler/jobs"
+	"github.com/guardian/deliverable_bundler/logging"
+	"github.com/guardian/deliverable_bundler/metrics"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+the headers that carry the signature of a payload. The signature is the hex HMAC-SHA256, keyed with the shared
+secret, of the timestamp header value, a full stop, and then the request body. Receivers should check it and
+reject timestamps that are too old, so that a captured request can't be replayed
+*/
+const (
+	SignatureHeader = "X-Bundler-Signature"
+	TimestampHeader = "X-Bundler-Timestamp"
+)
+
+/**
+Failure is one reason a bundle did not complete cleanly
+*/
+type Failure struct {
+	StorageId string `json:"storageId,omitempty"`
+	FileId    string `json:"fileId,omitempty"`
+	ItemId    string `json:"itemId,omitempty"`
+	Reason    string `json:"reason"`
+}
+
+/**
+Payload is the JSON body sent to each webhook when a job finishes
+*/
+type Payload struct {
+	JobId       string                  `json:"jobId"`
+	Status      jobs.JobStatus          `json:"status"`
+	ContentList string                  `json:"contentList"`
+	Output      string                  `json:"output"`
+	Format      string                  `json:"format"`
+	Started     *time.Time              `json:"started,omitempty"`
+	Finished    *time.Time              `json:"finished,omitempty"`
+	Manifest    *bundle.ManifestSummary `json:"manifest,omitempty"` //only present if the bundle was completed
+	Failures    []Failure               `json:"failures"`
+}
+
+/**
+build the payload for a finished job. `result` can be nil if the job never got as far as building the bundle
+*/
+func NewPayload(job *jobs.Job, result *bundle.BundleResult) *Payload {
+	payload := &Payload{
+		JobId:       job.Id,
+		Status:      job.Status,
+		ContentList: job.ContentList,
+		Output:      job.Output,
+		Format:      job.Format,
+		Started:     job.Started,
+		Finished:    job.Finished,
+		Failures:    []Failure{},
+	}
+
+	if result != nil && result.Manifest != nil {
+		summary := result.Manifest.Summary()
+		payload.Manifest = &summary
+	}
+	for _, file := range job.Files {
+		if file.Status == jobs.FileFailed || file.Status == jobs.FileSkipped {
+			payload.Failures = append(payload.Failures, Failure{StorageId: file.StorageId, FileId: file.FileId, ItemId: file.ItemId, Reason: file.Error})
+		}
+	}
+	if result != nil {
+		for _, mismatch := range result.ChecksumFailures {
+			payload.Failures = append(payload.Failures, Failure{Reason: mismatch})
+		}
+	}
+	if job.Error != "" && len(payload.Failures) == 0 {
+		payload.Failures = append(payload.Failures, Failure{Reason: job.Error})
+	}
+	return payload
+}
+
+/**
+Config lists the webhooks to call and how hard to try
+*/
+type Config struct {
+	URLs         []string
+	Secret       string        //shared secret for signing payloads. Payloads are not signed if this is empty
+	MaxAttempts  int           //total number of attempts for each URL, including the first
+	InitialDelay time.Duration //delay before the first retry. This doubles on every attempt
+	MaxDelay     time.Duration //upper limit for the delay between attempts
+	Timeout      time.Duration //timeout for each request
+	Logger       *slog.Logger  //where failed attempts are logged. nil means the default logger
+}
+
+func DefaultConfig() Config {
+	return Config{
+		MaxAttempts:  5,
+		InitialDelay: 2 * time.Second,
+		MaxDelay:     time.Minute,
+		Timeout:      10 * time.Second,
+	}
+}
+
+/**
+parse a comma-separated list of webhook URLs
+*/
+func ParseURLs(list string) []string {
+	var rtn []string
+	for _, part := range strings.Split(list, ",") {
+		if trimmed := strings.TrimSpace(part); trimmed != "" {
+			rtn = append(rtn, trimmed)
+		}
+	}
+	return rtn
+}
+
+/**
+Notifier sends payloads to every configured webhook
+*/
+type Notifier struct {
+	config Config
+	client *http.Client
+}
+
+func NewNotifier(config Config) *Notifier {
+	if config.MaxAttempts < 1 {
+		config.MaxAttempts = 1
+	}
+	return &Notifier{
+		config: config,
+		client: &http.Client{Timeout: config.Timeout},
+	}
+}
+
+/**
+returns the signature for the given body and timestamp
+*/
+func Sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+/**
+an error from a webhook that might go away if we try again
+*/
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string {
+	return e.err.Error()
+}
+
+func (n *Notifier) post(url string, body []byte) error {
+	request, requestErr := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if requestErr != nil {
+		return requestErr
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if n.config.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		request.Header.Set(TimestampHeader, timestamp)
+		request.Header.Set(SignatureHeader, "sha256="+Sign(n.config.Secret, timestamp, body))
+	}
+
+	response, postErr := n.client.Do(request)
+	if postErr != nil {
+		return &retryableError{postErr}
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, response.Body)
+
+	switch {
+	case response.StatusCode >= 200 && response.StatusCode < 300:
+		return nil
+	case response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500:
+		return &retryableError{fmt.Errorf("webhook returned %s", response.Status)}
+	default:
+		return fmt.Errorf("webhook returned %s", response.Status)
+	}
+}
+
+func (n *Notifier) delayFor(attempt int) time.Duration {
+	delay := n.config.InitialDelay
+	for i := 1; i < attempt && delay < n.config.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > n.config.MaxDelay {
+		delay = n.config.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
+
+/**
+send the payload to one URL, retrying with backoff while the endpoint is unavailable
+*/
+func (n *Notifier) sendTo(url string, body []byte, logger *slog.Logger) error {
+	for attempt := 1; ; attempt++ {
+		postErr := n.post(url, body)
+		if postErr == nil {
+			return nil
+		}
+
+		var retryable *retryableError
+		if !errors.As(postErr, &retryable) || attempt >= n.config.MaxAttempts {
+			return fmt.Errorf("could not notify %s after %d attempts: %s", url, attempt, postErr)
+		}
+		delay := n.delayFor(attempt)
+		metrics.Retry(metrics.RetryWebhook)
+		logger.Warn("Could not send webhook, retrying", "url", url, "attempt", attempt, "maxAttempts", n.config.MaxAttempts,
+			"delay", delay, "error", postErr)
+		time.Sleep(delay)
+	}
+}
+
+/**
+send the payload to every webhook at once, and wait until they have all succeeded or given up. Returns the
+failures, if there were any
+*/
+func (n *Notifier) Send(payload *Payload) error {
+	if n == nil || len(n.config.URLs) == 0 {
+		return nil
+	}
+
+	body, marshalErr := json.Marshal(payload)
+	if marshalErr != nil {
+		return marshalErr
+	}
+
+	logger := logging.ForJob(n.config.Logger, payload.JobId)
+	errs := make([]error, len(n.config.URLs))
+	var wg sync.WaitGroup
+	for i, url := range n.config.URLs {
+		wg.Add(1)
+		go func(i int, url string) {
+			defer wg.Done()
+			errs[i] = n.sendTo(url, body, logger)
+		}(i, url)
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,65 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSendRetriesAndSigns(t *testing.T) {
+	var attempts int32
+	var received Payload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		expected := "sha256=" + Sign("secret", r.Header.Get(TimestampHeader), body)
+		if r.Header.Get(SignatureHeader) != expected {
+			t.Errorf("Signature %s does not match %s", r.Header.Get(SignatureHeader), expected)
+		}
+		json.Unmarshal(body, &received)
+	}))
+	defer server.Close()
+
+	config := DefaultConfig()
+	config.URLs = []string{server.URL}
+	config.Secret = "secret"
+	config.InitialDelay = time.Millisecond
+	sendErr := NewNotifier(config).Send(&Payload{JobId: "abc123", Status: "completed", Failures: []Failure{}})
+	if sendErr != nil {
+		t.Fatal("Could not send webhook: ", sendErr)
+	}
+	if attempts != 2 {
+		t.Errorf("Expected 2 attempts, got %d", attempts)
+	}
+	if received.JobId != "abc123" {
+		t.Errorf("Unexpected payload %+v", received)
+	}
+}
+
+func TestSendGivesUpOnClientError(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	config := DefaultConfig()
+	config.URLs = []string{server.URL}
+	config.InitialDelay = time.Millisecond
+	sendErr := NewNotifier(config).Send(&Payload{JobId: "abc123"})
+	if sendErr == nil || !strings.Contains(sendErr.Error(), "404") {
+		t.Errorf("Expected a 404 error, got %v", sendErr)
+	}
+	if attempts != 1 {
+		t.Errorf("Expected a client error not to be retried, got %d attempts", attempts)
+	}
+}